@@ -41,15 +41,32 @@ import (
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/dgraph-io/badger/v3"
 	"github.com/rs/zerolog"
 	"github.com/tauraamui/bluepanda/internal/logging"
 	"github.com/tauraamui/bluepanda/internal/service"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 )
 
+type fsckCmd struct {
+	Dir     string   `arg:"--dir" help:"data directory to check, defaults to the one the server uses"`
+	Require []string `arg:"--require,separate" help:"table=column,... whose rows must hold each column, may be repeated"`
+	Repair  bool     `arg:"--repair" help:"bump sequences which are behind and delete rows missing a column given by --require"`
+}
+
+type convertCmd struct {
+	Dir    string `arg:"--dir" help:"data directory to convert, defaults to the one the server uses"`
+	Table  string `arg:"--table,required" help:"table whose rows to convert"`
+	Layout string `arg:"--layout,required" help:"layout to store the rows in, row or column"`
+}
+
 type args struct {
-	Proto    string `arg:"--proto" default:"grpc"`
-	LogLevel string `arg:"--loglevel" default:"info"`
-	Port     int    `arg:"--port" default:"3000"`
+	Fsck     *fsckCmd    `arg:"subcommand:fsck" help:"check a data directory for inconsistencies"`
+	Convert  *convertCmd `arg:"subcommand:convert" help:"rewrite the rows of a table in another storage layout"`
+	Proto    string      `arg:"--proto" default:"grpc"`
+	LogLevel string      `arg:"--loglevel" default:"info"`
+	Port     int         `arg:"--port" default:"3000"`
 }
 
 func (args) Version() string {
@@ -94,6 +111,91 @@ func run(log logging.Logger, newServer newServerFunc, opts args) {
 	log.Info().Msg("shut down... done")
 }
 
+// openDataDir opens the given data directory, or the one the server uses
+// if none is given.
+func openDataDir(dir string) (kvs.KVDB, error) {
+	if dir == "" {
+		dataDir, err := service.DataDir()
+		if err != nil {
+			return kvs.KVDB{}, err
+		}
+		dir = dataDir
+	}
+
+	conn, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		return kvs.KVDB{}, err
+	}
+
+	return kvs.NewKVDB(conn)
+}
+
+// fsck checks the data directory for problems, printing each one and
+// repairing those it can if asked to. Only rows missing a column given by
+// --require are deleted, as rows of other tables lacking columns may have
+// been stored that way on purpose. It returns how many remain.
+func fsck(log logging.Logger, opts fsckCmd) (int, error) {
+	checkOpts := make([]kvs.CheckOption, 0, len(opts.Require))
+	for _, r := range opts.Require {
+		table, columns, ok := strings.Cut(r, "=")
+		if !ok || table == "" || columns == "" {
+			return 0, fmt.Errorf("--require %q is not table=column,...", r)
+		}
+		checkOpts = append(checkOpts, kvs.WithRequired(table, strings.Split(columns, ",")...))
+	}
+
+	db, err := openDataDir(opts.Dir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	report, err := kvs.Check(db, checkOpts...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	log.Info().Msgf("scanned %d keys, found %d problems", report.KeysScanned, len(report.Problems))
+
+	if !opts.Repair || len(report.Problems) == 0 {
+		return len(report.Problems), nil
+	}
+
+	repaired, err := kvs.Repair(db, report)
+	if err != nil {
+		return 0, err
+	}
+	log.Info().Msgf("repaired %d problems", repaired)
+
+	return len(report.Problems) - repaired, nil
+}
+
+// convert rewrites every row of a table in the layout asked for. Nothing
+// else may have the data directory open while it runs.
+func convert(log logging.Logger, opts convertCmd) error {
+	layout, err := storage.ParseLayout(opts.Layout)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDataDir(opts.Dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	converted, err := storage.ConvertTable(storage.New(db), opts.Table, layout)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("converted %d rows of %s to the %s layout", converted, opts.Table, layout)
+
+	return nil
+}
+
 func main() {
 	var args args
 	p := arg.MustParse(&args)
@@ -106,6 +208,24 @@ func main() {
 	zerolog.SetGlobalLevel(logLevel)
 	log := logging.New()
 
+	if args.Fsck != nil {
+		remaining, err := fsck(log, *args.Fsck)
+		if err != nil {
+			log.Fatal().Msgf("error: %s", err)
+		}
+		if remaining > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.Convert != nil {
+		if err := convert(log, *args.Convert); err != nil {
+			log.Fatal().Msgf("error: %s", err)
+		}
+		return
+	}
+
 	proto := strings.ToLower(args.Proto)
 	switch proto {
 	case "http":
@@ -0,0 +1,296 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+const kvsPath = "github.com/tauraamui/bluepanda/pkg/kvs"
+
+// column is a column of a struct type and the field holding it.
+type column struct {
+	Name      string
+	Expr      string // selector of the field from the receiver, such as p.Address.City
+	Zero      string // condition which holds when an omitempty field is non-zero
+	OmitEmpty bool
+	UUID      bool
+}
+
+// typeSpec is a struct type methods are generated for.
+type typeSpec struct {
+	Name     string
+	Receiver string
+	Columns  []column
+}
+
+// file is the generated source for a package.
+type file struct {
+	Package string
+	Args    string
+	Types   []typeSpec
+	Codec   bool
+	Reflect bool
+}
+
+// loadPackage parses and type checks the Go files of the package in dir.
+// Type errors are ignored, as previously generated methods may no longer
+// match the types they were generated for.
+func loadPackage(dir string) (*types.Package, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	files := []*ast.File{}
+	for _, name := range bp.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	pkg, _ := conf.Check(bp.ImportPath, fset, files, nil)
+	if pkg == nil {
+		return nil, fmt.Errorf("unable to type check package in %s", dir)
+	}
+	return pkg, nil
+}
+
+// generate returns the source of Entries and LoadEntry methods for each
+// of the named struct types of pkg.
+func generate(pkg *types.Package, typeNames []string) ([]byte, error) {
+	out := file{
+		Package: pkg.Name(),
+		Args:    strings.Join(typeNames, ","),
+	}
+
+	for _, name := range typeNames {
+		obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+		if !ok {
+			return nil, fmt.Errorf("type %s not found in package %s", name, pkg.Name())
+		}
+		st, ok := obj.Type().Underlying().(*types.Struct)
+		if !ok {
+			return nil, fmt.Errorf("type %s is not a struct", name)
+		}
+
+		spec := typeSpec{Name: name, Receiver: strings.ToLower(name[:1])}
+		columns, err := appendColumns(nil, st, "", spec.Receiver, kvs.FieldOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("type %s: %w", name, err)
+		}
+		for _, c := range columns {
+			out.Codec = out.Codec || !c.UUID
+			out.Reflect = out.Reflect || (c.OmitEmpty && strings.HasPrefix(c.Zero, "!reflect."))
+		}
+		spec.Columns = columns
+		out.Types = append(out.Types, spec)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, out); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// appendColumns lists the columns of st as kvs.Columns would for the
+// equivalent reflect type, so that generated methods store values exactly
+// as reflection does.
+func appendColumns(columns []column, st *types.Struct, prefix, expr string, inherited kvs.FieldOptions) ([]column, error) {
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		if !f.Exported() {
+			continue
+		}
+
+		if t, ok := f.Type().(*types.Basic); ok && t.Kind() == types.Invalid {
+			return nil, fmt.Errorf("field %s: type could not be resolved", f.Name())
+		}
+
+		fOpts, err := kvs.ParseFieldTag(f.Name(), reflect.StructTag(st.Tag(i)))
+		if err != nil {
+			return nil, err
+		}
+		if fOpts.Ignore || fOpts.Children != "" {
+			continue
+		}
+		fOpts.OmitEmpty = fOpts.OmitEmpty || inherited.OmitEmpty
+
+		sel := expr + "." + f.Name()
+
+		if nested, ok := nestedStruct(f.Type()); ok {
+			if fOpts.Index || fOpts.HasDefault {
+				return nil, fmt.Errorf("field %s: mdb tag options index and default can't be used on a nested struct", f.Name())
+			}
+			p := prefix
+			if !f.Embedded() || fOpts.Name != "" {
+				p += fOpts.ColumnName(f.Name()) + "."
+			}
+			if columns, err = appendColumns(columns, nested, p, sel, fOpts); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		columns = append(columns, column{
+			Name:      prefix + fOpts.ColumnName(f.Name()),
+			Expr:      sel,
+			Zero:      nonZero(sel, f.Type()),
+			OmitEmpty: fOpts.OmitEmpty,
+			UUID:      isUUID(f.Type()),
+		})
+	}
+
+	return columns, nil
+}
+
+// nestedStruct reports whether a field of type t is flattened into
+// sub-columns, returning the struct it holds. Structs which marshal
+// themselves, such as time.Time, are stored whole.
+func nestedStruct(t types.Type) (*types.Struct, bool) {
+	st, ok := t.Underlying().(*types.Struct)
+	if !ok {
+		return nil, false
+	}
+	methods := types.NewMethodSet(types.NewPointer(t))
+	for _, name := range []string{"MarshalJSON", "MarshalText"} {
+		if methods.Lookup(nil, name) != nil {
+			return nil, false
+		}
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		if st.Field(i).Exported() {
+			return st, true
+		}
+	}
+	return nil, false
+}
+
+func isUUID(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == kvsPath && obj.Name() == "UUID"
+}
+
+// nonZero returns a condition which holds when the field selected by expr
+// isn't the zero value of its type.
+func nonZero(expr string, t types.Type) string {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			return expr
+		case u.Info()&types.IsString != 0:
+			return expr + ` != ""`
+		case u.Info()&types.IsNumeric != 0:
+			return expr + " != 0"
+		}
+	case *types.Pointer, *types.Slice, *types.Map, *types.Interface, *types.Chan, *types.Signature:
+		return expr + " != nil"
+	}
+	return "!reflect.ValueOf(" + expr + ").IsZero()"
+}
+
+var tmpl = template.Must(template.New("file").Parse(`// Code generated by bluepanda-gen -type {{.Args}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"fmt"
+	{{- if .Reflect}}
+	"reflect"
+	{{- end}}
+	"strings"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	{{- if .Codec}}
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	{{- end}}
+)
+{{range $t := .Types}}
+// Entries converts {{$t.Receiver}} into the entries it is stored as.
+func ({{$t.Receiver}} *{{$t.Name}}) Entries(tableName string, ownerID kvs.UUID, rowID uint32) ([]kvs.Entry, error) {
+	entries := make([]kvs.Entry, 0, {{len $t.Columns}})
+	{{- range $t.Columns}}
+	{{if .OmitEmpty}}if {{.Zero}} {{end}}{
+		data, meta, err := {{if .UUID}}kvs.EncodeUUID{{else}}codec.Encode{{end}}({{.Expr}})
+		if err != nil {
+			return nil, fmt.Errorf("{{.Name}}: %w", err)
+		}
+		entries = append(entries, kvs.Entry{TableName: tableName, ColumnName: "{{.Name}}", OwnerUUID: ownerID, RowID: rowID, Data: data, Meta: meta})
+	}
+	{{- end}}
+	return entries, nil
+}
+
+// LoadEntry sets the field of {{$t.Receiver}} which holds the entry's column.
+func ({{$t.Receiver}} *{{$t.Name}}) LoadEntry(entry kvs.Entry) error {
+	var err error
+	switch strings.ToLower(entry.ColumnName) {
+	{{- range $t.Columns}}
+	case "{{.Name}}":
+		err = {{if .UUID}}kvs.DecodeUUID{{else}}codec.Decode{{end}}(entry.Data, entry.Meta, &{{.Expr}})
+	{{- end}}
+	default:
+		return fmt.Errorf("struct does not have a field with name %q", entry.ColumnName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to convert entry data to field type: %v", err)
+	}
+	return nil
+}
+{{end}}`))
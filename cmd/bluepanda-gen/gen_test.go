@@ -29,66 +29,50 @@
 // ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
 // POSSIBILITY OF SUCH DAMAGE.
 
-package kvs
+package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/matryer/is"
 )
 
-func TestConvertToBytes(t *testing.T) {
+func TestGenerateMatchesGoldenFile(t *testing.T) {
 	is := is.New(t)
 
-	// Test input and expected output.
-	tests := []struct {
-		input    interface{}
-		expected []byte
-	}{
-		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
-		{"hello", []byte("hello")},
-		{struct{ A int }{5}, []byte("{\"A\":5}")},
-	}
-
-	// Iterate over the tests and compare the output of convertToBytes to the expected output.
-	for _, test := range tests {
-		result, err := convertToBytes(test.input)
-		is.NoErr(err)
-		is.Equal(result, test.expected)
-	}
-}
-
-func TestConvertBytesFromBytes(t *testing.T) {
-	is := is.New(t)
+	pkg, err := loadPackage(filepath.Join("testdata", "parcels"))
+	is.NoErr(err)
 
-	input := []byte{1, 2, 3}
-	var destination []byte
-	err := convertFromBytes(input, &destination)
+	src, err := generate(pkg, []string{"Parcel", "Item"})
 	is.NoErr(err)
-	is.Equal(destination, input)
 
+	golden, err := os.ReadFile(filepath.Join("testdata", "parcels", "parcels_bluepanda.go.golden"))
+	is.NoErr(err)
+	is.Equal(string(src), string(golden))
 }
 
-func TestConvertStringFromBytes(t *testing.T) {
+func TestGenerateRejectsWhatColumnsWould(t *testing.T) {
 	is := is.New(t)
 
-	input := []byte("hello")
-	var destination string
-	err := convertFromBytes(input, &destination)
+	pkg, err := loadPackage(filepath.Join("testdata", "invalid"))
 	is.NoErr(err)
-	is.Equal(destination, string(input))
-}
 
-func TestConvertStructFromBytes(t *testing.T) {
-	is := is.New(t)
+	tests := []struct {
+		typeName string
+		msg      string
+	}{
+		{"Missing", "type Missing not found in package invalid"},
+		{"NotStruct", "type NotStruct is not a struct"},
+		{"UnknownOption", `type UnknownOption: field Name: unknown mdb tag option "primary"`},
+		{"IndexedNested", "type IndexedNested: field Address: mdb tag options index and default can't be used on a nested struct"},
+		{"Unresolved", "type Unresolved: field Shape: type could not be resolved"},
+	}
 
-	type TestStruct struct {
-		A int
-		B string
+	for _, tt := range tests {
+		_, err := generate(pkg, []string{tt.typeName})
+		is.True(err != nil) // type should be rejected
+		is.Equal(err.Error(), tt.msg)
 	}
-	input := []byte("{\"A\":5,\"B\":\"hello\"}")
-	var destination TestStruct
-	err := convertFromBytes(input, &destination)
-	is.NoErr(err)
-	is.Equal(destination, TestStruct{A: 5, B: "hello"})
 }
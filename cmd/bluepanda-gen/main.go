@@ -0,0 +1,96 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Command bluepanda-gen generates Entries and LoadEntry methods for struct
+// types, which storage uses to save and load values without reflection.
+// It is meant to be run by go generate, with a directive such as
+//
+//	//go:generate go run github.com/tauraamui/bluepanda/cmd/bluepanda-gen -type Passenger,Ticket
+//
+// in a file of the package declaring the types.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+)
+
+type args struct {
+	Types  []string `arg:"-t,--type,required" help:"comma separated names of the struct types to generate methods for"`
+	Output string   `arg:"-o,--output" help:"file to write, defaults to <type>_bluepanda.go in the package directory"`
+	Dir    string   `arg:"positional" default:"." help:"directory of the package declaring the types"`
+}
+
+func (args) Version() string {
+	return "bluepanda-gen v0.0.0"
+}
+
+func main() {
+	var args args
+	arg.MustParse(&args)
+
+	typeNames := []string{}
+	for _, t := range args.Types {
+		for _, name := range strings.Split(t, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				typeNames = append(typeNames, name)
+			}
+		}
+	}
+
+	output := args.Output
+	if output == "" {
+		output = filepath.Join(args.Dir, strings.ToLower(typeNames[0])+"_bluepanda.go")
+	}
+
+	if err := run(args.Dir, typeNames, output); err != nil {
+		fmt.Fprintf(os.Stderr, "bluepanda-gen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, typeNames []string, output string) error {
+	pkg, err := loadPackage(dir)
+	if err != nil {
+		return err
+	}
+
+	src, err := generate(pkg, typeNames)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(output, src, 0o644)
+}
@@ -0,0 +1,19 @@
+package invalid
+
+type NotStruct []string
+
+type UnknownOption struct {
+	Name string `mdb:"primary"`
+}
+
+type Address struct {
+	City string
+}
+
+type IndexedNested struct {
+	Address Address `mdb:"index"`
+}
+
+type Unresolved struct {
+	Shape geometry.Shape
+}
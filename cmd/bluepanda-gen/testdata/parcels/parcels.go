@@ -0,0 +1,43 @@
+package parcels
+
+import (
+	"time"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+type Audit struct {
+	CreatedAt time.Time
+	CreatedBy string `mdb:"name=author"`
+}
+
+type Address struct {
+	City     string
+	Postcode string `mdb:"index"`
+}
+
+type Parcel struct {
+	Audit
+	ID       uint32 `mdb:"ignore"`
+	Owner    kvs.UUID
+	Label    string `mdb:"name=title,omitempty"`
+	Weight   float64
+	Fragile  bool `mdb:"omitempty"`
+	Address  Address
+	Return   Address `mdb:"omitempty"`
+	Tags     []string
+	Dims     map[string]int `mdb:"omitempty"`
+	Insured  *bool
+	Items    []Item `mdb:"children=parcel"`
+	internal string
+}
+
+func (p Parcel) TableName() string { return "parcels" }
+
+type Item struct {
+	ID     uint32 `mdb:"ignore"`
+	Parcel kvs.UUID
+	Name   string
+}
+
+func (i Item) TableName() string { return "items" }
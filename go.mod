@@ -10,7 +10,7 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/matryer/is v1.4.1
 	github.com/rs/zerolog v1.30.0
-	github.com/tauraamui/bluepanda/pkg/kvs v0.0.1
+	github.com/tauraamui/bluepanda/pkg/kvs v0.0.2
 	google.golang.org/grpc v1.57.0
 	google.golang.org/protobuf v1.31.0
 )
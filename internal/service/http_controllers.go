@@ -33,28 +33,42 @@ package service
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"io"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/tauraamui/bluepanda/internal/logging"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	"github.com/tauraamui/bluepanda/pkg/kvs/query"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 )
 
-const JSONNumber = byte(99)
+// JSONNumber is the meta byte JSON numbers were stored with before the
+// codec, which still reads them.
+const JSONNumber = codec.LegacyNumber
 
 type typedEntry struct {
 	t reflect.Type
 	e kvs.Entry
 }
 
+// rowIDKey is the key under which each fetched row's ID is returned.
+const rowIDKey = "_id"
+
+// ownerKey is the key under which each fetched row's owner is returned,
+// when the rows fetched may belong to more than one owner.
+const ownerKey = "_owner"
+
 func handleFetch(log logging.Logger, store kvs.KVDB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		ttype := c.Params("type")
@@ -64,48 +78,14 @@ func handleFetch(log logging.Logger, store kvs.KVDB) fiber.Handler {
 		log.Debug().Msgf("%s", c.Body())
 		json.Unmarshal(c.Body(), &data)
 
-		blankEntries := convertToBlankTypesEntries(ttype, resolveOwnerID(uuidx), uint32(0), data)
-
-		dest := []rawData{}
-		for _, ent := range blankEntries {
-			// iterate over all stored values for this entry
-			prefix := ent.PrefixKey()
-			if err := store.View(func(txn *badger.Txn) error {
-				it := txn.NewIterator(badger.DefaultIteratorOptions)
-				defer it.Close()
-
-				var destinationindex uint32 = 0
-				for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-					item := it.Item()
-					if err := item.Value(func(val []byte) error {
-						ent.Data = val
-						return nil
-					}); err != nil {
-						return err
-					}
-					ent.Meta = item.UserMeta()
-
-					if len(dest) == 0 || destinationindex >= uint32(len(dest)) {
-						dest = append(dest, rawData{})
-					}
-
-					var v any
-					if ent.Meta != JSONNumber {
-						v = reflect.New(reflect.TypeOf(createInstanceOfKind(reflect.Kind(ent.Meta)))).Interface()
-						if err := convertFromBytes(ent.Data, v); err != nil {
-							return err
-						}
-					} else {
-						v = json.Number(string(ent.Data))
-					}
-					dest[destinationindex][ent.ColumnName] = v
-
-					destinationindex++
-				}
-				return nil
-			}); err != nil {
-				return err
-			}
+		owner, err := resolveOwnerID(uuidx)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+
+		dest, err := fetchRows(store, ttype, owner, c.QueryInt("descendants"), data)
+		if err != nil {
+			return err
 		}
 
 		log.Debug().Msg("loaded entry successfully...")
@@ -114,309 +94,478 @@ func handleFetch(log logging.Logger, store kvs.KVDB) fiber.Handler {
 	}
 }
 
-type PKS map[string]*badger.Sequence
+// fetchRows loads the given columns of a table, joining them on row ID.
+// Columns which a row has no value for are returned as nil. A non-zero
+// depth also fetches rows of the owners beneath owner, as found by
+// storage.DescendantOwners.
+func fetchRows(db kvs.KVDB, tableName string, owner kvs.UUID, depth int, columns []string) ([]rawData, error) {
+	lowered := make([]string, len(columns))
+	for i, column := range columns {
+		lowered[i] = strings.ToLower(column)
+	}
+
+	s := storage.New(db)
+	var ownerIDs map[string]struct{}
+	if _, ok := owner.(kvs.AnyOwner); !ok && depth != 0 {
+		owners, err := storage.DescendantOwners(s, owner, depth)
+		if err != nil {
+			return nil, err
+		}
+		ownerIDs = make(map[string]struct{}, len(owners))
+		for _, o := range owners {
+			ownerIDs[o.String()] = struct{}{}
+		}
+		owner = kvs.AnyOwner{}
+	}
 
-type rawData map[string]any
+	scanned, err := storage.ExpandColumns(s, tableName, owner, lowered)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := storage.LoadRows(s, tableName, owner, scanned...)
+	if err != nil {
+		return nil, err
+	}
 
-func handleInserts(log logging.Logger, store kvs.KVDB, gpks PKS) fiber.Handler {
+	_, spansOwners := owner.(kvs.AnyOwner)
+	dest := make([]rawData, 0, len(rows))
+	for _, row := range rows {
+		if ownerIDs != nil {
+			if _, ok := ownerIDs[row.Owner.String()]; !ok {
+				continue
+			}
+		}
+		data, err := rowData(row, lowered)
+		if err != nil {
+			return nil, err
+		}
+		if spansOwners {
+			data[ownerKey] = row.Owner.String()
+		}
+		dest = append(dest, data)
+	}
+
+	return dest, nil
+}
+
+// renderRowID renders numeric row IDs as numbers and any other as text.
+func renderRowID(id kvs.RowID) any {
+	if n, ok := id.Numeric(); ok {
+		return n
+	}
+	return id.String()
+}
+
+// rowData renders the given columns of a row. Objects which were
+// flattened into sub-columns are reassembled under the column named.
+func rowData(row storage.Row, columns []string) (rawData, error) {
+	data := rawData{rowIDKey: renderRowID(row.ResolveRowID())}
+	for _, column := range columns {
+		if ent, ok := row.Entry(column); ok {
+			v, err := renderEntry(ent)
+			if err != nil {
+				return nil, err
+			}
+			data[column] = v
+			continue
+		}
+
+		object, err := objectData(row, column)
+		if err != nil {
+			return nil, err
+		}
+		if object == nil {
+			data[column] = nil
+			continue
+		}
+		data[column] = object
+	}
+	return data, nil
+}
+
+// objectData nests the sub-columns of a row stored beneath column back
+// into the object they were flattened from, or returns nil if there are
+// none.
+func objectData(row storage.Row, column string) (map[string]any, error) {
+	var object map[string]any
+	prefix := strings.ToLower(column) + "."
+	for name, ent := range row.Entries {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		path := strings.TrimPrefix(name, prefix)
+		v, err := renderEntry(ent)
+		if err != nil {
+			return nil, err
+		}
+
+		if object == nil {
+			object = map[string]any{}
+		}
+		parent := object
+		keys := strings.Split(path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := parent[key].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[keys[len(keys)-1]] = v
+	}
+	return object, nil
+}
+
+// renderEntry decodes an entry into the value returned for it, with
+// UUIDs, times and durations written as text.
+func renderEntry(ent kvs.Entry) (any, error) {
+	v, err := decodeEntry(ent)
+	if err != nil {
+		return nil, err
+	}
+	if text, ok := codec.Text(v); ok {
+		return text, nil
+	}
+	return v, nil
+}
+
+type aggregateRequest struct {
+	Op      string           `json:"op"`
+	Column  string           `json:"column"`
+	GroupBy string           `json:"groupby"`
+	Filters map[string][]any `json:"filters"`
+}
+
+func handleAggregate(log logging.Logger, store kvs.KVDB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		ttype := c.Params("type")
 		uuidx := c.Params("uuid")
 
-		data := rawData{}
+		req := aggregateRequest{}
 		decoder := json.NewDecoder(bytes.NewReader(c.Body()))
 		decoder.UseNumber()
-		if err := decoder.Decode(&data); err != nil {
+		if err := decoder.Decode(&req); err != nil {
 			return err
 		}
 
-		rowID, err := nextRowID(store, resolveOwnerID(uuidx), ttype, gpks)
+		owner, err := resolveOwnerID(uuidx)
 		if err != nil {
-			return err
+			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
-		entries := convertToEntries(ttype, resolveOwnerID(uuidx), rowID, data, true)
 
-		for _, entry := range entries {
-			if err := kvs.Store(store, entry); err != nil {
-				log.Error().Msgf("failed to store entry: %v", err)
-				return c.SendStatus(http.StatusInternalServerError)
-			}
+		result, err := runAggregate(store, ttype, owner, req)
+		if err != nil {
+			log.Error().Msgf("failed to aggregate entries: %v", err)
+			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
 
-		log.Debug().Msg("stored entry successfully...")
+		log.Debug().Msg("aggregated entries successfully...")
 
-		return nil
+		return c.JSON(result)
 	}
 }
 
-func resolveOwnerID(v string) kvs.UUID {
-	if v == "root" {
-		return kvs.RootOwner{}
+func runAggregate(db kvs.KVDB, tableName string, owner kvs.UUID, req aggregateRequest) (query.Aggregate, error) {
+	op, err := query.ParseAggregateOp(req.Op)
+	if err != nil {
+		return query.Aggregate{}, err
+	}
+
+	q := query.New()
+	for column, values := range req.Filters {
+		q = q.Filter(column).Eq(values...)
+	}
+	if req.GroupBy != "" {
+		q = q.GroupBy(req.GroupBy)
 	}
-	return uuid.MustParse(v)
+
+	return query.AggregateTable(storage.New(db), tableName, owner, q, op, req.Column, decodeEntry)
 }
 
-func loadItemDataIntoEntry(ent *kvs.Entry, fn func(func(val []byte) error) error) error {
-	return fn(func(val []byte) error {
-		return convertFromBytes(val, &ent.Data)
-	})
+func decodeEntry(ent kvs.Entry) (any, error) {
+	return codec.DecodeValue(ent.Data, ent.Meta)
 }
 
-func convertToBlankTypesEntries(tableName string, ownerUUID kvs.UUID, rowID uint32, data []string) []kvs.Entry {
-	entries := []kvs.Entry{}
-	for _, k := range data {
-		e := kvs.Entry{
-			TableName:  tableName,
-			ColumnName: strings.ToLower(k),
-			OwnerUUID:  ownerUUID,
-			RowID:      rowID,
+func handleQuery(log logging.Logger, store kvs.KVDB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		dest, err := runQuery(log, store, string(c.Body()))
+		if err != nil {
+			log.Error().Msgf("failed to run query: %v", err)
+			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
 
-		entries = append(entries, e)
+		return c.JSON(dest)
 	}
-	return entries
 }
 
-func convertToBlankEntries(tableName string, ownerUUID kvs.UUID, rowID uint32, data map[string]any) []kvs.Entry {
-	return convertToEntries(tableName, ownerUUID, rowID, data, false)
+func runQuery(log logging.Logger, db kvs.KVDB, src string) ([]rawData, error) {
+	q, err := query.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, stats, err := query.RunTableWithStats(storage.New(db), q, decodeEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().
+		Str("plan", query.Explain(q).String()).
+		Int("keys_scanned", stats.KeysScanned).
+		Int("bytes_read", stats.BytesRead).
+		Int("rows_matched", stats.RowsMatched).
+		Str("duration", stats.Duration.String()).
+		Msg("ran query successfully...")
+
+	_, spansOwners := q.Owner().(kvs.AnyOwner)
+	dest := make([]rawData, 0, len(rows))
+	for _, row := range rows {
+		// select * returns whichever columns each row has values for, with
+		// objects reassembled from their sub-columns
+		columns := q.Columns()
+		if len(columns) == 0 {
+			seen := map[string]struct{}{}
+			for column := range row.Entries {
+				column, _, _ = strings.Cut(column, ".")
+				if _, ok := seen[column]; !ok {
+					seen[column] = struct{}{}
+					columns = append(columns, column)
+				}
+			}
+		}
+
+		data, err := rowData(row, columns)
+		if err != nil {
+			return nil, err
+		}
+		if spansOwners {
+			data[ownerKey] = row.Owner.String()
+		}
+		dest = append(dest, data)
+	}
+
+	return dest, nil
 }
 
-func convertToEntries(tableName string, ownerUUID kvs.UUID, rowID uint32, data map[string]any, includeData bool) []kvs.Entry {
-	entries := []kvs.Entry{}
+// PKS hands out the row IDs of inserted rows, with a generator for each
+// strategy an insert can ask for. It is safe for concurrent use, so one
+// can be shared by every handler.
+type PKS struct {
+	mu  sync.Mutex
+	ids map[string]storage.IDGenerator
+}
+
+// rowIDHeader is the response header an inserted row's ID is returned in.
+const rowIDHeader = "Bluepanda-Row-Id"
+
+type rawData map[string]any
+
+// handleInserts stores the posted object as a new row. Its row ID is
+// handed out by the strategy named by the ids query parameter, one of
+// sequence, the default, uint64, uuid or ulid, or is taken from the column
+// named by the key parameter. The ID is returned in a response header.
+// Strings are stored as text unless the infer parameter is true, when
+// those holding a UUID, time or duration are stored as one.
+func handleInserts(log logging.Logger, store kvs.KVDB, gpks *PKS) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ttype := c.Params("type")
+		uuidx := c.Params("uuid")
 
-	for k, v := range data {
-		jsonNum, isJSONNumber := v.(json.Number)
-		e := kvs.Entry{
-			TableName:  tableName,
-			ColumnName: strings.ToLower(k),
-			OwnerUUID:  ownerUUID,
-			RowID:      rowID,
-			Meta:       byte(reflect.TypeOf(v).Kind()),
+		data := rawData{}
+		decoder := json.NewDecoder(bytes.NewReader(c.Body()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return err
 		}
 
-		if isJSONNumber {
-			e.Meta = JSONNumber
+		owner, err := resolveOwnerID(uuidx)
+		if err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
 
-		if includeData {
-			if !isJSONNumber {
+		if c.QueryBool("infer") {
+			codec.InferAll(data)
+		}
 
-				bd, err := convertToBytes(v)
-				if err != nil {
-					return entries
-				}
-				e.Data = bd
-			} else {
-				e.Data = []byte(jsonNum.String())
+		rowID, err := insertRow(store, gpks, ttype, owner, data, c.Query("ids"), c.Query("key"))
+		if err != nil {
+			var badRequest *insertError
+			switch {
+			case errors.As(err, &badRequest):
+				return fiber.NewError(http.StatusBadRequest, err.Error())
+			case errors.Is(err, storage.ErrRowExists):
+				return fiber.NewError(http.StatusConflict, err.Error())
 			}
+			log.Error().Msgf("failed to store entry: %v", err)
+			return c.SendStatus(http.StatusInternalServerError)
 		}
+		c.Set(rowIDHeader, rowID.String())
 
-		entries = append(entries, e)
-	}
-
-	return entries
-}
+		log.Debug().Msg("stored entry successfully...")
 
-func createInstanceOfKind(kind reflect.Kind) any {
-	switch kind {
-	case reflect.Bool:
-		return false
-	case reflect.Int:
-		return int(0)
-	case reflect.Int8:
-		return int8(0)
-	case reflect.Int16:
-		return int16(0)
-	case reflect.Int32:
-		return int32(0)
-	case reflect.Int64:
-		return int64(0)
-	case reflect.Uint:
-		return uint(0)
-	case reflect.Uint8:
-		return uint8(0)
-	case reflect.Uint16:
-		return uint16(0)
-	case reflect.Uint32:
-		return uint32(0)
-	case reflect.Uint64:
-		return uint64(0)
-	case reflect.Uintptr:
-		return uintptr(0)
-	case reflect.Float32:
-		return float32(0)
-	case reflect.Float64:
-		return float64(0)
-	case reflect.Complex64:
-		return complex64(0)
-	case reflect.Complex128:
-		return complex128(0)
-	case reflect.Interface:
-		return new(interface{})
-	case reflect.String:
-		return ""
-	default:
 		return nil
 	}
 }
 
-func convertToBytes(i interface{}) ([]byte, error) {
-	switch v := i.(type) {
-	case []byte:
-		return v, nil
-	case string:
-		return []byte(v), nil
-	case int:
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, uint32(v))
-		return buf, nil
-	case int32:
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, uint32(v))
-		return buf, nil
-	case int64:
-		buf := make([]byte, 8)
-		binary.BigEndian.PutUint64(buf, uint64(v))
-		return buf, nil
-	case uint:
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, uint32(v))
-		return buf, nil
-	case uint32:
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, v)
-		return buf, nil
-	case uint64:
-		buf := make([]byte, 8)
-		binary.BigEndian.PutUint64(buf, v)
-		return buf, nil
-	case float32:
-		bits := math.Float32bits(v)
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, bits)
-		return buf, nil
-	case float64:
-		bits := math.Float64bits(v)
-		buf := make([]byte, 8)
-		binary.BigEndian.PutUint64(buf, bits)
-		return buf, nil
-	case bool:
-		if v {
-			return []byte{1}, nil
-		} else {
-			return []byte{0}, nil
-		}
-	case json.Number:
-		return []byte(v), nil
-	default:
-		return nil, fmt.Errorf("unsupported type")
-	}
-}
+// insertError is an insert which could never succeed as it was asked for.
+type insertError struct{ msg string }
 
-func convertFromBytes(data []byte, i interface{}) error {
-	if reflect.TypeOf(i).Kind() != reflect.Ptr {
-		return fmt.Errorf("destination must be a pointer")
-	}
+func (e *insertError) Error() string { return e.msg }
 
-	switch v := i.(type) {
-	case *[]byte:
-		*v = data
-		return nil
-	case *string:
-		*v = string(data)
-		return nil
-	case *int:
-		if len(data) < 4 {
-			return fmt.Errorf("insufficient data for int")
+// insertRow stores data as a new row of tableName, returning the row ID it
+// was given by the named ID strategy, or taken from its key column.
+func insertRow(db kvs.KVDB, pks *PKS, tableName string, owner kvs.UUID, data rawData, strategy, keyColumn string) (kvs.RowID, error) {
+	var rowID kvs.RowID
+	if keyColumn != "" {
+		if strategy != "" {
+			return "", &insertError{"ids and key cannot both be given"}
 		}
-		*v = int(binary.BigEndian.Uint32(data))
-		return nil
-	case *int32:
-		if len(data) < 4 {
-			return fmt.Errorf("insufficient data for int32")
+		v, ok := data[strings.ToLower(keyColumn)]
+		if !ok {
+			v, ok = data[keyColumn]
 		}
-		*v = int32(binary.BigEndian.Uint32(data))
-		return nil
-	case *int64:
-		if len(data) < 8 {
-			return fmt.Errorf("insufficient data for int64")
+		if !ok {
+			return "", &insertError{fmt.Sprintf("key column %q has no value", keyColumn)}
 		}
-		*v = int64(binary.BigEndian.Uint64(data))
-		return nil
-	case *uint:
-		if len(data) < 4 {
-			return fmt.Errorf("insufficient data for uint")
+		if n, isNumber := v.(json.Number); isNumber {
+			v = n.String()
 		}
-		*v = uint(binary.BigEndian.Uint32(data))
-		return nil
-	case *uint32:
-		if len(data) < 4 {
-			return fmt.Errorf("insufficient data for uint32")
+		id, err := kvs.RowIDOf(v)
+		if err != nil {
+			return "", &insertError{fmt.Sprintf("key column %q: %v", keyColumn, err)}
 		}
-		*v = binary.BigEndian.Uint32(data)
-		return nil
-	case *uint64:
-		if len(data) < 8 {
-			return fmt.Errorf("insufficient data for uint64")
+		rowID = id
+	} else {
+		ids, err := pks.generator(strategy)
+		if err != nil {
+			return "", err
 		}
-		*v = binary.BigEndian.Uint64(data)
-		return nil
-	case *float32:
-		if len(data) < 4 {
-			return fmt.Errorf("insufficient data for float32")
+		if rowID, err = ids.NextID(db, owner, tableName, data); err != nil {
+			return "", err
 		}
-		bits := binary.BigEndian.Uint32(data)
-		*v = math.Float32frombits(bits)
-		return nil
-	case *float64:
-		if len(data) < 8 {
-			return fmt.Errorf("insufficient data for float64")
+	}
+
+	entries, err := convertToEntries(tableName, owner, rowID, data, true)
+	if err != nil {
+		return "", &insertError{err.Error()}
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if keyColumn != "" {
+			// a row keyed by one of its columns mustn't overwrite or merge
+			// into another, whichever columns it was stored with
+			stored, err := storage.RowStored(txn, kvs.Entry{TableName: tableName, OwnerUUID: owner}.WithRowID(rowID))
+			if err != nil {
+				return err
+			}
+			if stored {
+				return fmt.Errorf("%s %s: %w", tableName, rowID, storage.ErrRowExists)
+			}
 		}
-		bits := binary.BigEndian.Uint64(data)
-		*v = math.Float64frombits(bits)
-		return nil
-	case *bool:
-		if len(data) < 1 {
-			return fmt.Errorf("insufficient data for bool")
+		if err := storage.KeepIndexes(txn, entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := txn.SetEntry(badger.NewEntry(entry.Key(), entry.Data).WithMeta(entry.Meta)); err != nil {
+				return err
+			}
 		}
-		*v = data[0] != 0
 		return nil
-	default:
-		return fmt.Errorf("unsupported type")
+	}); err != nil {
+		return "", err
 	}
+
+	return rowID, nil
 }
 
-func nextRowID(db kvs.KVDB, owner kvs.UUID, tableName string, pks map[string]*badger.Sequence) (uint32, error) {
-	seq, err := resolveSequence(db, fmt.Sprintf("%s.%s", owner, tableName), pks)
+// resolveOwnerID parses the owner a request names, which is root, * for
+// any owner, or a UUID.
+func resolveOwnerID(v string) (kvs.UUID, error) {
+	switch v {
+	case "root":
+		return kvs.RootOwner{}, nil
+	case "*":
+		return kvs.AnyOwner{}, nil
+	}
+	id, err := uuid.Parse(v)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("owner %q is not root, * or a UUID: %w", v, err)
 	}
+	return id, nil
+}
 
-	s, err := seq.Next()
+func convertToBlankEntries(tableName string, ownerUUID kvs.UUID, rowID kvs.RowID, data map[string]any) []kvs.Entry {
+	entries, _ := convertToEntries(tableName, ownerUUID, rowID, data, false)
+	return entries
+}
+
+func convertToEntries(tableName string, ownerUUID kvs.UUID, rowID kvs.RowID, data map[string]any, includeData bool) ([]kvs.Entry, error) {
+	entries, err := kvs.MapEntries(kvs.Entry{
+		TableName: tableName,
+		OwnerUUID: ownerUUID,
+	}.WithRowID(rowID), data, nil)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if !includeData {
+		for i := range entries {
+			entries[i].Data, entries[i].Meta = nil, 0
+		}
 	}
-	return uint32(s), nil
+	return entries, nil
 }
 
-func nextSequence(seq *badger.Sequence) (uint32, error) {
-	s, err := seq.Next()
-	if err != nil {
-		return 0, err
+// generator returns the ID generator of the named strategy, creating it
+// the first time it's asked for.
+func (p *PKS) generator(strategy string) (storage.IDGenerator, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ids, ok := p.ids[strategy]; ok {
+		return ids, nil
 	}
-	return uint32(s), nil
+
+	var ids storage.IDGenerator
+	switch strategy {
+	case "", "sequence":
+		ids = storage.SequenceIDs(1)
+	case "uint64":
+		ids = storage.Uint64IDs(1)
+	case "uuid":
+		ids = storage.UUIDv7IDs()
+	case "ulid":
+		ids = storage.ULIDs()
+	default:
+		return nil, &insertError{fmt.Sprintf("unknown ID strategy %q, expected sequence, uint64, uuid or ulid", strategy)}
+	}
+
+	if p.ids == nil {
+		p.ids = map[string]storage.IDGenerator{}
+	}
+	// the strategy may be read from a request, whose memory fiber reuses
+	p.ids[strings.Clone(strategy)] = ids
+	return ids, nil
 }
 
-func resolveSequence(db kvs.KVDB, sequenceKey string, pks map[string]*badger.Sequence) (*badger.Sequence, error) {
-	seq, ok := pks[sequenceKey]
-	var err error
-	if !ok {
-		seq, err = db.GetSeq([]byte(sequenceKey), 1)
-		if err != nil {
-			return nil, err
+// Release gives back the leases of every sequence, carrying on past any
+// which fail so as not to leave the rest leased.
+func (p *PKS) Release() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failed := []string{}
+	for strategy, ids := range p.ids {
+		if c, ok := ids.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				failed = append(failed, err.Error())
+			}
 		}
-		pks[sequenceKey] = seq
+		delete(p.ids, strategy)
 	}
-
-	return seq, nil
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("releasing sequences: %s", strings.Join(failed, "; "))
+	}
+	return nil
 }
@@ -33,6 +33,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -42,13 +43,21 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/matryer/is"
 	"github.com/tauraamui/bluepanda/internal/logging"
 	"github.com/tauraamui/bluepanda/internal/mock"
+	"github.com/tauraamui/bluepanda/pkg/api"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type data struct {
@@ -93,7 +102,70 @@ func TestHandleFetch(t *testing.T) {
 	body, err := ioutil.ReadAll(resp.Body)
 	is.NoErr(err)
 
-	is.Equal(string(body), `[{"name":"mango","size":99.48},{"name":"strawberry","size":15},{"name":"grape","size":"n/a"}]`)
+	is.Equal(string(body), `[{"_id":0,"name":"mango","size":99.48},{"_id":1,"name":"strawberry","size":15},{"_id":2,"name":"grape","size":"n/a"}]`)
+}
+
+func TestHandleFetchWithSparseColumns(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	is.NoErr(insertEntry(store, "fruit", "name", 0, []byte("mango"), reflect.String))
+	is.NoErr(insertEntry(store, "fruit", "size", 0, []byte("99.48"), reflect.Kind(JSONNumber)))
+
+	is.NoErr(insertEntry(store, "fruit", "name", 1, []byte("strawberry"), reflect.String))
+
+	is.NoErr(insertEntry(store, "fruit", "name", 2, []byte("grape"), reflect.String))
+	is.NoErr(insertEntry(store, "fruit", "size", 2, []byte("4"), reflect.Kind(JSONNumber)))
+
+	is.NoErr(insertEntry(store, "fruit", "size", 11, []byte("31"), reflect.Kind(JSONNumber)))
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+
+	resp, err := test(buildPostRequest("/fetch/fruit/root", mustMarshal([]string{"name", "size"})))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+
+	is.Equal(string(body), `[{"_id":0,"name":"mango","size":99.48},{"_id":1,"name":"strawberry","size":null},{"_id":2,"name":"grape","size":4},{"_id":11,"name":null,"size":31}]`)
+}
+
+func TestHandleFetchDescendantsAndAnyOwner(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	shelf := uuid.MustParse("6a1f3c2e-8b4d-4e5f-9a6b-7c8d9e0f1a2b")
+	is.NoErr(insertEntry(store, "shelves", "uuid", 0, []byte(shelf.String()), reflect.String))
+	is.NoErr(insertEntry(store, "jars", "name", 0, []byte("flour"), reflect.String))
+	is.NoErr(kvs.Store(store, kvs.Entry{
+		TableName: "jars", ColumnName: "name", OwnerUUID: shelf, RowID: 0, Data: []byte("honey"), Meta: byte(reflect.String),
+	}))
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+
+	expected := `[{"_id":0,"_owner":"6a1f3c2e-8b4d-4e5f-9a6b-7c8d9e0f1a2b","name":"honey"},{"_id":0,"_owner":"root","name":"flour"}]`
+	for _, path := range []string{"/fetch/jars/root?descendants=1", "/fetch/jars/*"} {
+		resp, err := test(buildPostRequest(path, mustMarshal([]string{"name"})))
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusOK)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		is.NoErr(err)
+		is.Equal(string(body), expected)
+	}
+
+	resp, err := test(buildPostRequest("/fetch/jars/root", mustMarshal([]string{"name"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"name":"flour"}]`)
 }
 
 func TestHandleInserts(t *testing.T) {
@@ -103,7 +175,7 @@ func TestHandleInserts(t *testing.T) {
 	is := is.New(t)
 
 	logWriter := mock.LogWriter{}
-	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, PKS{}))
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
 
 	resp, err := test(buildPostRequest("/insert/fruit/root", mustMarshal(data{
 		Name: "mango",
@@ -120,6 +192,330 @@ func TestHandleInserts(t *testing.T) {
 	is.Equal(string(body), "")
 }
 
+type fruit struct {
+	ID   uint32 `mdb:"ignore"`
+	Name string
+	Size int64
+}
+
+func (f fruit) TableName() string { return "fruit" }
+
+func TestInsertedRowsRoundTripThroughStorage(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+
+	resp, err := test(buildPostRequest("/insert/fruit/root", []byte(`{"name":"mango","size":9007199254740993}`)))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	s := storage.New(store)
+	defer s.Close()
+
+	fruits, err := storage.LoadAll[fruit](s, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(fruits, []fruit{{ID: 0, Name: "mango", Size: 9007199254740993}})
+
+	// rows saved through storage are read back over HTTP
+	is.NoErr(s.Update(kvs.RootOwner{}, &fruit{Name: "durian", Size: -4}, 1))
+
+	resp, err = test(buildPostRequest("/fetch/fruit/root", mustMarshal([]string{"name", "size"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"name":"mango","size":9007199254740993},{"_id":1,"name":"durian","size":-4}]`)
+}
+
+type indexedFruit struct {
+	ID   uint32 `mdb:"ignore"`
+	Name string `mdb:"index"`
+	Size int64
+}
+
+func (f indexedFruit) TableName() string { return "fruit" }
+
+func TestInsertedRowsAreFoundThroughIndexes(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
+
+	s := storage.New(store)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := test(buildPostRequest("/insert/fruit/root", []byte(`{"name":"mango","size":3}`)))
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusOK)
+
+		// the first lookup builds the index, which the second insert keeps
+		fruits, err := storage.LoadAll[indexedFruit](s, kvs.RootOwner{}, storage.WithIndex("name", "mango"))
+		is.NoErr(err)
+		is.Equal(len(fruits), i+1)
+	}
+}
+
+func TestInsertsHandOutRowIDsByTheStrategyAskedFor(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	pks := PKS{}
+	defer pks.Release()
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &pks))
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+
+	insert := func(url string, body string) *http.Response {
+		resp, err := test(buildPostRequest(url, []byte(body)))
+		is.NoErr(err)
+		return resp
+	}
+
+	resp := insert("/insert/fruit/root", `{"name":"mango"}`)
+	is.Equal(resp.Header.Get(rowIDHeader), "0")
+
+	resp = insert("/insert/fruit/root?ids=uuid", `{"name":"kiwi"}`)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	id, err := uuid.Parse(resp.Header.Get(rowIDHeader))
+	is.NoErr(err)
+	is.Equal(id.Version(), uuid.Version(7))
+
+	resp = insert("/insert/fruit/root?ids=ulid", `{"name":"lime"}`)
+	ulid := resp.Header.Get(rowIDHeader)
+	is.Equal(len(ulid), 26)
+
+	resp = insert("/insert/fruit/root?key=name", `{"name":"pear"}`)
+	is.Equal(resp.Header.Get(rowIDHeader), "pear")
+	resp = insert("/insert/fruit/root?key=name", `{"name":"pear"}`)
+	is.Equal(resp.StatusCode, http.StatusConflict)
+	// the row exists whichever of its columns the second insert posts
+	resp = insert("/insert/fruit/root?key=variety", `{"variety":"pear","size":3}`)
+	is.Equal(resp.StatusCode, http.StatusConflict)
+
+	resp = insert("/insert/fruit/root?ids=random", `{"name":"fig"}`)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	resp = insert("/insert/fruit/root?key=colour", `{"name":"fig"}`)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+	resp = insert("/insert/fruit/not-a-uuid", `{"name":"fig"}`)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	resp, err = test(buildPostRequest("/fetch/fruit/root", mustMarshal([]string{"name"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	fetched := []map[string]any{}
+	is.NoErr(json.Unmarshal(body, &fetched))
+	is.Equal(len(fetched), 4)
+	is.Equal(fetched[0], map[string]any{"_id": float64(0), "name": "mango"}) // numeric IDs come first, as numbers
+	is.Equal(fetched[1]["_id"], ulid)                                        // then text IDs in byte order
+	is.Equal(fetched[2]["_id"], id.String())
+	is.Equal(fetched[3]["_id"], "pear")
+}
+
+func TestRPCInsertsRows(t *testing.T) {
+	_, store, _, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	svr := &rpcserver{db: store, pks: &PKS{}}
+	defer svr.pks.Release()
+
+	result, err := svr.Insert(context.Background(), &api.InsertRequest{Type: "fruit", Uuid: "root", Json: []byte(`{"name":"mango","size":3}`)})
+	is.NoErr(err)
+	is.Equal(result.GetId(), "0")
+
+	result, err = svr.Insert(context.Background(), &api.InsertRequest{Type: "fruit", Uuid: "root", Json: []byte(`{"name":"kiwi","size":4}`), Key: "size"})
+	is.NoErr(err)
+	is.Equal(result.GetId(), "4")
+
+	_, err = svr.Insert(context.Background(), &api.InsertRequest{Type: "fruit", Uuid: "root", Json: []byte(`{"name":"lime","size":4}`), Key: "size"})
+	is.Equal(status.Code(err), codes.AlreadyExists)
+
+	// owners which aren't UUIDs are refused rather than panicking
+	_, err = svr.Insert(context.Background(), &api.InsertRequest{Type: "fruit", Uuid: "not-a-uuid", Json: []byte(`{"name":"lime"}`)})
+	is.Equal(status.Code(err), codes.InvalidArgument)
+	_, err = svr.Aggregate(context.Background(), &api.AggregateRequest{Type: "fruit", Uuid: "not-a-uuid", Op: "count"})
+	is.Equal(status.Code(err), codes.InvalidArgument)
+
+	s := storage.New(store)
+	defer s.Close()
+	fruits, err := storage.LoadAll[fruit](s, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(fruits, []fruit{{ID: 0, Name: "mango", Size: 3}, {ID: 4, Name: "kiwi", Size: 4}})
+}
+
+func TestConcurrentInsertsShareSequencesSafely(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	pks := PKS{}
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &pks))
+
+	owners := []string{"root", uuid.NewString()}
+	const workers, inserts = 12, 15
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, workers*inserts)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < inserts; i++ {
+				url := fmt.Sprintf("/insert/fruit/%s", owners[(w+i)%len(owners)])
+				resp, err := test(buildPostRequest(url, mustMarshal(data{Name: fmt.Sprintf("W%d", w), Size: uint32(i)})))
+				if err == nil && resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("inserting into %s: %s", url, resp.Status)
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		is.NoErr(err)
+	}
+	is.NoErr(pks.Release())
+
+	s := storage.New(store)
+	defer s.Close()
+
+	total := 0
+	for _, owner := range owners {
+		ownerID, err := resolveOwnerID(owner)
+		is.NoErr(err)
+		fruits, err := storage.LoadAll[fruit](s, ownerID)
+		is.NoErr(err)
+		for i := range fruits {
+			is.Equal(fruits[i].ID, uint32(i)) // each row ID handed out exactly once
+		}
+		total += len(fruits)
+	}
+	is.Equal(total, workers*inserts)
+}
+
+func TestHandleAggregate(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	passengers := []struct {
+		surname string
+		age     string
+	}{
+		{"Hax", "3"}, {"Hax", "26"}, {"West", "58"}, {"Hax", "27"},
+	}
+	for i, p := range passengers {
+		is.NoErr(insertEntry(store, "passengers", "surname", uint32(i), []byte(p.surname), reflect.String))
+		is.NoErr(insertEntry(store, "passengers", "age", uint32(i), []byte(p.age), reflect.Kind(JSONNumber)))
+	}
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/aggregate/:type/:uuid", handleAggregate(logging.New(&logWriter), store))
+
+	resp, err := test(buildPostRequest("/aggregate/passengers/root", []byte(`{"op":"sum","column":"age","groupby":"surname"}`)))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `{"value":114,"groups":{"Hax":56,"West":58}}`)
+
+	resp, err = test(buildPostRequest("/aggregate/passengers/root", []byte(`{"op":"count","filters":{"surname":["Hax"]}}`)))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `{"value":3}`)
+
+	// nothing matched has no smallest age
+	resp, err = test(buildPostRequest("/aggregate/passengers/root", []byte(`{"op":"min","column":"age","filters":{"surname":["Pond"]}}`)))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `{"value":0,"null":true}`)
+
+	resp, err = test(buildPostRequest("/aggregate/passengers/root", []byte(`{"op":"median","column":"age"}`)))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	svr := &rpcserver{db: store}
+	result, err := svr.Aggregate(context.Background(), &api.AggregateRequest{Type: "passengers", Uuid: "root", Op: "avg", Column: "age", Filters: []*api.Filter{{Column: "surname", Values: []byte(`["Pond"]`)}}})
+	is.NoErr(err)
+	is.True(result.GetNull())
+}
+
+func TestHandleQuery(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	passengers := []struct {
+		name, surname, age string
+	}{
+		{"Brian", "Hax", "3"}, {"Amy", "Hax", "26"}, {"Mark", "West", "58"}, {"Rory", "Hax", "27"},
+	}
+	for i, p := range passengers {
+		is.NoErr(insertEntry(store, "passengers", "name", uint32(i), []byte(p.name), reflect.String))
+		is.NoErr(insertEntry(store, "passengers", "surname", uint32(i), []byte(p.surname), reflect.String))
+		is.NoErr(insertEntry(store, "passengers", "age", uint32(i), []byte(p.age), reflect.Kind(JSONNumber)))
+	}
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/query", handleQuery(logging.New(&logWriter), store))
+
+	resp, err := test(buildPostRequest("/query", []byte("SELECT name, age FROM passengers OWNER root WHERE surname = 'Hax' AND age > 20 ORDER BY age DESC LIMIT 10")))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":3,"age":27,"name":"Rory"},{"_id":1,"age":26,"name":"Amy"}]`)
+
+	debugLogs := logWriter.DebugLogs()
+	is.Equal(len(debugLogs), 1)
+	stats := struct {
+		Plan        string `json:"plan"`
+		KeysScanned int    `json:"keys_scanned"`
+		RowsMatched int    `json:"rows_matched"`
+		Message     string `json:"message"`
+	}{}
+	is.NoErr(json.Unmarshal([]byte(debugLogs[0]), &stats))
+	is.Equal(stats.Plan, `scan passengers columns=name,age,surname filters=[surname equal "Hax", age greaterthan 20] order=age desc limit=10`)
+	is.Equal(stats.KeysScanned, 12)
+	is.Equal(stats.RowsMatched, 2)
+	is.Equal(stats.Message, "ran query successfully...")
+
+	resp, err = test(buildPostRequest("/query", []byte("SELECT name FROM passengers WHERE")))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), "syntax error at line 1, column 34: expected column or table name but found end of query")
+}
+
 func insertEntry(store kvs.KVDB, tbl, col string, rID uint32, data []byte, meta reflect.Kind) error {
 	return kvs.Store(store, kvs.Entry{
 		TableName:  tbl,
@@ -163,3 +559,192 @@ func buildPostRequest(url string, data []byte) *http.Request {
 
 type register func(method, path string, handlers ...fiber.Handler) fiber.Router
 type test func(req *http.Request, msTimeout ...int) (*http.Response, error)
+
+type ticket struct {
+	ID      uint32 `mdb:"ignore"`
+	UUID    uuid.UUID
+	Created time.Time
+	TTL     time.Duration
+	Title   string
+}
+
+func (t ticket) TableName() string { return "tickets" }
+
+func TestInsertedUUIDsAndTimesKeepTheirTypesWhenInferred(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+	register("POST", "/query", handleQuery(logging.New(&logWriter), store))
+
+	id := uuid.New()
+	inserted := fmt.Sprintf(`{"created":"2023-08-18T09:30:00.5Z","title":"2023-08-18","ttl":"1h30m0s","uuid":"%s"}`, id)
+	resp, err := test(buildPostRequest("/insert/tickets/root?infer=true", []byte(inserted)))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	s := storage.New(store)
+	defer s.Close()
+
+	tickets, err := storage.LoadAll[ticket](s, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(tickets, []ticket{{
+		UUID:    id,
+		Created: time.Date(2023, 8, 18, 9, 30, 0, 5e8, time.UTC),
+		TTL:     90 * time.Minute,
+		Title:   "2023-08-18", // only text exactly as a value would be written is inferred
+	}})
+
+	resp, err = test(buildPostRequest("/fetch/tickets/root", mustMarshal([]string{"uuid", "created", "ttl", "title"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,`+inserted[1:]+`]`)
+
+	resp, err = test(buildPostRequest("/query", []byte("SELECT title FROM tickets WHERE created > '2023-08-18T09:00:00+01:00' AND ttl >= '1h'")))
+	is.NoErr(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"title":"2023-08-18"}]`)
+}
+
+func TestInsertedStringsStayTextUnlessInferred(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
+
+	id := uuid.New()
+	resp, err := test(buildPostRequest("/insert/notes/root", []byte(fmt.Sprintf(`{"text":"1s","ref":"%s"}`, id))))
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+
+	svr := &rpcserver{db: store, pks: &PKS{}}
+	defer svr.pks.Release()
+	_, err = svr.Insert(context.Background(), &api.InsertRequest{Type: "notes", Uuid: "root", Json: []byte(`{"text":"1s"}`)})
+	is.NoErr(err)
+	_, err = svr.Insert(context.Background(), &api.InsertRequest{Type: "notes", Uuid: "root", Json: []byte(`{"text":"1s"}`), Infer: true})
+	is.NoErr(err)
+
+	rows, err := storage.LoadRows(storage.New(store), "notes", kvs.RootOwner{}, "text", "ref")
+	is.NoErr(err)
+	is.Equal(len(rows), 3)
+	ref, _ := rows[0].Entry("ref")
+	is.Equal(ref.Meta, codec.Meta(codec.TagString))
+	is.Equal(string(ref.Data), id.String())
+	for i, meta := range []byte{codec.Meta(codec.TagString), codec.Meta(codec.TagString), codec.Meta(codec.TagDuration)} {
+		text, _ := rows[i].Entry("text")
+		is.Equal(text.Meta, meta)
+	}
+}
+
+func TestInsertedNullsAreFetchedAsNull(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+	register("POST", "/query", handleQuery(logging.New(&logWriter), store))
+
+	for _, body := range []string{`{"name":"mango","size":null}`, `{"name":"kiwi","size":0}`} {
+		resp, err := test(buildPostRequest("/insert/fruit/root", []byte(body)))
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusOK)
+	}
+
+	resp, err := test(buildPostRequest("/fetch/fruit/root", mustMarshal([]string{"name", "size"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"name":"mango","size":null},{"_id":1,"name":"kiwi","size":0}]`)
+
+	resp, err = test(buildPostRequest("/query", []byte("SELECT name FROM fruit WHERE size IS NULL")))
+	is.NoErr(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"name":"mango"}]`)
+}
+
+func TestInsertedObjectsAndArraysAreFetchedIntact(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/insert/:type/:uuid", handleInserts(logging.New(&logWriter), store, &PKS{}))
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+	register("POST", "/query", handleQuery(logging.New(&logWriter), store))
+
+	for _, body := range []string{
+		`{"name":"crate","dims":{"h":2,"w":1},"tags":["a","b"]}`,
+		`{"name":"box","dims":{"h":1,"w":3},"tags":["c"]}`,
+	} {
+		resp, err := test(buildPostRequest("/insert/parcels/root", []byte(body)))
+		is.NoErr(err)
+		is.Equal(resp.StatusCode, http.StatusOK)
+	}
+
+	resp, err := test(buildPostRequest("/fetch/parcels/root", mustMarshal([]string{"name", "dims", "tags"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"dims":{"h":2,"w":1},"name":"crate","tags":["a","b"]},{"_id":1,"dims":{"h":1,"w":3},"name":"box","tags":["c"]}]`)
+
+	resp, err = test(buildPostRequest("/query", []byte("SELECT name, dims.w FROM parcels WHERE dims.w = 3")))
+	is.NoErr(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":1,"dims.w":3,"name":"box"}]`)
+
+	resp, err = test(buildPostRequest("/query", []byte("SELECT * FROM parcels WHERE tags.1 = 'b'")))
+	is.NoErr(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"dims":{"h":2,"w":1},"name":"crate","tags":["a","b"]}]`)
+}
+
+// packedFruit stores the rows of the fruit table row by row.
+type packedFruit fruit
+
+func (f packedFruit) TableName() string      { return "fruit" }
+func (f packedFruit) Layout() storage.Layout { return storage.RowMajor }
+
+func TestFetchReadsRowMajorRows(t *testing.T) {
+	register, store, test, shutdown := setup()
+	defer shutdown()
+
+	is := is.New(t)
+
+	logWriter := mock.LogWriter{}
+	register("POST", "/fetch/:type/:uuid", handleFetch(logging.New(&logWriter), store))
+	register("POST", "/query", handleQuery(logging.New(&logWriter), store))
+
+	s := storage.New(store)
+	defer s.Close()
+
+	is.NoErr(s.Save(kvs.RootOwner{}, &fruit{Name: "mango", Size: 9}))
+	is.NoErr(s.Save(kvs.RootOwner{}, &packedFruit{Name: "kiwi", Size: 3}))
+
+	resp, err := test(buildPostRequest("/fetch/fruit/root", mustMarshal([]string{"name", "size"})))
+	is.NoErr(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":0,"name":"mango","size":9},{"_id":1,"name":"kiwi","size":3}]`)
+
+	resp, err = test(buildPostRequest("/query", []byte("SELECT name FROM fruit WHERE size < 5")))
+	is.NoErr(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	is.NoErr(err)
+	is.Equal(string(body), `[{"_id":1,"name":"kiwi"}]`)
+}
@@ -53,16 +53,26 @@ type Server interface {
 
 type server struct {
 	db  kvs.KVDB
+	pks *PKS
 	app *fiber.App
 }
 
-func NewHTTP(log logging.Logger) (Server, error) {
+// DataDir is the directory both servers keep their database in.
+func DataDir() (string, error) {
 	parentDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parentDir, "bluepanda", "data"), nil
+}
+
+func NewHTTP(log logging.Logger) (Server, error) {
+	dataDir, err := DataDir()
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := badger.Open(badger.DefaultOptions(filepath.Join(parentDir, "bluepanda", "data")).WithLogger(nil))
+	conn, err := badger.Open(badger.DefaultOptions(dataDir).WithLogger(nil))
 	if err != nil {
 		return nil, err
 	}
@@ -74,11 +84,14 @@ func NewHTTP(log logging.Logger) (Server, error) {
 
 	svr := server{
 		db:  db,
+		pks: &PKS{},
 		app: fiber.New(fiber.Config{DisableStartupMessage: true}),
 	}
 
-	svr.app.Post("/insert/:type/:uuid", handleInserts(log, db, PKS{}))
+	svr.app.Post("/insert/:type/:uuid", handleInserts(log, db, svr.pks))
 	svr.app.Post("/fetch/:type/:uuid", handleFetch(log, db))
+	svr.app.Post("/aggregate/:type/:uuid", handleAggregate(log, db))
+	svr.app.Post("/query", handleQuery(log, db))
 
 	return svr, nil
 }
@@ -92,11 +105,13 @@ func (s server) Listen(port string) error {
 }
 
 func (s server) Cleanup(log logging.Logger) error {
+	// sequences are released first so the dump shows where they left off
+	err := s.pks.Release()
 	dbg := strings.Builder{}
 	s.db.DumpTo(&dbg)
 	log.Debug().Msg(dbg.String())
 	s.db.Close()
-	return nil
+	return err
 }
 
 func (s server) Shutdown() error {
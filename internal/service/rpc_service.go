@@ -1,11 +1,11 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net"
-	"os"
-	"path/filepath"
-	"reflect"
 	"strings"
 	"time"
 
@@ -14,22 +14,28 @@ import (
 	"github.com/tauraamui/bluepanda/pkg/api"
 	pb "github.com/tauraamui/bluepanda/pkg/api"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type rpcserver struct {
 	pb.UnimplementedBluePandaServer
 	rpcserver *grpc.Server
 	db        kvs.KVDB
+	pks       *PKS
+	log       logging.Logger
 }
 
 func NewRPC(log logging.Logger) (Server, error) {
-	parentDir, err := os.UserConfigDir()
+	dataDir, err := DataDir()
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := badger.Open(badger.DefaultOptions(filepath.Join(parentDir, "bluepanda", "data")).WithLogger(nil))
+	conn, err := badger.Open(badger.DefaultOptions(dataDir).WithLogger(nil))
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +45,7 @@ func NewRPC(log logging.Logger) (Server, error) {
 		return nil, err
 	}
 
-	return &rpcserver{db: db}, nil
+	return &rpcserver{db: db, pks: &PKS{}, log: log}, nil
 }
 
 func (s *rpcserver) Type() string {
@@ -57,10 +63,15 @@ func (s *rpcserver) Listen(addr string) error {
 }
 
 func (s *rpcserver) Cleanup(log logging.Logger) error {
+	// sequences are released first so the dump shows where they left off
+	releaseErr := s.pks.Release()
 	dbg := strings.Builder{}
 	s.db.DumpTo(&dbg)
 	log.Debug().Msg(dbg.String())
-	return s.db.Close()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return releaseErr
 }
 
 func (s *rpcserver) Shutdown() error {
@@ -77,52 +88,24 @@ func (s *rpcserver) Fetch(req *pb.FetchRequest, stream pb.BluePanda_FetchServer)
 	ttype := req.GetType()
 	uuidx := req.GetUuid()
 
-	columns := req.GetColumns()
-
-	blankEntries := convertToBlankTypesEntries(ttype, resolveOwnerID(uuidx), uint32(0), columns)
-
-	dest := []rawData{}
-	for _, ent := range blankEntries {
-		// iterate over all stored values for this entry
-		prefix := ent.PrefixKey()
-		if err := s.db.View(func(txn *badger.Txn) error {
-			it := txn.NewIterator(badger.DefaultIteratorOptions)
-			defer it.Close()
-
-			var destinationindex uint32 = 0
-			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-				item := it.Item()
-				if err := item.Value(func(val []byte) error {
-					ent.Data = val
-					return nil
-				}); err != nil {
-					return err
-				}
-				ent.Meta = item.UserMeta()
-
-				if len(dest) == 0 || destinationindex >= uint32(len(dest)) {
-					dest = append(dest, rawData{})
-				}
-
-				var v any
-				if ent.Meta != JSONNumber {
-					v = reflect.New(reflect.TypeOf(createInstanceOfKind(reflect.Kind(ent.Meta)))).Interface()
-					if err := convertFromBytes(ent.Data, v); err != nil {
-						return err
-					}
-				} else {
-					v = json.Number(string(ent.Data))
-				}
-				dest[destinationindex][ent.ColumnName] = v
-
-				destinationindex++
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
+	owner, err := resolveOwnerID(uuidx)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	dest, err := fetchRows(s.db, ttype, owner, int(req.GetDescendants()), req.GetColumns())
+	if err != nil {
+		return err
+	}
+
+	return sendRows(stream, dest)
+}
+
+type fetchResultSender interface {
+	Send(*api.FetchResult) error
+}
+
+func sendRows(stream fetchResultSender, dest []rawData) error {
 	for i := 0; i < len(dest); i++ {
 		data, err := json.Marshal(dest[i])
 		if err != nil {
@@ -137,6 +120,77 @@ func (s *rpcserver) Fetch(req *pb.FetchRequest, stream pb.BluePanda_FetchServer)
 	return nil
 }
 
+func (s *rpcserver) Aggregate(ctx context.Context, req *pb.AggregateRequest) (*pb.AggregateResult, error) {
+	owner, err := resolveOwnerID(req.GetUuid())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	filters := map[string][]any{}
+	for _, f := range req.GetFilters() {
+		values := []any{}
+		decoder := json.NewDecoder(bytes.NewReader(f.GetValues()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil {
+			return nil, err
+		}
+		filters[f.GetColumn()] = append(filters[f.GetColumn()], values...)
+	}
+
+	result, err := runAggregate(s.db, req.GetType(), owner, aggregateRequest{
+		Op:      req.GetOp(),
+		Column:  req.GetColumn(),
+		GroupBy: req.GetGroupBy(),
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.AggregateResult{Value: result.Value, Null: result.Null, Groups: result.Groups}, nil
+}
+
+func (s *rpcserver) Query(req *pb.QueryRequest, stream pb.BluePanda_QueryServer) error {
+	dest, err := runQuery(s.log, s.db, req.GetQuery())
+	if err != nil {
+		return err
+	}
+
+	return sendRows(stream, dest)
+}
+
+func (s *rpcserver) Insert(ctx context.Context, req *pb.InsertRequest) (*pb.InsertResult, error) {
+	owner, err := resolveOwnerID(req.GetUuid())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	data := rawData{}
+	decoder := json.NewDecoder(bytes.NewReader(req.GetJson()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if req.GetInfer() {
+		codec.InferAll(data)
+	}
+
+	rowID, err := insertRow(s.db, s.pks, req.GetType(), owner, data, req.GetIds(), req.GetKey())
+	if err != nil {
+		var badRequest *insertError
+		switch {
+		case errors.As(err, &badRequest):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, storage.ErrRowExists):
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		return nil, err
+	}
+
+	return &api.InsertResult{Id: rowID.String()}, nil
+}
+
 func stub() {
 	s := grpc.NewServer()
 	pb.RegisterBluePandaServer(s, &rpcserver{})
@@ -19,7 +19,10 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	BluePanda_Fetch_FullMethodName = "/bluepanda.BluePanda/Fetch"
+	BluePanda_Fetch_FullMethodName     = "/bluepanda.BluePanda/Fetch"
+	BluePanda_Aggregate_FullMethodName = "/bluepanda.BluePanda/Aggregate"
+	BluePanda_Query_FullMethodName     = "/bluepanda.BluePanda/Query"
+	BluePanda_Insert_FullMethodName    = "/bluepanda.BluePanda/Insert"
 )
 
 // BluePandaClient is the client API for BluePanda service.
@@ -27,6 +30,9 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type BluePandaClient interface {
 	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (BluePanda_FetchClient, error)
+	Aggregate(ctx context.Context, in *AggregateRequest, opts ...grpc.CallOption) (*AggregateResult, error)
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (BluePanda_QueryClient, error)
+	Insert(ctx context.Context, in *InsertRequest, opts ...grpc.CallOption) (*InsertResult, error)
 }
 
 type bluePandaClient struct {
@@ -69,11 +75,64 @@ func (x *bluePandaFetchClient) Recv() (*FetchResult, error) {
 	return m, nil
 }
 
+func (c *bluePandaClient) Aggregate(ctx context.Context, in *AggregateRequest, opts ...grpc.CallOption) (*AggregateResult, error) {
+	out := new(AggregateResult)
+	err := c.cc.Invoke(ctx, BluePanda_Aggregate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *bluePandaClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (BluePanda_QueryClient, error) {
+	stream, err := c.cc.NewStream(ctx, &BluePanda_ServiceDesc.Streams[1], BluePanda_Query_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &bluePandaQueryClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type BluePanda_QueryClient interface {
+	Recv() (*FetchResult, error)
+	grpc.ClientStream
+}
+
+type bluePandaQueryClient struct {
+	grpc.ClientStream
+}
+
+func (x *bluePandaQueryClient) Recv() (*FetchResult, error) {
+	m := new(FetchResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *bluePandaClient) Insert(ctx context.Context, in *InsertRequest, opts ...grpc.CallOption) (*InsertResult, error) {
+	out := new(InsertResult)
+	err := c.cc.Invoke(ctx, BluePanda_Insert_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BluePandaServer is the server API for BluePanda service.
 // All implementations must embed UnimplementedBluePandaServer
 // for forward compatibility
 type BluePandaServer interface {
 	Fetch(*FetchRequest, BluePanda_FetchServer) error
+	Aggregate(context.Context, *AggregateRequest) (*AggregateResult, error)
+	Query(*QueryRequest, BluePanda_QueryServer) error
+	Insert(context.Context, *InsertRequest) (*InsertResult, error)
 	mustEmbedUnimplementedBluePandaServer()
 }
 
@@ -84,6 +143,15 @@ type UnimplementedBluePandaServer struct {
 func (UnimplementedBluePandaServer) Fetch(*FetchRequest, BluePanda_FetchServer) error {
 	return status.Errorf(codes.Unimplemented, "method Fetch not implemented")
 }
+func (UnimplementedBluePandaServer) Aggregate(context.Context, *AggregateRequest) (*AggregateResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Aggregate not implemented")
+}
+func (UnimplementedBluePandaServer) Query(*QueryRequest, BluePanda_QueryServer) error {
+	return status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedBluePandaServer) Insert(context.Context, *InsertRequest) (*InsertResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Insert not implemented")
+}
 func (UnimplementedBluePandaServer) mustEmbedUnimplementedBluePandaServer() {}
 
 // UnsafeBluePandaServer may be embedded to opt out of forward compatibility for this service.
@@ -118,19 +186,90 @@ func (x *bluePandaFetchServer) Send(m *FetchResult) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _BluePanda_Aggregate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AggregateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BluePandaServer).Aggregate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BluePanda_Aggregate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BluePandaServer).Aggregate(ctx, req.(*AggregateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BluePanda_Query_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BluePandaServer).Query(m, &bluePandaQueryServer{stream})
+}
+
+type BluePanda_QueryServer interface {
+	Send(*FetchResult) error
+	grpc.ServerStream
+}
+
+type bluePandaQueryServer struct {
+	grpc.ServerStream
+}
+
+func (x *bluePandaQueryServer) Send(m *FetchResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _BluePanda_Insert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InsertRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BluePandaServer).Insert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BluePanda_Insert_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BluePandaServer).Insert(ctx, req.(*InsertRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BluePanda_ServiceDesc is the grpc.ServiceDesc for BluePanda service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var BluePanda_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "bluepanda.BluePanda",
 	HandlerType: (*BluePandaServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Aggregate",
+			Handler:    _BluePanda_Aggregate_Handler,
+		},
+		{
+			MethodName: "Insert",
+			Handler:    _BluePanda_Insert_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "Fetch",
 			Handler:       _BluePanda_Fetch_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "Query",
+			Handler:       _BluePanda_Query_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "service.proto",
 }
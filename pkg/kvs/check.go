@@ -0,0 +1,494 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+)
+
+// ProblemKind identifies the kind of inconsistency Check found.
+type ProblemKind int
+
+const (
+	// PartialRow is a row missing some of the columns its table's other
+	// rows hold, or, for tables with a known schema, some of its required
+	// columns.
+	PartialRow ProblemKind = iota
+	// OrphanedOwner is an owner of rows whose UUID no row holds.
+	OrphanedOwner
+	// SequenceBehind is a row ID sequence which would hand out IDs of rows
+	// which already exist.
+	SequenceBehind
+	// MalformedKey is a key which is neither table.column.owner.row,
+	// table.owner.row nor a sequence.
+	MalformedKey
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case PartialRow:
+		return "partial row"
+	case OrphanedOwner:
+		return "orphaned owner"
+	case SequenceBehind:
+		return "sequence behind"
+	case MalformedKey:
+		return "malformed key"
+	}
+	return "unknown"
+}
+
+// Problem is a single inconsistency found by Check.
+type Problem struct {
+	Kind    ProblemKind
+	Key     string
+	Table   string
+	Owner   string
+	RowID   uint32
+	TextID  RowID    // the row's ID, if it doesn't fit RowID
+	Missing []string // columns a partial row lacks
+	// Required is set for partial rows missing columns their table's
+	// schema requires, rather than only columns other rows hold.
+	Required bool
+	Next     uint64   // next ID a behind sequence hands out
+	MaxRow   uint32   // highest row ID stored for a behind sequence
+	Tables   []string // tables an orphaned owner holds rows in
+}
+
+// row returns the ID of the problem's row, whichever field holds it.
+func (p Problem) row() RowID {
+	return Entry{RowID: p.RowID, TextID: p.TextID}.ResolveRowID()
+}
+
+func (p Problem) String() string {
+	switch p.Kind {
+	case PartialRow:
+		if !p.Required {
+			return fmt.Sprintf("%s: %s.%s.%s lacks %s, which other rows hold", p.Kind, p.Table, p.Owner, p.row(), strings.Join(p.Missing, ", "))
+		}
+		return fmt.Sprintf("%s: %s.%s.%s is missing %s", p.Kind, p.Table, p.Owner, p.row(), strings.Join(p.Missing, ", "))
+	case OrphanedOwner:
+		return fmt.Sprintf("%s: %s owns rows in %s but no row holds it", p.Kind, p.Owner, strings.Join(p.Tables, ", "))
+	case SequenceBehind:
+		return fmt.Sprintf("%s: %s is at %d but row %d exists", p.Kind, p.Key, p.Next, p.MaxRow)
+	}
+	return fmt.Sprintf("%s: %s", p.Kind, p.Key)
+}
+
+// Report lists every problem found by Check.
+type Report struct {
+	KeysScanned int
+	Problems    []Problem
+}
+
+// CheckOption adjusts what Check considers a problem.
+type CheckOption func(*checkOptions)
+
+type checkOptions struct {
+	schema   []interface{ TableName() string }
+	required map[string][]string
+}
+
+// WithSchema tells Check the Go types the given values' tables are stored
+// from, so that rows of those tables are only reported as partial when
+// they miss a column which is neither omitempty nor has a default, and
+// tables keyed by a field of their own aren't expected to have a sequence.
+func WithSchema(values ...interface{ TableName() string }) CheckOption {
+	return func(o *checkOptions) {
+		o.schema = append(o.schema, values...)
+	}
+}
+
+// WithRequired tells Check which columns every row of a table must hold,
+// for tables with no Go type to hand to WithSchema, so that rows are only
+// reported as partial when they miss one of them.
+func WithRequired(tableName string, columns ...string) CheckOption {
+	return func(o *checkOptions) {
+		if o.required == nil {
+			o.required = map[string][]string{}
+		}
+		for _, c := range columns {
+			o.required[tableName] = append(o.required[tableName], strings.ToLower(c))
+		}
+	}
+}
+
+// tableSchema is what a value given to WithSchema or WithRequired says
+// about its table.
+type tableSchema struct {
+	required []string
+	keyed    bool
+}
+
+func resolveSchema(opts []CheckOption) (map[string]tableSchema, error) {
+	o := checkOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	schema := map[string]tableSchema{}
+	for _, v := range o.schema {
+		columns, err := Columns(reflect.TypeOf(v))
+		if err != nil {
+			return nil, err
+		}
+		ts := tableSchema{}
+		for _, c := range columns {
+			if !c.OmitEmpty && !c.HasDefault {
+				ts.required = append(ts.required, c.Name)
+			}
+			ts.keyed = ts.keyed || c.Key
+		}
+		schema[v.TableName()] = ts
+	}
+	for tableName, columns := range o.required {
+		ts := schema[tableName]
+		ts.required = append(ts.required, columns...)
+		schema[tableName] = ts
+	}
+	return schema, nil
+}
+
+// Check scans the whole keyspace for partial rows, owners no row
+// references, sequences behind the highest stored row ID and keys which
+// cannot be parsed. Without a schema for a row's table, given by
+// WithSchema or WithRequired, rows lacking a column other rows hold are
+// reported, but as they may well have been stored that way on purpose,
+// Repair leaves them be. Tables whose rows have IDs which aren't numbers,
+// or which have no sequence, are taken to be keyed some other way and
+// their sequences aren't checked. It only reads, use Repair to fix what it
+// reports.
+func Check(db KVDB, opts ...CheckOption) (Report, error) {
+	schema, err := resolveSchema(opts)
+	if err != nil {
+		return Report{}, err
+	}
+
+	type rowKey struct {
+		table, owner string
+		id           RowID
+	}
+	type seqKey struct{ owner, table string }
+
+	report := Report{}
+	tableColumns := map[string]map[string]struct{}{}
+	rows := map[rowKey]map[string]struct{}{}
+	maxRows := map[seqKey]uint32{}
+	textIDs := map[seqKey]struct{}{}
+	sequences := map[seqKey]uint64{}
+	ownerTables := map[string]map[string]struct{}{}
+	referenced := map[string]struct{}{}
+
+	// record notes a column of a row, whichever layout it is stored in
+	record := func(e Entry) {
+		owner := e.OwnerUUID.String()
+		if tableColumns[e.TableName] == nil {
+			tableColumns[e.TableName] = map[string]struct{}{}
+		}
+		tableColumns[e.TableName][e.ColumnName] = struct{}{}
+
+		rk := rowKey{e.TableName, owner, e.ResolveRowID()}
+		if rows[rk] == nil {
+			rows[rk] = map[string]struct{}{}
+		}
+		rows[rk][e.ColumnName] = struct{}{}
+
+		// only numeric IDs can have been handed out by a sequence
+		sk := seqKey{owner, e.TableName}
+		if e.TextID != "" {
+			textIDs[sk] = struct{}{}
+		} else if id, ok := maxRows[sk]; !ok || e.RowID > id {
+			maxRows[sk] = e.RowID
+		}
+
+		if ownerTables[owner] == nil {
+			ownerTables[owner] = map[string]struct{}{}
+		}
+		ownerTables[owner][e.TableName] = struct{}{}
+
+		if id, ok := UUIDFromData(e.Data, e.Meta); ok {
+			referenced[id.String()] = struct{}{}
+		}
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			report.KeysScanned++
+
+			if IsIndexKey(item.Key()) {
+				continue
+			}
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if row, err := ParseRowKey(item.Key()); err == nil {
+				entries, err := DecodeRow(row, val)
+				if err != nil {
+					report.Problems = append(report.Problems, Problem{Kind: MalformedKey, Key: string(item.Key())})
+					continue
+				}
+				for _, e := range entries {
+					record(e)
+				}
+				continue
+			}
+
+			e, err := ParseKey(item.Key())
+			if err != nil {
+				owner, table, ok := parseSequenceKey(item.Key())
+				if !ok || len(val) != 8 {
+					report.Problems = append(report.Problems, Problem{Kind: MalformedKey, Key: string(item.Key())})
+					continue
+				}
+				sequences[seqKey{owner, table}] = binary.BigEndian.Uint64(val)
+				continue
+			}
+
+			e.Data = val
+			e.Meta = item.UserMeta()
+			record(e)
+		}
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	for rk, columns := range rows {
+		ts, required := schema[rk.table]
+		expected := ts.required
+		if !required {
+			expected = make([]string, 0, len(tableColumns[rk.table]))
+			for column := range tableColumns[rk.table] {
+				expected = append(expected, column)
+			}
+		}
+		missing := []string{}
+		for _, column := range expected {
+			if _, ok := columns[column]; !ok {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		sort.Strings(missing)
+		row := Entry{}.WithRowID(rk.id)
+		report.Problems = append(report.Problems, Problem{
+			Kind: PartialRow, Table: rk.table, Owner: rk.owner, RowID: row.RowID, TextID: row.TextID, Missing: missing, Required: required,
+		})
+	}
+
+	for owner, tables := range ownerTables {
+		if owner == (RootOwner{}).String() {
+			continue
+		}
+		if _, ok := referenced[owner]; ok {
+			continue
+		}
+		names := make([]string, 0, len(tables))
+		for t := range tables {
+			names = append(names, t)
+		}
+		sort.Strings(names)
+		report.Problems = append(report.Problems, Problem{Kind: OrphanedOwner, Owner: owner, Tables: names})
+	}
+
+	for sk, maxRow := range maxRows {
+		next, ok := sequences[sk]
+		if !ok || next > uint64(maxRow) {
+			continue
+		}
+		if _, ok := textIDs[sk]; ok || schema[sk.table].keyed {
+			continue
+		}
+		report.Problems = append(report.Problems, Problem{
+			Kind: SequenceBehind, Key: sk.owner + "." + sk.table, Table: sk.table, Owner: sk.owner, Next: next, MaxRow: maxRow,
+		})
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		a, b := report.Problems[i], report.Problems[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.String() < b.String()
+	})
+
+	return report, nil
+}
+
+// Repair fixes the problems in report which can be fixed safely: rows
+// missing columns their schema requires are deleted, along with the index
+// keys of the values they do hold, and behind sequences are bumped past
+// their highest row. Other partial rows, orphaned owners and malformed
+// keys are left for a person to decide on.
+// No Store may hold a sequence of the same database while it runs. It
+// returns how many problems were repaired.
+func Repair(db KVDB, report Report) (int, error) {
+	type rowRef struct {
+		owner string
+		id    RowID
+	}
+	partial := map[string]map[rowRef]struct{}{}
+	for _, p := range report.Problems {
+		if p.Kind != PartialRow || !p.Required {
+			continue
+		}
+		if partial[p.Table] == nil {
+			partial[p.Table] = map[rowRef]struct{}{}
+		}
+		partial[p.Table][rowRef{p.Owner, p.row()}] = struct{}{}
+	}
+
+	repaired := 0
+	err := db.Update(func(txn *badger.Txn) error {
+		// every partial row of a table is found in one pass over its keys
+		keys := [][]byte{}
+		stored := []Entry{}
+		for table, rows := range partial {
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte(table + ".")})
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				entries := []Entry{}
+				if row, err := ParseRowKey(item.Key()); err == nil {
+					if _, ok := rows[rowRef{row.OwnerUUID.String(), row.ResolveRowID()}]; !ok {
+						continue
+					}
+					val, err := item.ValueCopy(nil)
+					if err != nil {
+						it.Close()
+						return err
+					}
+					// a row which can't be decoded has no index keys to find
+					entries, _ = DecodeRow(row, val)
+				} else if e, err := ParseKey(item.Key()); err == nil {
+					if _, ok := rows[rowRef{e.OwnerUUID.String(), e.ResolveRowID()}]; !ok {
+						continue
+					}
+					if e.Data, err = item.ValueCopy(nil); err != nil {
+						it.Close()
+						return err
+					}
+					e.Meta = item.UserMeta()
+					entries = append(entries, e)
+				} else {
+					continue
+				}
+				keys = append(keys, item.KeyCopy(nil))
+				stored = append(stored, entries...)
+			}
+			it.Close()
+		}
+
+		for _, e := range stored {
+			if _, err := txn.Get(IndexKey(e)); err == nil {
+				keys = append(keys, IndexKey(e))
+			} else if !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+		}
+		for _, k := range keys {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range report.Problems {
+			switch p.Kind {
+			case PartialRow:
+				if !p.Required {
+					continue
+				}
+			case SequenceBehind:
+				next := make([]byte, 8)
+				binary.BigEndian.PutUint64(next, uint64(p.MaxRow)+1)
+				if err := txn.Set([]byte(p.Key), next); err != nil {
+					return err
+				}
+			default:
+				continue
+			}
+			repaired++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return repaired, nil
+}
+
+// parseSequenceKey recognises the owner.table keys of row ID sequences.
+func parseSequenceKey(k []byte) (string, string, bool) {
+	owner, table, ok := strings.Cut(string(k), ".")
+	if !ok || table == "" || strings.Contains(table, ".") {
+		return "", "", false
+	}
+	switch ParseOwner(owner).(type) {
+	case RootOwner, uuid.UUID:
+		return owner, table, true
+	}
+	return "", "", false
+}
+
+// UUIDFromData reports whether stored column data holds a UUID, either in
+// its own encoding or as text, raw or JSON encoded.
+func UUIDFromData(data []byte, meta byte) (uuid.UUID, bool) {
+	if meta == codec.Meta(codec.TagUUID) {
+		id, err := uuid.FromBytes(data)
+		return id, err == nil
+	}
+	data = bytes.Trim(data, `"`)
+	if len(data) != 36 {
+		return uuid.UUID{}, false
+	}
+	id, err := uuid.ParseBytes(data)
+	return id, err == nil
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs_test
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+func TestCheckReportsAndRepairsProblems(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := func(column string, owner kvs.UUID, rowID uint32, data string) {
+		is.NoErr(kvs.Store(db, kvs.Entry{TableName: "balloons", ColumnName: column, OwnerUUID: owner, RowID: rowID, Data: []byte(data)}))
+	}
+
+	seq, err := db.GetSeq([]byte("root.balloons"), 1)
+	is.NoErr(err)
+	for i := 0; i < 2; i++ {
+		_, err := seq.Next()
+		is.NoErr(err)
+	}
+	is.NoErr(seq.Release())
+
+	store("color", kvs.RootOwner{}, 0, "RED")
+	store("size", kvs.RootOwner{}, 0, "695")
+	store("color", kvs.RootOwner{}, 1, "WHITE")
+	// written without going through the sequence, which is now behind
+	store("color", kvs.RootOwner{}, 5, "BLUE")
+	store("size", kvs.RootOwner{}, 5, "12")
+
+	orphan := uuid.MustParse("0b4f7a52-6a43-4c9e-8d0a-3f5e2c1b9a77")
+	store("color", orphan, 0, "GREEN")
+	store("size", orphan, 0, "4")
+
+	is.NoErr(db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("nonsense"), []byte("?"))
+	}))
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+
+	problems := func(report kvs.Report) []string {
+		ss := []string{}
+		for _, p := range report.Problems {
+			ss = append(ss, p.String())
+		}
+		return ss
+	}
+	// the orphan's rows were never numbered by a sequence, so it has none
+	// which could be behind
+	is.Equal(problems(report), []string{
+		"partial row: balloons.root.1 lacks size, which other rows hold",
+		"orphaned owner: 0b4f7a52-6a43-4c9e-8d0a-3f5e2c1b9a77 owns rows in balloons but no row holds it",
+		"sequence behind: root.balloons is at 2 but row 5 exists",
+		"malformed key: nonsense",
+	})
+
+	// without a schema a row lacking a column may have been stored that
+	// way on purpose, so it isn't deleted
+	repaired, err := kvs.Repair(db, report)
+	is.NoErr(err)
+	is.Equal(repaired, 1)
+
+	report, err = kvs.Check(db, kvs.WithSchema(checkedBalloon{}))
+	is.NoErr(err)
+	is.Equal(problems(report), []string{
+		"partial row: balloons.root.1 is missing size",
+		"orphaned owner: 0b4f7a52-6a43-4c9e-8d0a-3f5e2c1b9a77 owns rows in balloons but no row holds it",
+		"malformed key: nonsense",
+	})
+	is.True(report.Problems[0].Required)
+
+	repaired, err = kvs.Repair(db, report)
+	is.NoErr(err)
+	is.Equal(repaired, 1)
+
+	report, err = kvs.Check(db)
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 2)
+	is.Equal(report.Problems[0].Kind, kvs.OrphanedOwner)
+	is.Equal(report.Problems[1].Kind, kvs.MalformedKey)
+
+	seq, err = db.GetSeq([]byte("root.balloons"), 1)
+	is.NoErr(err)
+	next, err := seq.Next()
+	is.NoErr(err)
+	is.Equal(next, uint64(6))
+	is.NoErr(seq.Release())
+}
+
+type checkedBalloon struct {
+	Color string
+	Size  string
+}
+
+func (b checkedBalloon) TableName() string { return "balloons" }
+
+type checkedMember struct {
+	Email    string `mdb:"key"`
+	Nickname string `mdb:"omitempty"`
+	Visits   int    `mdb:"default=1"`
+}
+
+func (m checkedMember) TableName() string { return "members" }
+
+func TestCheckWithSchemaOnlyFlagsRowsMissingRequiredColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := func(column string, rowID uint32, data string) {
+		is.NoErr(kvs.Store(db, kvs.Entry{TableName: "members", ColumnName: column, OwnerUUID: kvs.RootOwner{}, RowID: rowID, Data: []byte(data)}))
+	}
+	// rows keyed by their own column, next to a sequence left over from
+	// when the table was numbered by one
+	store("email", 4, "amy@pond.example")
+	store("nickname", 4, "Amelia")
+	store("visits", 4, "3")
+	store("email", 9, "rory@pond.example")
+	store("nickname", 9, "")
+	store("visits", 7, "2")
+	seq, err := db.GetSeq([]byte("root.members"), 1)
+	is.NoErr(err)
+	is.NoErr(seq.Release())
+
+	report, err := kvs.Check(db, kvs.WithSchema(checkedMember{}))
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 1)
+	is.Equal(report.Problems[0].String(), "partial row: members.root.7 is missing email")
+
+	report, err = kvs.Check(db)
+	is.NoErr(err)
+	kinds := []kvs.ProblemKind{}
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind)
+		is.True(!p.Required)
+	}
+	is.Equal(kinds, []kvs.ProblemKind{kvs.PartialRow, kvs.PartialRow, kvs.SequenceBehind})
+}
+
+func TestRepairDeletesRowsMissingRequiredColumnsWithTheirIndexKeys(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := func(column string, owner kvs.UUID, rowID uint32, data string) {
+		e := kvs.Entry{TableName: "tickets", ColumnName: column, OwnerUUID: owner, RowID: rowID, Data: []byte(data)}
+		is.NoErr(kvs.Store(db, e))
+		if column == "status" {
+			is.NoErr(db.Update(func(txn *badger.Txn) error {
+				return txn.Set(kvs.IndexKey(e), nil)
+			}))
+		}
+	}
+	other := uuid.New()
+	store("summary", kvs.RootOwner{}, 0, "T")
+	store("status", kvs.RootOwner{}, 0, "open")
+	store("status", kvs.RootOwner{}, 1, "open") // lost its summary in a crash
+	store("status", other, 1, "open")
+	store("summary", other, 1, "U")
+
+	report, err := kvs.Check(db, kvs.WithRequired("tickets", "Summary", "status"))
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 2)
+	is.Equal(report.Problems[0].String(), "partial row: tickets.root.1 is missing summary")
+	is.Equal(report.Problems[1].Kind, kvs.OrphanedOwner)
+
+	repaired, err := kvs.Repair(db, report)
+	is.NoErr(err)
+	is.Equal(repaired, 1)
+
+	remaining := []string{}
+	is.NoErr(db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if e, err := kvs.ParseIndexKey(it.Item().Key()); err == nil {
+				remaining = append(remaining, e.OwnerUUID.String()+"."+e.ResolveRowID().String())
+				continue
+			}
+			remaining = append(remaining, string(it.Item().Key()))
+		}
+		return nil
+	}))
+	is.Equal(remaining, []string{
+		other.String() + ".1", // index keys of the same value sort by owner
+		"root.0",
+		"tickets.status." + other.String() + ".1",
+		"tickets.status.root.0",
+		"tickets.summary." + other.String() + ".1",
+		"tickets.summary.root.0",
+	})
+}
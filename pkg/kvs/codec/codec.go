@@ -0,0 +1,851 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package codec encodes column values into the bytes stored under each key.
+//
+// Every entry records how its data was encoded in its meta byte: the top
+// three bits hold the codec version and the bottom five a Tag naming the
+// encoded type. Version 0 covers data written before the codec existed,
+// which is still read but never written.
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Version is the codec version Encode writes.
+const Version = 1
+
+// Tag names the type of an encoded value. Scalar tags share their numbering
+// with reflect.Kind, and the rest take numbers of kinds which are never
+// stored as themselves.
+type Tag byte
+
+const (
+	TagNone       Tag = Tag(reflect.Invalid)
+	TagBool       Tag = Tag(reflect.Bool)
+	TagInt        Tag = Tag(reflect.Int)
+	TagInt8       Tag = Tag(reflect.Int8)
+	TagInt16      Tag = Tag(reflect.Int16)
+	TagInt32      Tag = Tag(reflect.Int32)
+	TagInt64      Tag = Tag(reflect.Int64)
+	TagUint       Tag = Tag(reflect.Uint)
+	TagUint8      Tag = Tag(reflect.Uint8)
+	TagUint16     Tag = Tag(reflect.Uint16)
+	TagUint32     Tag = Tag(reflect.Uint32)
+	TagUint64     Tag = Tag(reflect.Uint64)
+	TagUintptr    Tag = Tag(reflect.Uintptr)
+	TagFloat32    Tag = Tag(reflect.Float32)
+	TagFloat64    Tag = Tag(reflect.Float64)
+	TagComplex64  Tag = Tag(reflect.Complex64)
+	TagComplex128 Tag = Tag(reflect.Complex128)
+	TagBytes      Tag = Tag(reflect.Slice)
+	TagString     Tag = Tag(reflect.String)
+	// TagDuration holds a time.Duration as an integer of nanoseconds.
+	TagDuration Tag = 26
+	// TagJSON holds any other value as a JSON document.
+	TagJSON Tag = 27
+	// TagList holds a slice as a count followed by each element's meta
+	// byte, length and encoding.
+	TagList Tag = 28
+	// TagMap holds a map as a count followed by each key and value encoded
+	// as a list element would be, ordered by the key's encoding.
+	TagMap Tag = 29
+	// TagUUID holds a uuid.UUID as its sixteen bytes.
+	TagUUID Tag = 30
+	// TagTime holds a time.Time as its Unix seconds and nanoseconds, which
+	// sort bytewise by instant, followed by its zone offset in seconds.
+	TagTime Tag = 31
+)
+
+// Null is the meta byte of a null value, which has no data. It is written
+// for nil values and nil pointers, so that a column explicitly holding no
+// value can be told apart from one which is absent or holds a zero value.
+const Null = byte(Version << 5)
+
+// LegacyNumber is the meta byte the service layer gave JSON numbers, stored
+// as their text, before the codec existed.
+const LegacyNumber = byte(99)
+
+func (t Tag) String() string {
+	switch t {
+	case TagNone:
+		return "none"
+	case TagBytes:
+		return "bytes"
+	case TagJSON:
+		return "json"
+	case TagList:
+		return "list"
+	case TagMap:
+		return "map"
+	case TagDuration:
+		return "duration"
+	case TagUUID:
+		return "uuid"
+	case TagTime:
+		return "time"
+	}
+	if t < TagBytes {
+		return reflect.Kind(t).String()
+	}
+	if t == TagString {
+		return "string"
+	}
+	return fmt.Sprintf("tag(%d)", byte(t))
+}
+
+// Meta packs the current version and the given tag into a meta byte.
+func Meta(tag Tag) byte { return Version<<5 | byte(tag) }
+
+// Split unpacks a meta byte into its version and tag.
+func Split(meta byte) (int, Tag) { return int(meta >> 5), Tag(meta & 0x1f) }
+
+var (
+	bytesType    = reflect.TypeOf([]byte(nil))
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Encode returns v's stored form and the meta byte describing it. Integers
+// are always stored in eight bytes so that no value is truncated, and JSON
+// numbers are stored as the narrowest of int64, uint64 or float64 which
+// holds them exactly. UUIDs, times and durations have encodings of their
+// own rather than being stored as JSON.
+func Encode(v any) ([]byte, byte, error) {
+	switch tv := v.(type) {
+	case json.Number:
+		return encodeNumber(tv)
+	case uuid.UUID:
+		return append([]byte(nil), tv[:]...), Meta(TagUUID), nil
+	case time.Time:
+		return encodeTime(tv), Meta(TagTime), nil
+	case time.Duration:
+		return encodeInt(int64(tv)), Meta(TagDuration), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		return nil, Null, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer:
+		// values are stored rather than pointers to them, unless only the
+		// pointer marshals itself
+		if !isMarshaler(rv.Type()) || isMarshaler(rv.Elem().Type()) {
+			return Encode(rv.Elem().Interface())
+		}
+	case reflect.Bool:
+		if rv.Bool() {
+			return []byte{1}, Meta(TagBool), nil
+		}
+		return []byte{0}, Meta(TagBool), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeInt(rv.Int()), Meta(Tag(rv.Kind())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return encodeUint(rv.Uint()), Meta(Tag(rv.Kind())), nil
+	case reflect.Float32, reflect.Float64:
+		return encodeUint(math.Float64bits(rv.Float())), Meta(Tag(rv.Kind())), nil
+	case reflect.Complex64, reflect.Complex128:
+		c := rv.Complex()
+		return append(encodeUint(math.Float64bits(real(c))), encodeUint(math.Float64bits(imag(c)))...), Meta(Tag(rv.Kind())), nil
+	case reflect.String:
+		return []byte(rv.String()), Meta(TagString), nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv.Convert(bytesType).Bytes(), Meta(TagBytes), nil
+		}
+		if !isMarshaler(rv.Type()) {
+			return encodeList(rv)
+		}
+	case reflect.Map:
+		if !isMarshaler(rv.Type()) {
+			return encodeMap(rv)
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, Meta(TagJSON), nil
+}
+
+func encodeTime(t time.Time) []byte {
+	_, offset := t.Zone()
+	buf := encodeInt(t.Unix())
+	buf = binary.BigEndian.AppendUint32(buf, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint32(buf, uint32(int32(offset)))
+}
+
+// decodeTime restores a time in the zone it was encoded in, using the
+// local zone where it has the same offset, as time.Parse does.
+func decodeTime(data []byte) (time.Time, error) {
+	if len(data) != 16 {
+		return time.Time{}, errShort(TagTime)
+	}
+	sec := int64(binary.BigEndian.Uint64(data) ^ 1<<63)
+	nsec := int64(binary.BigEndian.Uint32(data[8:]))
+	offset := int(int32(binary.BigEndian.Uint32(data[12:])))
+
+	t := time.Unix(sec, nsec)
+	if offset == 0 {
+		return t.UTC(), nil
+	}
+	if _, local := t.Zone(); local == offset {
+		return t, nil
+	}
+	return t.In(time.FixedZone("", offset)), nil
+}
+
+// Infer returns the UUID, time or duration a string holds, provided the
+// string is exactly how that value would be written back out as text, and
+// otherwise returns the string itself. It lets values which arrive as JSON
+// text be stored in their own encodings without changing how they read.
+func Infer(s string) any {
+	if len(s) == 36 {
+		if id, err := uuid.Parse(s); err == nil && id.String() == s {
+			return id
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil && t.Format(time.RFC3339Nano) == s {
+		return t
+	}
+	if d, err := time.ParseDuration(s); err == nil && d.String() == s {
+		return d
+	}
+	return s
+}
+
+// InferAll replaces each string of values, and of the objects it holds,
+// with what Infer returns for it, for documents whose strings are asked to
+// be stored in the encodings of the values they hold.
+func InferAll(values map[string]any) {
+	for k, v := range values {
+		switch tv := v.(type) {
+		case string:
+			values[k] = Infer(tv)
+		case map[string]any:
+			InferAll(tv)
+		}
+	}
+}
+
+// Text returns the textual form of a UUID, time or duration, which Infer
+// reverses, reporting false for any other value.
+func Text(v any) (string, bool) {
+	switch tv := v.(type) {
+	case uuid.UUID:
+		return tv.String(), true
+	case time.Time:
+		return tv.Format(time.RFC3339Nano), true
+	case time.Duration:
+		return tv.String(), true
+	}
+	return "", false
+}
+
+func encodeNumber(n json.Number) ([]byte, byte, error) {
+	if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+		return encodeInt(i), Meta(TagInt64), nil
+	}
+	if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		return encodeUint(u), Meta(TagUint64), nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, 0, err
+	}
+	return encodeUint(math.Float64bits(f)), Meta(TagFloat64), nil
+}
+
+func isMarshaler(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func encodeList(rv reflect.Value) ([]byte, byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(rv.Len()))
+	for i := 0; i < rv.Len(); i++ {
+		var err error
+		if buf, err = appendElem(buf, rv.Index(i).Interface()); err != nil {
+			return nil, 0, err
+		}
+	}
+	return buf, Meta(TagList), nil
+}
+
+func encodeMap(rv reflect.Value) ([]byte, byte, error) {
+	type pair struct{ k, v []byte }
+	pairs := make([]pair, 0, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		k, err := appendElem(nil, iter.Key().Interface())
+		if err != nil {
+			return nil, 0, err
+		}
+		v, err := appendElem(nil, iter.Value().Interface())
+		if err != nil {
+			return nil, 0, err
+		}
+		pairs = append(pairs, pair{k, v})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i].k, pairs[j].k) < 0 })
+
+	buf := binary.AppendUvarint(nil, uint64(len(pairs)))
+	for _, p := range pairs {
+		buf = append(append(buf, p.k...), p.v...)
+	}
+	return buf, Meta(TagMap), nil
+}
+
+// appendElem appends the meta byte, length and encoding of a list element.
+func appendElem(buf []byte, v any) ([]byte, error) {
+	data, meta, err := Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, meta)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...), nil
+}
+
+// readElem reads a list element, returning it and the remaining data.
+func readElem(data []byte) ([]byte, byte, []byte, error) {
+	if len(data) < 1 {
+		return nil, 0, nil, fmt.Errorf("insufficient data for element")
+	}
+	meta := data[0]
+	n, w := binary.Uvarint(data[1:])
+	if w <= 0 || uint64(len(data)-1-w) < n {
+		return nil, 0, nil, fmt.Errorf("insufficient data for element")
+	}
+	start := 1 + w
+	return data[start : start+int(n)], meta, data[start+int(n):], nil
+}
+
+func readCount(data []byte) (int, []byte, error) {
+	n, w := binary.Uvarint(data)
+	if w <= 0 || n > uint64(len(data)) {
+		return 0, nil, fmt.Errorf("malformed count")
+	}
+	return int(n), data[w:], nil
+}
+
+// encodeInt flips the sign bit so that encoded integers sort bytewise.
+func encodeInt(i int64) []byte {
+	return encodeUint(uint64(i) ^ 1<<63)
+}
+
+func encodeUint(u uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf
+}
+
+// DecodeValue returns the value data holds as the Go type its tag names.
+// JSON documents decode as they would into an any, keeping numbers as
+// json.Number.
+func DecodeValue(data []byte, meta byte) (any, error) {
+	switch meta {
+	case LegacyNumber:
+		return json.Number(string(data)), nil
+	case Null:
+		return nil, nil
+	}
+
+	version, tag := Split(meta)
+	switch version {
+	case 0:
+		if tag == TagNone {
+			return decodeLegacyUntyped(data), nil
+		}
+		return decodeLegacyBinary(data, tag)
+	case Version:
+		return decodeValue(data, tag)
+	}
+	return nil, fmt.Errorf("unsupported codec version %d", version)
+}
+
+// Decode stores the value data holds in the value dest points to,
+// converting between numeric types where no precision is lost.
+func Decode(data []byte, meta byte, dest any) error {
+	dv := reflect.ValueOf(dest)
+	if dv.Kind() != reflect.Pointer || dv.IsNil() {
+		return fmt.Errorf("destination must be a pointer")
+	}
+
+	if meta == Null || isDocumentNull(data, meta) {
+		dv.Elem().Set(reflect.Zero(dv.Elem().Type()))
+		return nil
+	}
+
+	// pointers are filled with a newly allocated value
+	if elem := dv.Elem(); elem.Kind() == reflect.Pointer {
+		v := reflect.New(elem.Type().Elem())
+		if err := Decode(data, meta, v.Interface()); err != nil {
+			return err
+		}
+		elem.Set(v)
+		return nil
+	}
+
+	version, tag := Split(meta)
+	if meta != LegacyNumber {
+		// documents and untyped legacy data decode straight into dest
+		if (version == Version && tag == TagJSON) || (version == 0 && tag == TagNone) {
+			return decodeDocument(data, dest)
+		}
+	}
+
+	if version == Version && (tag == TagList || tag == TagMap) {
+		return decodeCollection(data, tag, dv.Elem())
+	}
+
+	v, err := DecodeValue(data, meta)
+	if err != nil {
+		return err
+	}
+	return assign(v, dv.Elem())
+}
+
+// isDocumentNull reports whether data is a JSON null, as nil pointers were
+// stored before the codec had a null.
+func isDocumentNull(data []byte, meta byte) bool {
+	version, tag := Split(meta)
+	if (version == Version && tag == TagJSON) || (version == 0 && tag == TagNone) {
+		return bytes.Equal(bytes.TrimSpace(data), []byte("null"))
+	}
+	return false
+}
+
+// decodeCollection decodes each element of a list or map straight into
+// the elements of dest, so they keep their own types.
+func decodeCollection(data []byte, tag Tag, dest reflect.Value) error {
+	n, rest, err := readCount(data)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tag == TagList && dest.Kind() == reflect.Slice:
+		if n == 0 {
+			dest.Set(reflect.Zero(dest.Type()))
+			return nil
+		}
+		list := reflect.MakeSlice(dest.Type(), n, n)
+		for i := 0; i < n; i++ {
+			var elem []byte
+			var meta byte
+			if elem, meta, rest, err = readElem(rest); err != nil {
+				return err
+			}
+			if err := Decode(elem, meta, list.Index(i).Addr().Interface()); err != nil {
+				return err
+			}
+		}
+		dest.Set(list)
+		return nil
+	case tag == TagList && dest.Kind() == reflect.Array:
+		if n != dest.Len() {
+			return fmt.Errorf("cannot decode %d elements into %s", n, dest.Type())
+		}
+		for i := 0; i < n; i++ {
+			var elem []byte
+			var meta byte
+			if elem, meta, rest, err = readElem(rest); err != nil {
+				return err
+			}
+			if err := Decode(elem, meta, dest.Index(i).Addr().Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case tag == TagMap && dest.Kind() == reflect.Map:
+		m := reflect.MakeMapWithSize(dest.Type(), n)
+		for i := 0; i < n; i++ {
+			var k, v []byte
+			var km, vm byte
+			if k, km, rest, err = readElem(rest); err != nil {
+				return err
+			}
+			if v, vm, rest, err = readElem(rest); err != nil {
+				return err
+			}
+			key := reflect.New(dest.Type().Key())
+			if err := Decode(k, km, key.Interface()); err != nil {
+				return err
+			}
+			val := reflect.New(dest.Type().Elem())
+			if err := Decode(v, vm, val.Interface()); err != nil {
+				return err
+			}
+			m.SetMapIndex(key.Elem(), val.Elem())
+		}
+		dest.Set(m)
+		return nil
+	}
+
+	v, err := decodeValue(data, tag)
+	if err != nil {
+		return err
+	}
+	return assign(v, dest)
+}
+
+func decodeDocument(data []byte, dest any) error {
+	switch v := dest.(type) {
+	case *[]byte:
+		*v = data
+		return nil
+	case *string:
+		// legacy data stored strings raw, rather than as JSON
+		if err := json.Unmarshal(data, v); err != nil {
+			*v = string(data)
+		}
+		return nil
+	}
+	return json.Unmarshal(data, dest)
+}
+
+func decodeValue(data []byte, tag Tag) (any, error) {
+	switch tag {
+	case TagBool:
+		if len(data) != 1 {
+			return nil, errShort(tag)
+		}
+		return data[0] != 0, nil
+	case TagInt, TagInt8, TagInt16, TagInt32, TagInt64:
+		if len(data) != 8 {
+			return nil, errShort(tag)
+		}
+		i := int64(binary.BigEndian.Uint64(data) ^ 1<<63)
+		return reflect.ValueOf(i).Convert(kindTypes[reflect.Kind(tag)]).Interface(), nil
+	case TagUint, TagUint8, TagUint16, TagUint32, TagUint64, TagUintptr:
+		if len(data) != 8 {
+			return nil, errShort(tag)
+		}
+		return reflect.ValueOf(binary.BigEndian.Uint64(data)).Convert(kindTypes[reflect.Kind(tag)]).Interface(), nil
+	case TagFloat32, TagFloat64:
+		if len(data) != 8 {
+			return nil, errShort(tag)
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(data))
+		if tag == TagFloat32 {
+			return float32(f), nil
+		}
+		return f, nil
+	case TagComplex64, TagComplex128:
+		if len(data) != 16 {
+			return nil, errShort(tag)
+		}
+		c := complex(math.Float64frombits(binary.BigEndian.Uint64(data)), math.Float64frombits(binary.BigEndian.Uint64(data[8:])))
+		if tag == TagComplex64 {
+			return complex64(c), nil
+		}
+		return c, nil
+	case TagString:
+		return string(data), nil
+	case TagBytes:
+		return append([]byte(nil), data...), nil
+	case TagDuration:
+		if len(data) != 8 {
+			return nil, errShort(tag)
+		}
+		return time.Duration(binary.BigEndian.Uint64(data) ^ 1<<63), nil
+	case TagUUID:
+		return uuid.FromBytes(data)
+	case TagTime:
+		return decodeTime(data)
+	case TagList:
+		n, rest, err := readCount(data)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			var elem []byte
+			var meta byte
+			if elem, meta, rest, err = readElem(rest); err != nil {
+				return nil, err
+			}
+			v, err := DecodeValue(elem, meta)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case TagMap:
+		// keys are rendered as text, as they would be in JSON
+		n, rest, err := readCount(data)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			var k, v []byte
+			var km, vm byte
+			if k, km, rest, err = readElem(rest); err != nil {
+				return nil, err
+			}
+			if v, vm, rest, err = readElem(rest); err != nil {
+				return nil, err
+			}
+			key, err := DecodeValue(k, km)
+			if err != nil {
+				return nil, err
+			}
+			val, err := DecodeValue(v, vm)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = val
+		}
+		return m, nil
+	case TagJSON:
+		var v any
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported tag %s", tag)
+}
+
+// decodeLegacyUntyped guesses the type of data written before the codec,
+// which stored strings raw and everything else as JSON.
+func decodeLegacyUntyped(data []byte) any {
+	var v any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil || decoder.More() {
+		return string(data)
+	}
+	return v
+}
+
+// decodeLegacyBinary reads the big-endian encoding the service layer used
+// before the codec, where int and uint were truncated to four bytes.
+func decodeLegacyBinary(data []byte, tag Tag) (any, error) {
+	need := map[Tag]int{
+		TagBool: 1, TagInt: 4, TagInt32: 4, TagInt64: 8, TagUint: 4, TagUint32: 4,
+		TagUint64: 8, TagFloat32: 4, TagFloat64: 8,
+	}
+	if n, ok := need[tag]; ok && len(data) < n {
+		return nil, errShort(tag)
+	}
+
+	switch tag {
+	case TagString:
+		return string(data), nil
+	case TagBool:
+		return data[0] != 0, nil
+	case TagInt:
+		return int(int32(binary.BigEndian.Uint32(data))), nil
+	case TagInt32:
+		return int32(binary.BigEndian.Uint32(data)), nil
+	case TagInt64:
+		return int64(binary.BigEndian.Uint64(data)), nil
+	case TagUint:
+		return uint(binary.BigEndian.Uint32(data)), nil
+	case TagUint32:
+		return binary.BigEndian.Uint32(data), nil
+	case TagUint64:
+		return binary.BigEndian.Uint64(data), nil
+	case TagFloat32:
+		return math.Float32frombits(binary.BigEndian.Uint32(data)), nil
+	case TagFloat64:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	}
+	return nil, fmt.Errorf("unsupported type")
+}
+
+func errShort(tag Tag) error {
+	return fmt.Errorf("insufficient data for %s", tag)
+}
+
+var kindTypes = map[reflect.Kind]reflect.Type{
+	reflect.Int: reflect.TypeOf(int(0)), reflect.Int8: reflect.TypeOf(int8(0)),
+	reflect.Int16: reflect.TypeOf(int16(0)), reflect.Int32: reflect.TypeOf(int32(0)),
+	reflect.Int64: reflect.TypeOf(int64(0)), reflect.Uint: reflect.TypeOf(uint(0)),
+	reflect.Uint8: reflect.TypeOf(uint8(0)), reflect.Uint16: reflect.TypeOf(uint16(0)),
+	reflect.Uint32: reflect.TypeOf(uint32(0)), reflect.Uint64: reflect.TypeOf(uint64(0)),
+	reflect.Uintptr: reflect.TypeOf(uintptr(0)),
+}
+
+// assign stores v in dest, converting between kinds where nothing is lost.
+func assign(v any, dest reflect.Value) error {
+	sv := reflect.ValueOf(v)
+	if sv.Type().AssignableTo(dest.Type()) {
+		dest.Set(sv)
+		return nil
+	}
+
+	if n, ok := v.(json.Number); ok {
+		return assignNumber(n, dest)
+	}
+
+	if dest.Type() == durationType && sv.Kind() == reflect.String {
+		d, err := time.ParseDuration(sv.String())
+		if err != nil {
+			return fmt.Errorf("cannot decode %q into %s", sv.String(), dest.Type())
+		}
+		dest.SetInt(int64(d))
+		return nil
+	}
+
+	switch dest.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch sv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if !dest.OverflowInt(sv.Int()) {
+				dest.SetInt(sv.Int())
+				return nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if sv.Uint() <= math.MaxInt64 && !dest.OverflowInt(int64(sv.Uint())) {
+				dest.SetInt(int64(sv.Uint()))
+				return nil
+			}
+		case reflect.Float32, reflect.Float64:
+			f := sv.Float()
+			if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 && !dest.OverflowInt(int64(f)) {
+				dest.SetInt(int64(f))
+				return nil
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch sv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if sv.Int() >= 0 && !dest.OverflowUint(uint64(sv.Int())) {
+				dest.SetUint(uint64(sv.Int()))
+				return nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if !dest.OverflowUint(sv.Uint()) {
+				dest.SetUint(sv.Uint())
+				return nil
+			}
+		case reflect.Float32, reflect.Float64:
+			f := sv.Float()
+			if f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 && !dest.OverflowUint(uint64(f)) {
+				dest.SetUint(uint64(f))
+				return nil
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		switch sv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			dest.SetFloat(float64(sv.Int()))
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			dest.SetFloat(float64(sv.Uint()))
+			return nil
+		case reflect.Float32, reflect.Float64:
+			dest.SetFloat(sv.Float())
+			return nil
+		}
+	case reflect.Complex64, reflect.Complex128:
+		if sv.Kind() == reflect.Complex64 || sv.Kind() == reflect.Complex128 {
+			dest.SetComplex(sv.Complex())
+			return nil
+		}
+	case reflect.Bool:
+		if sv.Kind() == reflect.Bool {
+			dest.SetBool(sv.Bool())
+			return nil
+		}
+	case reflect.String:
+		if text, ok := Text(v); ok {
+			dest.SetString(text)
+			return nil
+		}
+		if sv.Kind() == reflect.String || sv.Type() == bytesType {
+			dest.SetString(sv.Convert(reflect.TypeOf("")).String())
+			return nil
+		}
+	case reflect.Slice:
+		if dest.Type().Elem().Kind() == reflect.Uint8 && (sv.Kind() == reflect.String || sv.Type() == bytesType) {
+			dest.SetBytes(sv.Convert(bytesType).Bytes())
+			return nil
+		}
+	}
+
+	// anything else, such as a string into a type which unmarshals text,
+	// goes through JSON
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, dest.Addr().Interface()); err != nil {
+		return fmt.Errorf("cannot decode %T into %s", v, dest.Type())
+	}
+	return nil
+}
+
+func assignNumber(n json.Number, dest reflect.Value) error {
+	switch dest.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+			return assign(i, dest)
+		}
+		if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			return assign(u, dest)
+		}
+	case reflect.String:
+		dest.SetString(n.String())
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	return assign(f, dest)
+}
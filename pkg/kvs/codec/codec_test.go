@@ -0,0 +1,389 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package codec_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+)
+
+type colour string
+
+func TestEncodeDecodeRoundTripsScalars(t *testing.T) {
+	is := is.New(t)
+
+	values := []any{
+		true, false,
+		int(-7), int8(math.MinInt8), int16(math.MaxInt16), int32(math.MinInt32),
+		int64(math.MaxInt64), int64(math.MinInt64),
+		uint(7), uint8(math.MaxUint8), uint16(math.MaxUint16), uint32(math.MaxUint32),
+		uint64(math.MaxUint64), uintptr(12),
+		float32(1.25), float64(math.SmallestNonzeroFloat64), math.MaxFloat64,
+		complex64(complex(1, -2)), complex(math.Pi, math.E),
+		"hello", []byte{1, 2, 3}, colour("RED"),
+		struct{ A int }{5}, []string{"a", "b"},
+	}
+
+	for _, v := range values {
+		data, meta, err := codec.Encode(v)
+		is.NoErr(err)
+
+		version, _ := codec.Split(meta)
+		is.Equal(version, codec.Version)
+
+		dest := reflect.New(reflect.TypeOf(v))
+		is.NoErr(codec.Decode(data, meta, dest.Interface()))
+		is.Equal(dest.Elem().Interface(), v)
+	}
+}
+
+func TestDecodeValueReturnsTaggedType(t *testing.T) {
+	is := is.New(t)
+
+	data, meta, err := codec.Encode(int64(math.MaxInt64))
+	is.NoErr(err)
+	v, err := codec.DecodeValue(data, meta)
+	is.NoErr(err)
+	is.Equal(v, int64(math.MaxInt64))
+
+	data, meta, err = codec.Encode(map[string]any{"w": 1})
+	is.NoErr(err)
+	v, err = codec.DecodeValue(data, meta)
+	is.NoErr(err)
+	is.Equal(v, map[string]any{"w": 1})
+
+	data, meta, err = codec.Encode(struct{ W json.Number }{"1"})
+	is.NoErr(err)
+	v, err = codec.DecodeValue(data, meta)
+	is.NoErr(err)
+	is.Equal(v, map[string]any{"W": json.Number("1")})
+}
+
+func TestListsAndMapsKeepElementTypes(t *testing.T) {
+	is := is.New(t)
+
+	values := []any{
+		[]int64{math.MaxInt64, -1},
+		[]string{"a", "b"},
+		[][]byte{{1}, {2, 3}},
+		map[string]uint64{"max": math.MaxUint64, "min": 0},
+		map[int]string{3: "three", -1: "minus one"},
+		map[string][]float32{"xs": {1.5, -2}},
+		[2]int8{-1, 1},
+	}
+	for _, v := range values {
+		data, meta, err := codec.Encode(v)
+		is.NoErr(err)
+
+		dest := reflect.New(reflect.TypeOf(v))
+		is.NoErr(codec.Decode(data, meta, dest.Interface()))
+		is.Equal(dest.Elem().Interface(), v)
+	}
+
+	// maps encode in key order, so equal maps always store the same bytes
+	a, _, err := codec.Encode(map[string]int{"x": 1, "y": 2, "z": 3})
+	is.NoErr(err)
+	for i := 0; i < 10; i++ {
+		b, _, err := codec.Encode(map[string]int{"z": 3, "y": 2, "x": 1})
+		is.NoErr(err)
+		is.Equal(a, b)
+	}
+
+	data, meta, err := codec.Encode([]any{"a", int64(1), map[string]any{"b": true}})
+	is.NoErr(err)
+	v, err := codec.DecodeValue(data, meta)
+	is.NoErr(err)
+	is.Equal(v, []any{"a", int64(1), map[string]any{"b": true}})
+}
+
+func TestEncodeJSONNumbersLosslessly(t *testing.T) {
+	is := is.New(t)
+
+	for _, tt := range []struct {
+		number string
+		want   any
+	}{
+		{"9007199254740993", int64(9007199254740993)},
+		{"18446744073709551615", uint64(math.MaxUint64)},
+		{"-3", int64(-3)},
+		{"99.48", 99.48},
+	} {
+		data, meta, err := codec.Encode(json.Number(tt.number))
+		is.NoErr(err)
+		v, err := codec.DecodeValue(data, meta)
+		is.NoErr(err)
+		is.Equal(v, tt.want)
+	}
+}
+
+func TestDecodeConvertsNumbersWithoutLoss(t *testing.T) {
+	is := is.New(t)
+
+	data, meta, err := codec.Encode(int64(26))
+	is.NoErr(err)
+	var small int8
+	is.NoErr(codec.Decode(data, meta, &small))
+	is.Equal(small, int8(26))
+	var f float64
+	is.NoErr(codec.Decode(data, meta, &f))
+	is.Equal(f, 26.0)
+
+	data, meta, err = codec.Encode(int64(300))
+	is.NoErr(err)
+	is.True(codec.Decode(data, meta, &small) != nil)
+
+	data, meta, err = codec.Encode(26.5)
+	is.NoErr(err)
+	var i int
+	is.True(codec.Decode(data, meta, &i) != nil)
+}
+
+func TestEncodedIntegersSortBytewise(t *testing.T) {
+	is := is.New(t)
+
+	prev, _, err := codec.Encode(int64(math.MinInt64))
+	is.NoErr(err)
+	for _, v := range []int64{-300, -1, 0, 1, 300, math.MaxInt64} {
+		data, _, err := codec.Encode(v)
+		is.NoErr(err)
+		is.True(string(prev) < string(data))
+		prev = data
+	}
+}
+
+func TestUUIDsTimesAndDurationsHaveTheirOwnEncodings(t *testing.T) {
+	is := is.New(t)
+
+	id := uuid.New()
+	values := []struct {
+		v   any
+		tag codec.Tag
+	}{
+		{id, codec.TagUUID},
+		{time.Date(2023, 8, 18, 9, 30, 0, 123, time.UTC), codec.TagTime},
+		{time.Date(1066, 10, 14, 9, 0, 0, 0, time.FixedZone("", -90*60)), codec.TagTime},
+		{time.Time{}, codec.TagTime},
+		{-90 * time.Minute, codec.TagDuration},
+	}
+
+	for _, tt := range values {
+		data, meta, err := codec.Encode(tt.v)
+		is.NoErr(err)
+		_, tag := codec.Split(meta)
+		is.Equal(tag, tt.tag)
+
+		v, err := codec.DecodeValue(data, meta)
+		is.NoErr(err)
+		is.Equal(v, tt.v)
+
+		text, ok := codec.Text(v)
+		is.True(ok)
+		is.Equal(codec.Infer(text), tt.v)
+		var s string
+		is.NoErr(codec.Decode(data, meta, &s))
+		is.Equal(s, text)
+	}
+
+	is.Equal(codec.Infer(strings.ToUpper(id.String())), strings.ToUpper(id.String())) // not how a UUID is written
+	is.Equal(codec.Infer("5m"), "5m")
+
+	var d time.Duration
+	data, meta, err := codec.Encode("2h")
+	is.NoErr(err)
+	is.NoErr(codec.Decode(data, meta, &d))
+	is.Equal(d, 2*time.Hour)
+
+	// times stored as JSON before they had an encoding still decode
+	var at time.Time
+	is.NoErr(codec.Decode([]byte(`"2023-08-18T09:30:00Z"`), codec.Meta(codec.TagJSON), &at))
+	is.Equal(at, time.Date(2023, 8, 18, 9, 30, 0, 0, time.UTC))
+}
+
+func TestEncodedTimesSortBytewise(t *testing.T) {
+	is := is.New(t)
+
+	prev, _, err := codec.Encode(time.Time{})
+	is.NoErr(err)
+	for _, v := range []time.Time{
+		time.Unix(-1, 0),
+		time.Unix(0, 0),
+		time.Unix(0, 1).In(time.FixedZone("", 3600)),
+		time.Unix(1692351000, 0),
+	} {
+		data, _, err := codec.Encode(v)
+		is.NoErr(err)
+		is.True(string(prev) < string(data))
+		prev = data
+	}
+}
+
+func TestNullsAndPointers(t *testing.T) {
+	is := is.New(t)
+
+	data, meta, err := codec.Encode(nil)
+	is.NoErr(err)
+	is.Equal(meta, codec.Null)
+	is.Equal(len(data), 0)
+	v, err := codec.DecodeValue(data, meta)
+	is.NoErr(err)
+	is.Equal(v, nil)
+
+	var nilInt *int
+	_, meta, err = codec.Encode(nilInt)
+	is.NoErr(err)
+	is.Equal(meta, codec.Null)
+
+	n := 5
+	p := &n
+	is.NoErr(codec.Decode(nil, codec.Null, &p))
+	is.Equal(p, nil)
+	is.NoErr(codec.Decode(nil, codec.Null, &n))
+	is.Equal(n, 0)
+
+	// pointers store the value they point to
+	at := time.Date(2023, 8, 18, 9, 30, 0, 0, time.UTC)
+	data, meta, err = codec.Encode(&at)
+	is.NoErr(err)
+	is.Equal(meta, codec.Meta(codec.TagTime))
+	var pat *time.Time
+	is.NoErr(codec.Decode(data, meta, &pat))
+	is.Equal(*pat, at)
+
+	zero := 0
+	data, meta, err = codec.Encode(&zero)
+	is.NoErr(err)
+	is.NoErr(codec.Decode(data, meta, &p))
+	is.Equal(*p, 0)
+
+	// nil pointers stored as JSON before the codec had a null still decode
+	p = &n
+	is.NoErr(codec.Decode([]byte("null"), codec.Meta(codec.TagJSON), &p))
+	is.Equal(p, nil)
+}
+
+func TestDecodeLegacyData(t *testing.T) {
+	is := is.New(t)
+
+	// untyped data stored strings and bytes raw and everything else as JSON
+	tests := []struct {
+		stored   []byte
+		expected any
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte("hello"), "hello"},
+		{[]byte("{\"A\":5}"), struct{ A int }{5}},
+	}
+
+	for _, test := range tests {
+		dest := reflect.New(reflect.TypeOf(test.expected))
+		is.NoErr(codec.Decode(test.stored, 0, dest.Interface()))
+		is.Equal(dest.Elem().Interface(), test.expected)
+	}
+
+	// without a destination its type is guessed
+	v, err := codec.DecodeValue([]byte("hello"), 0)
+	is.NoErr(err)
+	is.Equal(v, "hello")
+
+	v, err = codec.DecodeValue([]byte("{\"A\":5}"), 0)
+	is.NoErr(err)
+	is.Equal(v, map[string]any{"A": json.Number("5")})
+}
+
+func TestDecodeLegacyBytes(t *testing.T) {
+	is := is.New(t)
+
+	input := []byte{1, 2, 3}
+	var destination []byte
+	err := codec.Decode(input, 0, &destination)
+	is.NoErr(err)
+	is.Equal(destination, input)
+}
+
+func TestDecodeLegacyString(t *testing.T) {
+	is := is.New(t)
+
+	input := []byte("hello")
+	var destination string
+	err := codec.Decode(input, 0, &destination)
+	is.NoErr(err)
+	is.Equal(destination, string(input))
+}
+
+func TestDecodeLegacyStruct(t *testing.T) {
+	is := is.New(t)
+
+	type TestStruct struct {
+		A int
+		B string
+	}
+	input := []byte("{\"A\":5,\"B\":\"hello\"}")
+	var destination TestStruct
+	err := codec.Decode(input, 0, &destination)
+	is.NoErr(err)
+	is.Equal(destination, TestStruct{A: 5, B: "hello"})
+}
+
+func TestDecodeLegacyServiceValues(t *testing.T) {
+	is := is.New(t)
+
+	// the service layer stored big-endian binary tagged by reflect.Kind
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(99.48))
+	v, err := codec.DecodeValue(buf, byte(reflect.Float64))
+	is.NoErr(err)
+	is.Equal(v, 99.48)
+
+	v, err = codec.DecodeValue([]byte("31"), codec.LegacyNumber)
+	is.NoErr(err)
+	is.Equal(v, json.Number("31"))
+
+	var i int
+	is.NoErr(codec.Decode([]byte("31"), codec.LegacyNumber, &i))
+	is.Equal(i, 31)
+}
+
+func TestDecodeUnknownVersionFails(t *testing.T) {
+	is := is.New(t)
+
+	_, err := codec.DecodeValue([]byte{0}, 5<<5|byte(codec.TagBool))
+	is.Equal(err.Error(), "unsupported codec version 5")
+}
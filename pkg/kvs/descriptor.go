@@ -0,0 +1,123 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// descriptor holds what is learnt by reflecting over a struct type, so
+// that it's worked out once per type rather than for every value saved or
+// loaded.
+type descriptor struct {
+	columns   []Column
+	err       error
+	byColumn  map[string][]int // column name -> index path of its field
+	relations []Relation
+	key       []int // index path of the field declared as the natural key
+
+	// fields caches the index paths of fields looked up by name, which
+	// may include fields not stored as columns, such as ID
+	fields sync.Map
+}
+
+var descriptors sync.Map // reflect.Type -> *descriptor
+
+// describe returns the descriptor of the struct type t, building it the
+// first time the type is seen.
+func describe(t reflect.Type) *descriptor {
+	if d, ok := descriptors.Load(t); ok {
+		return d.(*descriptor)
+	}
+
+	d := &descriptor{byColumn: map[string][]int{}}
+	d.columns, d.err = appendColumns([]Column{}, t, "", nil, FieldOptions{})
+	for _, c := range d.columns {
+		// fields declared directly take precedence over promoted ones
+		if index, ok := d.byColumn[c.Name]; !ok || len(c.Field) < len(index) {
+			d.byColumn[c.Name] = c.Field
+		}
+		if c.Key {
+			if d.key != nil && d.err == nil {
+				d.err = fmt.Errorf("%s has more than one key field", t.Name())
+			}
+			d.key = c.Field
+		}
+	}
+	d.relations = relations(t)
+
+	actual, _ := descriptors.LoadOrStore(t, d)
+	return actual.(*descriptor)
+}
+
+// field returns the index path of the field of t matching name, as
+// fieldByName resolves it.
+func (d *descriptor) field(t reflect.Type, name string) ([]int, bool, error) {
+	key := strings.ToLower(name)
+	if index, ok := d.fields.Load(key); ok {
+		return index.([]int), true, nil
+	}
+
+	index, ok, err := fieldIndex(t, name)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	d.fields.Store(key, index)
+	return index, true, nil
+}
+
+func fieldIndex(t reflect.Type, name string) ([]int, bool, error) {
+	promoted := []int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fOpts, err := resolveFieldOptions(f)
+		if err != nil {
+			return nil, false, err
+		}
+		if f.Anonymous && fOpts.Name == "" && f.Type.Kind() == reflect.Struct {
+			promoted = append(promoted, i)
+		}
+		if strings.EqualFold(fOpts.columnName(f), name) {
+			return []int{i}, true, nil
+		}
+	}
+	for _, i := range promoted {
+		index, ok, err := fieldIndex(t.Field(i).Type, name)
+		if err != nil || ok {
+			return append([]int{i}, index...), ok, err
+		}
+	}
+	return nil, false, nil
+}
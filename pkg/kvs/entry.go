@@ -32,15 +32,18 @@
 package kvs
 
 import (
-	"bytes"
+	"encoding"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/google/uuid"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
 )
 
 type Entry struct {
@@ -48,16 +51,41 @@ type Entry struct {
 	ColumnName string
 	OwnerUUID  UUID
 	RowID      uint32
-	Data       []byte
-	Meta       byte
+	// TextID holds the row's ID in place of RowID when it isn't a number
+	// which fits a uint32, such as a UUID or a natural key.
+	TextID RowID
+	Data   []byte
+	Meta   byte
+}
+
+// ResolveRowID returns the ID of the entry's row, whichever field holds it.
+func (e Entry) ResolveRowID() RowID {
+	if e.TextID != "" {
+		return e.TextID
+	}
+	return NumericID(uint64(e.RowID))
+}
+
+// WithRowID returns e with its row ID set to id, held in RowID if it's a
+// number which fits one and in TextID otherwise.
+func (e Entry) WithRowID(id RowID) Entry {
+	if n, ok := id.Numeric(); ok && n <= math.MaxUint32 {
+		e.RowID, e.TextID = uint32(n), ""
+		return e
+	}
+	e.RowID, e.TextID = 0, id
+	return e
 }
 
 func (e Entry) PrefixKey() []byte {
+	if _, ok := e.OwnerUUID.(AnyOwner); ok {
+		return []byte(fmt.Sprintf("%s.%s.", e.TableName, e.ColumnName))
+	}
 	return []byte(fmt.Sprintf("%s.%s.%s", e.TableName, e.ColumnName, e.resolveOwnerID()))
 }
 
 func (e Entry) Key() []byte {
-	return []byte(fmt.Sprintf("%s.%s.%s.%d", e.TableName, e.ColumnName, e.resolveOwnerID(), e.RowID))
+	return []byte(fmt.Sprintf("%s.%s.%s.%s", e.TableName, e.ColumnName, e.resolveOwnerID(), e.ResolveRowID().segment()))
 }
 
 func (e Entry) resolveOwnerID() string {
@@ -96,14 +124,79 @@ func Get(db KVDB, e *Entry) error {
 
 func ConvertToBlankEntries(tableName string, ownerID UUID, rowID uint32, x any) []Entry {
 	v := reflect.ValueOf(x)
-	return convertToEntries(tableName, ownerID, rowID, v, false)
+	entries, _ := convertToEntries(tableName, ownerID, rowID, v, false)
+	return entries
 }
 
 func ConvertToEntries(tableName string, ownerID UUID, rowID uint32, x any) []Entry {
 	v := reflect.ValueOf(x)
+	entries, _ := convertToEntries(tableName, ownerID, rowID, v, true)
+	return entries
+}
+
+// EntryConverter is implemented by types which convert themselves into
+// entries without reflection, such as those bluepanda-gen generates
+// methods for.
+type EntryConverter interface {
+	Entries(tableName string, ownerID UUID, rowID uint32) ([]Entry, error)
+}
+
+// EntryLoader is implemented by types which load entries into their own
+// fields without reflection.
+type EntryLoader interface {
+	LoadEntry(entry Entry) error
+}
+
+// EntriesOf converts x into the entries it is stored as, using its own
+// Entries method if it has one. Unlike ConvertToEntries, it reports values
+// which can't be encoded.
+func EntriesOf(tableName string, ownerID UUID, rowID uint32, x any) ([]Entry, error) {
+	if c, ok := x.(EntryConverter); ok {
+		return c.Entries(tableName, ownerID, rowID)
+	}
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if _, err := Columns(v.Type()); err != nil {
+		return nil, err
+	}
 	return convertToEntries(tableName, ownerID, rowID, v, true)
 }
 
+// MapEntries converts a document, such as one decoded from JSON, into the
+// entries of the row of blank, as rows of tables without a Go type are
+// stored. Objects are flattened into dotted sub-columns, as nested structs
+// are, unless whole reports their column is stored whole, while arrays and
+// empty objects are always stored whole. Nil values are stored as null.
+func MapEntries(blank Entry, data map[string]any, whole func(column string) bool) ([]Entry, error) {
+	return appendMapEntries([]Entry{}, blank, "", data, whole)
+}
+
+func appendMapEntries(entries []Entry, blank Entry, prefix string, data map[string]any, whole func(column string) bool) ([]Entry, error) {
+	for k, v := range data {
+		column := prefix + strings.ToLower(k)
+		if object, ok := v.(map[string]any); ok && len(object) > 0 && (whole == nil || !whole(column)) {
+			var err error
+			if entries, err = appendMapEntries(entries, blank, column+".", object, whole); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		bd, meta, err := codec.Encode(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", column, err)
+		}
+		e := blank
+		e.ColumnName = column
+		e.Data = bd
+		e.Meta = meta
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
 type UUID interface {
 	String() string
 }
@@ -112,34 +205,76 @@ type RootOwner struct{}
 
 func (o RootOwner) String() string { return "root" }
 
-func LoadEntry(s interface{}, entry Entry) error {
-	// convert the interface value to a reflect.Value so we can access its fields
-	val := reflect.ValueOf(s).Elem()
+// AnyOwner matches rows regardless of which owner they belong to. It can
+// only be used to read, as no single key can be built for it.
+type AnyOwner struct{}
 
-	field, err := resolveFieldRef(val, entry.ColumnName)
-	if err != nil {
-		return err
+func (o AnyOwner) String() string { return "*" }
+
+// ownerID is an owner recovered from a key which is neither root nor a UUID.
+type ownerID string
+
+func (o ownerID) String() string { return string(o) }
+
+// ParseOwner resolves the string form of an owner back into a UUID value.
+func ParseOwner(s string) UUID {
+	switch s {
+	case RootOwner{}.String():
+		return RootOwner{}
+	case AnyOwner{}.String():
+		return AnyOwner{}
+	}
+	if id, err := uuid.Parse(s); err == nil {
+		return id
 	}
+	return ownerID(s)
+}
 
-	// convert the entry's Data field to the type of the target field
-	if err := convertFromBytes(entry.Data, field.Addr().Interface()); err != nil {
-		return fmt.Errorf("failed to convert entry data to field type: %v", err)
+// ParseKey reverses Entry.Key, recovering the table, column, owner and row
+// ID an entry was stored under. Column names may contain dots, but table
+// names may not.
+func ParseKey(k []byte) (Entry, error) {
+	key := string(k)
+
+	rowPos := strings.LastIndex(key, ".")
+	if rowPos < 0 {
+		return Entry{}, fmt.Errorf("malformed key: %s", key)
+	}
+	rowID, ok := parseRowSegment(key[rowPos+1:])
+	if !ok {
+		return Entry{}, fmt.Errorf("malformed key: %s", key)
 	}
 
-	return nil
+	ownerPos := strings.LastIndex(key[:rowPos], ".")
+	tablePos := strings.Index(key, ".")
+	if ownerPos < 0 || tablePos >= ownerPos {
+		return Entry{}, fmt.Errorf("malformed key: %s", key)
+	}
+
+	return Entry{
+		TableName:  key[:tablePos],
+		ColumnName: key[tablePos+1 : ownerPos],
+		OwnerUUID:  ParseOwner(key[ownerPos+1 : rowPos]),
+	}.WithRowID(rowID), nil
 }
 
-func LoadID(s any, rowID uint32) error {
+// LoadEntry sets the field of s which holds the entry's column to the
+// value it stores, using the LoadEntry method of s if it has one.
+func LoadEntry(s interface{}, entry Entry) error {
+	if l, ok := s.(EntryLoader); ok {
+		return l.LoadEntry(entry)
+	}
+
 	// convert the interface value to a reflect.Value so we can access its fields
 	val := reflect.ValueOf(s).Elem()
 
-	field, err := resolveFieldRef(val, "ID")
+	field, err := resolveFieldRef(val, entry.ColumnName)
 	if err != nil {
 		return err
 	}
 
 	// convert the entry's Data field to the type of the target field
-	if err := assignUint32(rowID, field.Addr().Interface()); err != nil {
+	if err := convertFromBytes(entry.Data, entry.Meta, field.Addr().Interface()); err != nil {
 		return fmt.Errorf("failed to convert entry data to field type: %v", err)
 	}
 
@@ -147,17 +282,97 @@ func LoadID(s any, rowID uint32) error {
 }
 
 func resolveFieldRef(v reflect.Value, nameToMatch string) (reflect.Value, error) {
-	t := v.Type()
+	field, ok, err := fieldByColumn(v, nameToMatch)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if !ok {
+		return reflect.Zero(reflect.TypeOf(v)), fmt.Errorf("struct does not have a field with name %q", nameToMatch)
+	}
+	return field, nil
+}
 
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
+// FieldByColumn resolves a column name to the field of v which holds it.
+// The name may be a dotted path into nested structs, such as address.city,
+// and fields of embedded structs are promoted as they are when converting
+// values into entries. Fields are matched by the name= option of their
+// mdb tag where they have one.
+func FieldByColumn(v reflect.Value, column string) (reflect.Value, bool) {
+	field, ok, err := fieldByColumn(v, column)
+	return field, ok && err == nil
+}
 
-		if strings.EqualFold(field.Name, nameToMatch) {
-			return v.Field(i), nil
+// Lookup resolves a column name against v as FieldByColumn does, but also
+// reads into maps by key and into slices and arrays by index, following
+// pointers and interfaces along the way. It can address paths inside a
+// column which holds a whole map or list, such as dims.w or tags.0, but
+// values found inside maps can't be set.
+func Lookup(v reflect.Value, column string) (reflect.Value, bool) {
+	for _, name := range strings.Split(column, ".") {
+		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			f, ok, err := fieldByName(v, name)
+			if err != nil || !ok {
+				return reflect.Value{}, false
+			}
+			v = f
+		case reflect.Map:
+			key := reflect.New(v.Type().Key()).Elem()
+			if key.Kind() == reflect.String {
+				key.SetString(name)
+			} else if err := codec.Decode([]byte(name), codec.LegacyNumber, key.Addr().Interface()); err != nil {
+				return reflect.Value{}, false
+			}
+			if v = v.MapIndex(key); !v.IsValid() {
+				return reflect.Value{}, false
+			}
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= v.Len() {
+				return reflect.Value{}, false
+			}
+			v = v.Index(i)
+		default:
+			return reflect.Value{}, false
+		}
+	}
+	return v, true
+}
+
+func fieldByColumn(v reflect.Value, column string) (reflect.Value, bool, error) {
+	v = reflect.Indirect(v)
+	if v.Kind() == reflect.Struct {
+		if index, ok := describe(v.Type()).byColumn[strings.ToLower(column)]; ok {
+			return v.FieldByIndex(index), true, nil
 		}
 	}
 
-	return reflect.Zero(reflect.TypeOf(v)), fmt.Errorf("struct does not have a field with name %q", nameToMatch)
+	for _, name := range strings.Split(column, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, false, nil
+		}
+		f, ok, err := fieldByName(v, name)
+		if err != nil || !ok {
+			return reflect.Value{}, false, err
+		}
+		v = f
+	}
+	return v, true, nil
+}
+
+func fieldByName(v reflect.Value, name string) (reflect.Value, bool, error) {
+	index, ok, err := describe(v.Type()).field(v.Type(), name)
+	if err != nil || !ok {
+		return reflect.Value{}, false, err
+	}
+	return v.FieldByIndex(index), true, nil
 }
 
 func LoadEntries(s interface{}, entries []Entry) error {
@@ -170,129 +385,382 @@ func LoadEntries(s interface{}, entries []Entry) error {
 	return nil
 }
 
-func convertToEntries(tableName string, ownerUUID UUID, rowID uint32, v reflect.Value, includeData bool) []Entry {
-	entries := []Entry{}
-
+func convertToEntries(tableName string, ownerUUID UUID, rowID uint32, v reflect.Value, includeData bool) ([]Entry, error) {
 	if v.Kind() == reflect.Pointer {
 		v = v.Elem()
 	}
-	for i := 0; i < v.NumField(); i++ {
-		vv := reflect.Indirect(v)
-		f := vv.Type().Field(i)
 
-		fOpts := resolveFieldOptions(f)
-		if fOpts.Ignore {
-			continue
-		}
+	columns, err := Columns(v.Type())
+	if err != nil {
+		return []Entry{}, err
+	}
 
+	entries := make([]Entry, 0, len(columns))
+	for _, c := range columns {
 		e := Entry{
 			TableName:  tableName,
-			ColumnName: strings.ToLower(f.Name),
+			ColumnName: c.Name,
 			OwnerUUID:  ownerUUID,
 			RowID:      rowID,
 		}
 
 		if includeData {
-			bd, err := convertToBytes(v.Field(i).Interface())
+			fv := v.FieldByIndex(c.Field)
+			if c.OmitEmpty && fv.IsZero() {
+				continue
+			}
+			bd, meta, err := encodeField(fv)
 			if err != nil {
-				return entries
+				// stop early if a value can't be encoded
+				return entries, fmt.Errorf("%s: %w", c.Name, err)
 			}
 			e.Data = bd
+			e.Meta = meta
 		}
 
 		entries = append(entries, e)
 	}
 
-	return entries
+	return entries, nil
 }
 
-func convertToBytes(i interface{}) ([]byte, error) {
-	// Check the type of the interface.
-	switch v := i.(type) {
-	case []byte:
-		// Return the input as a []byte if it is already a []byte.
-		return v, nil
-	case string:
-		// Convert the string to a []byte and return it.
-		return []byte(v), nil
-	default:
-		// Use json.Marshal to convert the interface to a []byte.
-		return json.Marshal(v)
+var uuidType = reflect.TypeOf((*UUID)(nil)).Elem()
+
+func encodeField(fv reflect.Value) ([]byte, byte, error) {
+	if fv.Type() != uuidType {
+		return codec.Encode(fv.Interface())
+	}
+	if fv.IsNil() {
+		return EncodeUUID(nil)
 	}
+	return EncodeUUID(fv.Interface().(UUID))
 }
 
-func assignUint32(data uint32, dest any) error {
-	// Check that the destination argument is a pointer.
-	if reflect.TypeOf(dest).Kind() != reflect.Ptr {
-		return fmt.Errorf("destination must be a pointer")
+// EncodeUUID encodes the value of a UUID field. UUIDs are stored in their
+// own encoding and any other owner, such as RootOwner, as its text, with
+// no value taken to mean the root owner.
+func EncodeUUID(id UUID) ([]byte, byte, error) {
+	switch id := id.(type) {
+	case nil:
+		return codec.Encode(RootOwner{}.String())
+	case uuid.UUID:
+		return codec.Encode(id)
 	}
+	return codec.Encode(id.String())
+}
 
-	switch v := dest.(type) {
-	case *uint32:
-		*v = data
-		return nil
-	}
+// Column describes how a field of a struct is stored.
+type Column struct {
+	Name       string
+	Field      []int // index path of the field, as for reflect.Value.FieldByIndex
+	OmitEmpty  bool
+	Indexed    bool
+	ReadOnly   bool
+	Default    string
+	HasDefault bool
+	Key        bool // the column's value is the row's natural key
+}
 
-	return errors.New("struct field ID is not of type uint32")
+// Columns lists the columns a struct of type t is stored as, honouring the
+// options of each field's mdb tag. Nested structs become dotted sub-columns
+// under their field's name, while the fields of embedded structs are
+// promoted. An error is returned for any tag which can't be understood.
+// The columns of each type are worked out once and shared between
+// callers, so must not be modified.
+func Columns(t reflect.Type) ([]Column, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", t)
+	}
+	d := describe(t)
+	return d.columns, d.err
 }
 
-func CompareBytesToAny(a []byte, i interface{}) bool {
-	switch v := i.(type) {
-	case []byte:
-		return bytes.Equal(a, v)
-	case string:
-		return string(a) == v
-	default:
-		val := reflect.ValueOf(i)
-		if val.Kind() == reflect.Ptr {
-			val = reflect.Indirect(val)
+func appendColumns(columns []Column, t reflect.Type, prefix string, index []int, inherited FieldOptions) ([]Column, error) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
 		}
-		newVal := reflect.New(val.Type())
-		err := json.Unmarshal(a, newVal.Interface())
+
+		fOpts, err := resolveFieldOptions(f)
 		if err != nil {
+			return nil, err
+		}
+		if fOpts.Ignore || fOpts.Children != "" {
+			continue
+		}
+		fOpts.OmitEmpty = fOpts.OmitEmpty || inherited.OmitEmpty
+		fOpts.ReadOnly = fOpts.ReadOnly || inherited.ReadOnly
+
+		path := append(append([]int{}, index...), i)
+
+		if isNestedStruct(f.Type) {
+			if fOpts.Index || fOpts.HasDefault {
+				return nil, fmt.Errorf("field %s: mdb tag options index and default can't be used on a nested struct", f.Name)
+			}
+			nested := prefix
+			if !f.Anonymous || fOpts.Name != "" {
+				nested += fOpts.columnName(f) + "."
+			}
+			if columns, err = appendColumns(columns, f.Type, nested, path, fOpts); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if fOpts.HasDefault {
+			if err := parseDefault(fOpts.Default, reflect.New(f.Type).Interface()); err != nil {
+				return nil, fmt.Errorf("field %s: invalid default %q: %w", f.Name, fOpts.Default, err)
+			}
+		}
+
+		columns = append(columns, Column{
+			Name:       prefix + fOpts.columnName(f),
+			Field:      path,
+			OmitEmpty:  fOpts.OmitEmpty,
+			Indexed:    fOpts.Index,
+			ReadOnly:   fOpts.ReadOnly,
+			Key:        fOpts.Key,
+			Default:    fOpts.Default,
+			HasDefault: fOpts.HasDefault,
+		})
+	}
+
+	return columns, nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// isNestedStruct reports whether a field of type t is flattened into
+// sub-columns, rather than stored whole. Structs which marshal themselves,
+// such as time.Time, are stored whole.
+func isNestedStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for _, m := range []reflect.Type{jsonMarshalerType, textMarshalerType} {
+		if t.Implements(m) || reflect.PointerTo(t).Implements(m) {
 			return false
 		}
-		return reflect.DeepEqual(newVal.Elem().Interface(), i)
 	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareBytesToAny reports whether data stored without a codec tag holds
+// the given value.
+func CompareBytesToAny(a []byte, i interface{}) bool {
+	return CompareEntryToAny(Entry{Data: a}, i)
+}
+
+// CompareEntryToAny reports whether an entry's data decodes to the given
+// value, once converted to the value's type.
+func CompareEntryToAny(e Entry, i any) bool {
+	if i == nil {
+		return false
+	}
+	dest := reflect.New(reflect.TypeOf(i))
+	if err := codec.Decode(e.Data, e.Meta, dest.Interface()); err != nil {
+		return false
+	}
+	// times are equal at the same instant, whatever their zone
+	if t, ok := i.(time.Time); ok {
+		return t.Equal(dest.Elem().Interface().(time.Time))
+	}
+	return reflect.DeepEqual(dest.Elem().Interface(), i)
 }
 
-func convertFromBytes(data []byte, i interface{}) error {
-	// Check that the destination argument is a pointer.
-	if reflect.TypeOf(i).Kind() != reflect.Ptr {
-		return fmt.Errorf("destination must be a pointer")
+func convertFromBytes(data []byte, meta byte, i interface{}) error {
+	if v, ok := i.(*UUID); ok {
+		return DecodeUUID(data, meta, v)
 	}
+	return codec.Decode(data, meta, i)
+}
 
-	// Check the type of the interface.
-	switch v := i.(type) {
-	case *[]byte:
-		// Set the value of the interface to the []byte if it is a pointer to a []byte.
-		*v = data
+// DecodeUUID decodes the value of a UUID field written by EncodeUUID. As
+// UUID fields hold an interface, the owner is resolved from the UUID or
+// text stored.
+func DecodeUUID(data []byte, meta byte, dest *UUID) error {
+	dv, err := codec.DecodeValue(data, meta)
+	if err != nil {
+		return err
+	}
+	switch owner := dv.(type) {
+	case nil:
+		*dest = nil
 		return nil
-	case *string:
-		// Convert the []byte to a string and set the value of the interface to the string.
-		*v = string(data)
+	case uuid.UUID:
+		*dest = owner
 		return nil
-	case *UUID:
-		// Convert the []byte to a UUID instance and set the value of the interface to it.
-		uuidv, err := uuid.ParseBytes(data)
-		if err != nil {
-			return err
+	case string:
+		parsed := ParseOwner(strings.Trim(owner, `"`))
+		if _, ok := parsed.(ownerID); ok {
+			return fmt.Errorf("%q is not a UUID", owner)
 		}
-		*v = uuidv
+		*dest = parsed
 		return nil
-	default:
-		// Use json.Unmarshal to convert the []byte to the interface.
-		return json.Unmarshal(data, v)
 	}
+	return fmt.Errorf("%v is not a UUID", dv)
+}
+
+// FieldOptions are the options given by a field's mdb tag.
+type FieldOptions struct {
+	Name       string
+	Ignore     bool
+	OmitEmpty  bool
+	Index      bool
+	ReadOnly   bool
+	Default    string
+	HasDefault bool
+	Children   string
+	Key        bool
+}
+
+// ColumnName is the name of the column the named field is stored under.
+func (o FieldOptions) ColumnName(fieldName string) string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return strings.ToLower(fieldName)
+}
+
+func (o FieldOptions) columnName(f reflect.StructField) string {
+	return o.ColumnName(f.Name)
 }
 
-type mdbFieldOptions struct {
-	Ignore bool
+func resolveFieldOptions(f reflect.StructField) (FieldOptions, error) {
+	return ParseFieldTag(f.Name, f.Tag)
 }
 
-func resolveFieldOptions(f reflect.StructField) mdbFieldOptions {
-	mdbTagValue := f.Tag.Get("mdb")
-	return mdbFieldOptions{
-		Ignore: strings.Contains(mdbTagValue, "ignore"),
+// ParseFieldTag parses the mdb tag of the named field, a comma separated
+// list of the options ignore, omitempty, index, readonly, name=, default=
+// and children=. Values can't themselves contain commas. It lets tools
+// which read struct types from source agree with Columns.
+func ParseFieldTag(fieldName string, tag reflect.StructTag) (FieldOptions, error) {
+	opts := FieldOptions{}
+	mdbTagValue, ok := tag.Lookup("mdb")
+	if !ok {
+		return opts, nil
+	}
+
+	for _, opt := range strings.Split(mdbTagValue, ",") {
+		opt = strings.TrimSpace(opt)
+		key, value, hasValue := strings.Cut(opt, "=")
+		switch {
+		case opt == "":
+			continue
+		case opt == "ignore":
+			opts.Ignore = true
+		case opt == "omitempty":
+			opts.OmitEmpty = true
+		case opt == "index":
+			opts.Index = true
+		case opt == "readonly":
+			opts.ReadOnly = true
+		case opt == "key":
+			opts.Key = true
+		case hasValue && key == "default":
+			opts.Default = value
+			opts.HasDefault = true
+		case hasValue && (key == "name" || key == "children"):
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value == "" || strings.ContainsAny(value, ". ") {
+				return FieldOptions{}, fmt.Errorf("field %s: mdb tag option %s needs a column name without dots or spaces, found %q", fieldName, key, value)
+			}
+			if key == "name" {
+				opts.Name = value
+			} else {
+				opts.Children = value
+			}
+		default:
+			return FieldOptions{}, fmt.Errorf("field %s: unknown mdb tag option %q", fieldName, opt)
+		}
+	}
+
+	return opts, nil
+}
+
+// parseDefault sets the value dest points to from the text of a default=
+// tag option. Strings are taken as they are, types which unmarshal
+// themselves from text are given it, and anything else is parsed as JSON.
+func parseDefault(text string, dest any) error {
+	v := reflect.ValueOf(dest).Elem()
+	if v.Kind() == reflect.String {
+		v.SetString(text)
+		return nil
+	}
+	if u, ok := dest.(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(text))
+	}
+	return json.Unmarshal([]byte(text), dest)
+}
+
+// LoadDefault sets the field of s which holds the given column to the
+// default declared by its mdb tag, if it has one. It is used for columns
+// which have no value stored.
+func LoadDefault(s any, column string) error {
+	val := reflect.ValueOf(s).Elem()
+	columns, err := Columns(val.Type())
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if c.Name != column || !c.HasDefault {
+			continue
+		}
+		field := val.FieldByIndex(c.Field)
+		field.Set(reflect.Zero(field.Type()))
+		return parseDefault(c.Default, field.Addr().Interface())
+	}
+	return nil
+}
+
+// Relation describes a slice field holding the child rows of a value,
+// declared with an mdb tag such as `mdb:"children=cake"`. Child rows are
+// owned by their parent's UUID and reference it through Column.
+type Relation struct {
+	Name   string
+	Column string
+	Index  int
+	Elem   reflect.Type
+}
+
+// Relations lists the child row fields declared on the given struct type.
+func Relations(t reflect.Type) []Relation {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return []Relation{}
+	}
+	return describe(t).relations
+}
+
+func relations(t reflect.Type) []Relation {
+	relations := []Relation{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fOpts, err := resolveFieldOptions(f)
+		if err != nil || fOpts.Children == "" || fOpts.Ignore || f.Type.Kind() != reflect.Slice {
+			continue
+		}
+		relations = append(relations, Relation{
+			Name:   fOpts.columnName(f),
+			Column: fOpts.Children,
+			Index:  i,
+			Elem:   f.Type.Elem(),
+		})
 	}
+	return relations
 }
@@ -32,12 +32,17 @@
 package kvs_test
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/matryer/is"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
 )
 
 func TestEntryStoreValuesInTable(t *testing.T) {
@@ -147,16 +152,186 @@ func TestConvertToEntries(t *testing.T) {
 		TableName:  "test",
 		ColumnName: "foo",
 		Data:       []byte{70, 111, 111},
+		Meta:       codec.Meta(codec.TagString),
 	}, e[0])
 
 	is.Equal(kvs.Entry{
 		OwnerUUID:  owner,
 		TableName:  "test",
 		ColumnName: "bar",
-		Data:       []byte{52},
+		Data:       []byte{128, 0, 0, 0, 0, 0, 0, 4},
+		Meta:       codec.Meta(codec.TagInt),
 	}, e[1])
 }
 
+func TestConvertToEntriesSkipsChildRelations(t *testing.T) {
+	is := is.New(t)
+
+	type child struct{ Name string }
+	source := struct {
+		Foo      string
+		Children []child `mdb:"children=parent"`
+	}{
+		Foo:      "Foo",
+		Children: []child{{Name: "Bar"}},
+	}
+
+	e := kvs.ConvertToEntries("test", kvs.RootOwner{}, 0, source)
+	is.Equal(len(e), 1)
+	is.Equal(e[0].ColumnName, "foo")
+
+	relations := kvs.Relations(reflect.TypeOf(source))
+	is.Equal(len(relations), 1)
+	is.Equal(relations[0].Name, "children")
+	is.Equal(relations[0].Column, "parent")
+	is.Equal(relations[0].Index, 1)
+}
+
+type Address struct {
+	City     string
+	Postcode string
+}
+
+type Audit struct {
+	Created time.Time
+}
+
+type Customer struct {
+	Audit
+	Name    string
+	Address Address
+	Tags    []string
+	Dims    map[string]int
+	secret  string
+}
+
+func TestConvertToEntriesFlattensNestedStructs(t *testing.T) {
+	is := is.New(t)
+
+	source := Customer{
+		Audit:   Audit{Created: time.Date(2023, 8, 18, 9, 30, 0, 0, time.UTC)},
+		Name:    "Amy",
+		Address: Address{City: "Leadworth", Postcode: "LW1"},
+		Tags:    []string{"a", "b"},
+		Dims:    map[string]int{"w": 1},
+		secret:  "unexported fields are never stored",
+	}
+
+	entries := kvs.ConvertToEntries("customers", kvs.RootOwner{}, 0, source)
+	columns := []string{}
+	for _, e := range entries {
+		columns = append(columns, e.ColumnName)
+	}
+	is.Equal(columns, []string{"created", "name", "address.city", "address.postcode", "tags", "dims"})
+
+	loaded := Customer{}
+	is.NoErr(kvs.LoadEntries(&loaded, entries))
+	source.secret = ""
+	is.Equal(loaded, source)
+
+	field, ok := kvs.FieldByColumn(reflect.ValueOf(&loaded), "address.city")
+	is.True(ok)
+	is.Equal(field.Interface(), "Leadworth")
+	_, ok = kvs.FieldByColumn(reflect.ValueOf(&loaded), "address.country")
+	is.True(!ok)
+}
+
+func TestColumnsParseMdbTagOptions(t *testing.T) {
+	is := is.New(t)
+
+	type Ticket struct {
+		ID       uint32    `mdb:"ignore"`
+		Title    string    `mdb:"name=summary, index"`
+		Priority int       `mdb:"default=3,omitempty"`
+		Opened   time.Time `mdb:"readonly"`
+		Address  Address   `mdb:"name=location"`
+	}
+
+	columns, err := kvs.Columns(reflect.TypeOf(Ticket{}))
+	is.NoErr(err)
+	is.Equal(columns, []kvs.Column{
+		{Name: "summary", Field: []int{1}, Indexed: true},
+		{Name: "priority", Field: []int{2}, OmitEmpty: true, Default: "3", HasDefault: true},
+		{Name: "opened", Field: []int{3}, ReadOnly: true},
+		{Name: "location.city", Field: []int{4, 0}},
+		{Name: "location.postcode", Field: []int{4, 1}},
+	})
+
+	entries := kvs.ConvertToEntries("tickets", kvs.RootOwner{}, 0, Ticket{Title: "Broken", Address: Address{City: "Leadworth"}})
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.ColumnName)
+	}
+	is.Equal(names, []string{"summary", "opened", "location.city", "location.postcode"}) // zero priority is omitted
+
+	loaded := Ticket{}
+	is.NoErr(kvs.LoadEntries(&loaded, entries))
+	is.NoErr(kvs.LoadDefault(&loaded, "priority"))
+	is.Equal(loaded.Title, "Broken")
+	is.Equal(loaded.Address.City, "Leadworth")
+	is.Equal(loaded.Priority, 3)
+
+	err = kvs.LoadEntry(&loaded, kvs.Entry{ColumnName: "title", Data: []byte("renamed")})
+	is.True(err != nil) // a renamed field is only matched by its column name
+}
+
+func TestColumnsRejectUnknownMdbTagOptions(t *testing.T) {
+	is := is.New(t)
+
+	type Reason struct {
+		Text string `mdb:"ignored_reason"`
+	}
+	_, err := kvs.Columns(reflect.TypeOf(Reason{}))
+	is.Equal(err.Error(), `field Text: unknown mdb tag option "ignored_reason"`)
+	is.Equal(len(kvs.ConvertToEntries("reasons", kvs.RootOwner{}, 0, Reason{Text: "x"})), 0)
+	err = kvs.LoadEntry(&Reason{}, kvs.Entry{ColumnName: "text", Data: []byte("x")})
+	is.Equal(err.Error(), `field Text: unknown mdb tag option "ignored_reason"`)
+
+	type BadDefault struct {
+		Count int `mdb:"default=many"`
+	}
+	_, err = kvs.Columns(reflect.TypeOf(BadDefault{}))
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), `field Count: invalid default "many"`))
+
+	type BadName struct {
+		Count int `mdb:"name=a.b"`
+	}
+	_, err = kvs.Columns(reflect.TypeOf(BadName{}))
+	is.Equal(err.Error(), `field Count: mdb tag option name needs a column name without dots or spaces, found "a.b"`)
+}
+
+func TestOwnerFieldsRoundTrip(t *testing.T) {
+	is := is.New(t)
+
+	type Link struct {
+		Parent kvs.UUID
+		Target uuid.UUID
+	}
+
+	for _, parent := range []kvs.UUID{uuid.New(), kvs.RootOwner{}} {
+		source := Link{Parent: parent, Target: uuid.New()}
+		entries := kvs.ConvertToEntries("links", kvs.RootOwner{}, 0, source)
+		is.Equal(len(entries), 2)
+		is.Equal(entries[1].Meta, codec.Meta(codec.TagUUID))
+
+		loaded := Link{}
+		is.NoErr(kvs.LoadEntries(&loaded, entries))
+		is.Equal(loaded, source)
+
+		id, ok := kvs.UUIDFromData(entries[1].Data, entries[1].Meta)
+		is.True(ok)
+		is.Equal(id, source.Target)
+	}
+
+	// owners stored as JSON text before UUIDs had an encoding still load
+	id := uuid.New()
+	loaded := Link{}
+	is.NoErr(kvs.LoadEntry(&loaded, kvs.Entry{ColumnName: "parent", Data: []byte(`"` + id.String() + `"`), Meta: codec.Meta(codec.TagJSON)}))
+	is.Equal(loaded.Parent, id)
+	is.True(kvs.LoadEntry(&loaded, kvs.Entry{ColumnName: "parent", Data: []byte("bob")}) != nil)
+}
+
 func TestLoadEntriesIntoStruct(t *testing.T) {
 	// Define a struct type to use for the test
 	type TestStruct struct {
@@ -256,3 +431,140 @@ func TestCompareBytesWithStruct(t *testing.T) {
 	input := []byte("{\"A\":5,\"B\":\"hello\"}")
 	is.True(kvs.CompareBytesToAny(input, TestStruct{A: 5, B: "hello"}))
 }
+
+func TestParseKeyRecoversEntryFields(t *testing.T) {
+	is := is.New(t)
+
+	owner := uuid.New()
+	e := kvs.Entry{TableName: "people", ColumnName: "address.city", OwnerUUID: owner, RowID: 12}
+
+	parsed, err := kvs.ParseKey(e.Key())
+	is.NoErr(err)
+	is.Equal(parsed, e)
+
+	parsed, err = kvs.ParseKey([]byte("balloons.color.root.3"))
+	is.NoErr(err)
+	is.Equal(parsed, kvs.Entry{TableName: "balloons", ColumnName: "color", OwnerUUID: kvs.RootOwner{}, RowID: 3})
+
+	for _, k := range []string{"root.balloons", "balloons.root.3", "balloons.color.root.x", "nodots"} {
+		_, err = kvs.ParseKey([]byte(k))
+		is.Equal(err.Error(), "malformed key: "+k)
+	}
+}
+
+func TestAnyOwnerPrefixKeySpansAllOwners(t *testing.T) {
+	is := is.New(t)
+
+	e := kvs.Entry{TableName: "candles", ColumnName: "lit", OwnerUUID: kvs.AnyOwner{}}
+	is.Equal(string(e.PrefixKey()), "candles.lit.")
+	is.Equal(kvs.ParseOwner("*"), kvs.AnyOwner{})
+	is.Equal(kvs.ParseOwner("root"), kvs.RootOwner{})
+	is.Equal(kvs.ParseOwner("11").String(), "11")
+}
+
+func TestRowKeysAndEncodingRoundTrip(t *testing.T) {
+	is := is.New(t)
+
+	owner := uuid.New()
+	row := kvs.Entry{TableName: "readings", OwnerUUID: owner, RowID: 12}
+	key := kvs.RowKey(row)
+	is.Equal(string(key), "readings."+owner.String()+".12")
+	is.True(kvs.IsRowKey(key))
+	is.True(!kvs.IsRowKey(kvs.Entry{TableName: "readings", ColumnName: "value", OwnerUUID: owner, RowID: 12}.Key()))
+	is.True(!kvs.IsRowKey([]byte(owner.String() + ".readings")))
+
+	parsed, err := kvs.ParseRowKey(key)
+	is.NoErr(err)
+	is.Equal(parsed, row)
+
+	entries := []kvs.Entry{}
+	for _, v := range []any{"north", 21.5, nil} {
+		e := row
+		e.ColumnName = fmt.Sprintf("c%d", len(entries))
+		e.Data, e.Meta, err = codec.Encode(v)
+		is.NoErr(err)
+		entries = append(entries, e)
+	}
+
+	decoded, err := kvs.DecodeRow(row, kvs.EncodeRow(entries))
+	is.NoErr(err)
+	is.Equal(len(decoded), 3)
+	for i, e := range decoded {
+		is.Equal(e.ColumnName, entries[i].ColumnName)
+		is.Equal(e.Meta, entries[i].Meta)
+		is.Equal(string(e.Data), string(entries[i].Data))
+		is.Equal(e.RowID, uint32(12))
+	}
+
+	_, err = kvs.DecodeRow(row, kvs.EncodeRow(entries)[:9])
+	is.True(err != nil) // truncated rows should not decode
+}
+
+func TestRowIDsWhichAreNotNumbersRoundTripThroughKeys(t *testing.T) {
+	is := is.New(t)
+
+	for _, id := range []kvs.RowID{"42", "042", "amy@pond.example", "50%!", "-3", "4294967296", kvs.RowID(uuid.NewString())} {
+		e := kvs.Entry{TableName: "members", ColumnName: "name", OwnerUUID: kvs.RootOwner{}, Data: []byte("Amy")}.WithRowID(id)
+
+		parsed, err := kvs.ParseKey(e.Key())
+		is.NoErr(err)
+		is.Equal(parsed.ResolveRowID(), id)
+
+		parsed, err = kvs.ParseRowKey(kvs.RowKey(e))
+		is.NoErr(err)
+		is.Equal(parsed.ResolveRowID(), id)
+
+		parsed, err = kvs.ParseIndexKey(kvs.IndexKey(e))
+		is.NoErr(err)
+		is.Equal(parsed.ResolveRowID(), id)
+	}
+
+	// numbers which fit a uint32 are held in RowID, the rest in TextID
+	e := kvs.Entry{}.WithRowID("42")
+	is.Equal(e.RowID, uint32(42))
+	is.Equal(e.TextID, kvs.RowID(""))
+	e = kvs.Entry{}.WithRowID("amy@pond.example")
+	is.Equal(e.RowID, uint32(0))
+	is.Equal(e.TextID, kvs.RowID("amy@pond.example"))
+
+	// numbers are written bare, as they always have been
+	is.Equal(string(kvs.Entry{TableName: "t", ColumnName: "c", OwnerUUID: kvs.RootOwner{}, RowID: 7}.Key()), "t.c.root.7")
+	is.Equal(string(kvs.Entry{TableName: "t", ColumnName: "c", OwnerUUID: kvs.RootOwner{}, TextID: "a.b"}.Key()), "t.c.root.~a%2Eb")
+
+	ids := []kvs.RowID{"b", "10", "a", "9", "010"}
+	sort.Slice(ids, func(i, j int) bool { return kvs.CompareRowIDs(ids[i], ids[j]) < 0 })
+	is.Equal(ids, []kvs.RowID{"9", "10", "010", "a", "b"})
+}
+
+func TestLoadRowIDFillsIDFieldsOfAnyKind(t *testing.T) {
+	is := is.New(t)
+
+	withUint32 := struct{ ID uint32 }{}
+	is.NoErr(kvs.LoadID(&withUint32, 12))
+	is.Equal(withUint32.ID, uint32(12))
+
+	id := uuid.New()
+	withUUID := struct{ ID uuid.UUID }{}
+	is.NoErr(kvs.LoadRowID(&withUUID, kvs.RowID(id.String())))
+	is.Equal(withUUID.ID, id)
+
+	withString := struct{ ID string }{}
+	is.NoErr(kvs.LoadRowID(&withString, "amy@pond.example"))
+	is.Equal(withString.ID, "amy@pond.example")
+
+	withInt := struct{ ID int64 }{}
+	is.NoErr(kvs.LoadRowID(&withInt, "12"))
+	is.Equal(withInt.ID, int64(12))
+
+	withUint8 := struct{ ID uint8 }{}
+	is.Equal(kvs.LoadRowID(&withUint8, "300").Error(), "failed to load row ID 300 into field ID: it does not fit uint8")
+
+	keyed := struct {
+		Email string `mdb:"key"`
+	}{Email: "rory@pond.example"}
+	is.NoErr(kvs.LoadRowID(&keyed, "rory@pond.example"))
+	key, ok, err := kvs.KeyOf(keyed)
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(key, kvs.RowID("rory@pond.example"))
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/query"
 	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 )
 
@@ -59,17 +60,13 @@ func hierarchy() {
 	store.Save(healthyishCarrotCake.UUID, &Candle{Cake: healthyishCarrotCake.UUID, Lit: true})
 	store.Save(redVelvetCake.UUID, &Candle{Cake: redVelvetCake.UUID, Lit: true})
 
-	bs, err := storage.LoadAll[Cake](store, child.UUID)
-	for _, cake := range bs {
-		fmt.Printf("ROWID: %d, %+v\n", cake.ID, cake)
-
-		candles, err := storage.LoadAll[Cake](store, cake.UUID)
-		if err != nil {
-			panic(err)
-		}
+	pairs, err := query.Join[Cake, Candle](store, child.UUID, "uuid", "cake")
+	if err != nil {
+		panic(err)
+	}
 
-		for _, candle := range candles {
-			fmt.Printf("ROWID: %d, %+v\n", candle.ID, candle)
-		}
+	for _, pair := range pairs {
+		fmt.Printf("ROWID: %d, %+v\n", pair.Left.ID, pair.Left)
+		fmt.Printf("ROWID: %d, %+v\n", pair.Right.ID, pair.Right)
 	}
 }
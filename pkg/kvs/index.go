@@ -0,0 +1,128 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// indexKeyPrefix begins every key of a secondary index. Index keys never
+// parse as entry keys, so scans of tables and owners pass over them.
+const indexKeyPrefix = "!index!"
+
+// indexHashSize is the number of bytes of a value's SHA-256 hash kept in
+// its index keys, so that they're the same size however big the value.
+const indexHashSize = 16
+
+// IndexKey is the key under which an entry's value is indexed for a column
+// declared with the index tag option. It sorts with every other row of the
+// same table and column holding an identical value, by owner and row. Only
+// a hash of the value is kept in the key, so rows found through it must be
+// checked against the value they hold.
+func IndexKey(e Entry) []byte {
+	return []byte(fmt.Sprintf("%s%s", IndexPrefix(e.TableName, e.ColumnName, e.OwnerUUID, e.Data, e.Meta), e.ResolveRowID().segment()))
+}
+
+// IndexPrefix is the prefix shared by the index keys of every row of the
+// owner holding the given value, or of every owner if owner is AnyOwner.
+func IndexPrefix(tableName, columnName string, owner UUID, data []byte, meta byte) []byte {
+	prefix := fmt.Sprintf("%s%s!", IndexColumnPrefix(tableName, columnName), indexHash(data, meta))
+	if _, ok := owner.(AnyOwner); ok {
+		return []byte(prefix)
+	}
+	return []byte(prefix + Entry{OwnerUUID: owner}.resolveOwnerID() + "!")
+}
+
+// indexHash is the hex of the hash of a value kept in its index keys. The
+// meta byte is hashed with the data, so equal bytes of different types
+// aren't indexed together.
+func indexHash(data []byte, meta byte) string {
+	h := sha256.New()
+	h.Write([]byte{meta})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)[:indexHashSize])
+}
+
+// IndexColumnPrefix is the prefix shared by every index key of a column,
+// whatever the value indexed.
+func IndexColumnPrefix(tableName, columnName string) []byte {
+	return []byte(fmt.Sprintf("%s%s!", IndexTablePrefix(tableName), columnName))
+}
+
+// IndexTablePrefix is the prefix shared by every index key of a table.
+func IndexTablePrefix(tableName string) []byte {
+	return []byte(fmt.Sprintf("%s%s!", indexKeyPrefix, tableName))
+}
+
+// IndexStateKey is the key recording how far the index of a column has
+// been built. It sorts before every index key of the column, and never
+// parses as one.
+func IndexStateKey(tableName, columnName string) []byte {
+	return IndexColumnPrefix(tableName, columnName)
+}
+
+// IsIndexKey reports whether k belongs to a secondary index.
+func IsIndexKey(k []byte) bool {
+	return bytes.HasPrefix(k, []byte(indexKeyPrefix))
+}
+
+// ParseIndexKey reverses IndexKey, recovering the table, column, owner and
+// row ID of the entry which was indexed. Its value can't be recovered, as
+// only a hash of it is kept.
+func ParseIndexKey(k []byte) (Entry, error) {
+	key, ok := strings.CutPrefix(string(k), indexKeyPrefix)
+	if !ok {
+		return Entry{}, fmt.Errorf("malformed index key: %s", k)
+	}
+
+	parts := strings.Split(key, "!")
+	if len(parts) != 5 {
+		return Entry{}, fmt.Errorf("malformed index key: %s", k)
+	}
+	if hash, err := hex.DecodeString(parts[2]); err != nil || len(hash) != indexHashSize {
+		return Entry{}, fmt.Errorf("malformed index key: %s", k)
+	}
+	rowID, ok := parseRowSegment(parts[4])
+	if !ok {
+		return Entry{}, fmt.Errorf("malformed index key: %s", k)
+	}
+
+	return Entry{
+		TableName:  parts[0],
+		ColumnName: parts[1],
+		OwnerUUID:  ParseOwner(parts[3]),
+	}.WithRowID(rowID), nil
+}
@@ -32,11 +32,13 @@
 package kvs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
 )
 
 type KVDB struct {
@@ -75,6 +77,21 @@ func (db KVDB) Update(f func(txn *badger.Txn) error) error {
 	return db.conn.Update(f)
 }
 
+func (db KVDB) NewWriteBatch() *badger.WriteBatch {
+	return db.conn.NewWriteBatch()
+}
+
+// Subscribe calls f with the keys written under any of the given prefixes,
+// by whichever connection wrote them, until ctx is done. An empty prefix
+// watches every key.
+func (db KVDB) Subscribe(ctx context.Context, f func(kvs *badger.KVList) error, prefixes ...[]byte) error {
+	matches := make([]pb.Match, 0, len(prefixes))
+	for _, p := range prefixes {
+		matches = append(matches, pb.Match{Prefix: p})
+	}
+	return db.conn.Subscribe(ctx, f, matches)
+}
+
 func (db KVDB) DumpTo(w io.Writer) error {
 	return db.conn.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
@@ -0,0 +1,339 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+// AggregateOp identifies the computation an aggregate terminal performs.
+type AggregateOp int64
+
+const (
+	undefinedAggregate AggregateOp = iota
+	OpCount
+	OpSum
+	OpMin
+	OpMax
+	OpAvg
+)
+
+func (op AggregateOp) String() string {
+	switch op {
+	case OpCount:
+		return "count"
+	case OpSum:
+		return "sum"
+	case OpMin:
+		return "min"
+	case OpMax:
+		return "max"
+	case OpAvg:
+		return "avg"
+	default:
+		return "undefined"
+	}
+}
+
+// ParseAggregateOp resolves an aggregate operation from its name.
+func ParseAggregateOp(name string) (AggregateOp, error) {
+	for _, op := range []AggregateOp{OpCount, OpSum, OpMin, OpMax, OpAvg} {
+		if strings.EqualFold(op.String(), name) {
+			return op, nil
+		}
+	}
+	return undefinedAggregate, fmt.Errorf("unknown aggregate operation %q", name)
+}
+
+// Aggregate is the result of an aggregate terminal. Value holds the result
+// over every matching row and, if the query was grouped, Groups holds the
+// result for each distinct value of the grouping column. Null is set when
+// a min, max or avg found no values to aggregate, so Value holds none.
+type Aggregate struct {
+	Value  float64            `json:"value"`
+	Null   bool               `json:"null,omitempty"`
+	Groups map[string]float64 `json:"groups,omitempty"`
+}
+
+// Decoder converts a stored entry into the Go value it represents.
+type Decoder func(e kvs.Entry) (any, error)
+
+// GroupBy partitions aggregate results by the value of the given column.
+func (q *Query) GroupBy(fieldName string) *Query {
+	q = q.clone()
+	q.groupBy = strings.ToLower(fieldName)
+	return q
+}
+
+// Count returns the number of rows of T which match the query.
+func Count[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) (Aggregate, error) {
+	return aggregateValue[T](s, owner, q, OpCount, "")
+}
+
+// Sum returns the total of the given numeric field across matching rows of T.
+func Sum[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, fieldName string) (Aggregate, error) {
+	return aggregateValue[T](s, owner, q, OpSum, fieldName)
+}
+
+// Min returns the smallest value of the given numeric field across matching rows of T.
+func Min[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, fieldName string) (Aggregate, error) {
+	return aggregateValue[T](s, owner, q, OpMin, fieldName)
+}
+
+// Max returns the largest value of the given numeric field across matching rows of T.
+func Max[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, fieldName string) (Aggregate, error) {
+	return aggregateValue[T](s, owner, q, OpMax, fieldName)
+}
+
+// Avg returns the mean value of the given numeric field across matching rows of T.
+func Avg[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, fieldName string) (Aggregate, error) {
+	return aggregateValue[T](s, owner, q, OpAvg, fieldName)
+}
+
+func aggregateValue[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, op AggregateOp, fieldName string) (Aggregate, error) {
+	v := *new(T)
+	blankEntries := kvs.ConvertToBlankEntries(v.TableName(), owner, 0, v)
+
+	columns := map[string]struct{}{}
+	for _, e := range blankEntries {
+		columns[e.ColumnName] = struct{}{}
+	}
+
+	for _, c := range aggregateColumns(q, fieldName) {
+		if _, ok := columns[c]; !ok {
+			return Aggregate{}, fmt.Errorf("%s does not have a column named %q", v.TableName(), c)
+		}
+	}
+
+	return aggregateRows(s, v.TableName(), owner, q, op, fieldName, decodeInto[T])
+}
+
+// AggregateTable runs an aggregate over a table without a Go type describing
+// its rows, using decode to convert stored entries into values.
+func AggregateTable(s storage.Store, tableName string, owner kvs.UUID, q *Query, op AggregateOp, fieldName string, decode Decoder) (Aggregate, error) {
+	return aggregateRows(s, tableName, owner, q, op, fieldName, decode)
+}
+
+func aggregateColumns(q *Query, fieldName string) []string {
+	columns := []string{}
+	if fieldName != "" {
+		columns = append(columns, strings.ToLower(fieldName))
+	}
+	if q == nil {
+		return columns
+	}
+	if q.groupBy != "" {
+		columns = append(columns, q.groupBy)
+	}
+	return append(columns, q.filterColumns()...)
+}
+
+func aggregateRows(s storage.Store, tableName string, owner kvs.UUID, q *Query, op AggregateOp, fieldName string, decode Decoder) (Aggregate, error) {
+	if op == undefinedAggregate {
+		return Aggregate{}, fmt.Errorf("undefined aggregate operation")
+	}
+	if op != OpCount && fieldName == "" {
+		return Aggregate{}, fmt.Errorf("%s requires a field to aggregate", op)
+	}
+	fieldName = strings.ToLower(fieldName)
+
+	columns := aggregateColumns(q, fieldName)
+	if len(columns) == 0 {
+		// a bare count has no column to read, and no one column is stored
+		// for every row
+		n, err := storage.CountRows(s, tableName, owner)
+		return Aggregate{Value: float64(n)}, err
+	}
+
+	columns, err := storage.ExpandColumns(s, tableName, owner, dedupe(columns))
+	if err != nil {
+		return Aggregate{}, err
+	}
+	rows, err := storage.LoadRows(s, tableName, owner, columns...)
+	if err != nil {
+		return Aggregate{}, err
+	}
+
+	total := aggregator{op: op}
+	var groups map[string]*aggregator
+	if q != nil && q.groupBy != "" {
+		groups = map[string]*aggregator{}
+	}
+
+	for _, row := range rows {
+		if q != nil {
+			ok, err := q.matches(row)
+			if err != nil {
+				return Aggregate{}, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		value := 0.0
+		if fieldName != "" {
+			// nulls are left out, as absent values are
+			e, ok := row.Entry(fieldName)
+			if !ok || e.Meta == codec.Null {
+				continue
+			}
+			dv, err := decode(e)
+			if err != nil {
+				return Aggregate{}, err
+			}
+			if value, err = toFloat64(dv); err != nil {
+				return Aggregate{}, fmt.Errorf("unable to aggregate column %q: %w", fieldName, err)
+			}
+		}
+
+		total.add(value)
+
+		if groups == nil {
+			continue
+		}
+
+		key := ""
+		if e, ok := row.Entry(q.groupBy); ok {
+			gv, err := decode(e)
+			if err != nil {
+				return Aggregate{}, err
+			}
+			key = fmt.Sprint(gv)
+		}
+		group, ok := groups[key]
+		if !ok {
+			group = &aggregator{op: op}
+			groups[key] = group
+		}
+		group.add(value)
+	}
+
+	value, ok := total.result()
+	result := Aggregate{Value: value, Null: !ok}
+	if groups != nil {
+		// every group holds at least one value
+		result.Groups = make(map[string]float64, len(groups))
+		for k, g := range groups {
+			result.Groups[k], _ = g.result()
+		}
+	}
+
+	return result, nil
+}
+
+type aggregator struct {
+	op            AggregateOp
+	count         int
+	sum, min, max float64
+}
+
+func (a *aggregator) add(v float64) {
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.count++
+}
+
+// result returns the aggregate of the values added, and false if there is
+// none because the operation has no value over zero rows.
+func (a *aggregator) result() (float64, bool) {
+	switch a.op {
+	case OpCount:
+		return float64(a.count), true
+	case OpSum:
+		return a.sum, true
+	}
+	if a.count == 0 {
+		return 0, false
+	}
+	switch a.op {
+	case OpMin:
+		return a.min, true
+	case OpMax:
+		return a.max, true
+	case OpAvg:
+		return a.sum / float64(a.count), true
+	}
+	return 0, false
+}
+
+func decodeInto[T storage.Value](e kvs.Entry) (any, error) {
+	dest := new(T)
+	if err := kvs.LoadEntry(dest, e); err != nil {
+		return nil, err
+	}
+	field, _ := kvs.FieldByColumn(reflect.ValueOf(dest), e.ColumnName)
+	return field.Interface(), nil
+}
+
+func toFloat64(v any) (float64, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		if rv.Type() == reflect.TypeOf(json.Number("")) {
+			return strconv.ParseFloat(rv.String(), 64)
+		}
+	}
+	return 0, fmt.Errorf("value of type %T is not numeric", v)
+}
+
+func dedupe(columns []string) []string {
+	seen := map[string]struct{}{}
+	unique := []string{}
+	for _, c := range columns {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		unique = append(unique, c)
+	}
+	return unique
+}
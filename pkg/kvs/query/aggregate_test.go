@@ -0,0 +1,221 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query_test
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/query"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+type Passenger struct {
+	ID        uint32 `mdb:"ignore"`
+	FirstName string
+	Surname   string
+	Age       int
+}
+
+func (p Passenger) TableName() string { return "passengers" }
+
+func seedPassengers(store storage.Store) {
+	store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Brian", Surname: "Hax", Age: 3})
+	store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Amy", Surname: "Hax", Age: 26})
+	store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Mark", Surname: "West", Age: 58})
+	store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Rory", Surname: "Hax", Age: 27})
+}
+
+func TestAggregateCountWithoutFilters(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	seedPassengers(store)
+
+	count, err := query.Count[Passenger](store, kvs.RootOwner{}, query.New())
+	is.NoErr(err)
+	is.Equal(count.Value, float64(4))
+	is.Equal(count.Groups, nil)
+}
+
+// Stowaway leaves out its alias when it has none, so not every row has
+// its first column stored.
+type Stowaway struct {
+	ID    uint32 `mdb:"ignore"`
+	Alias string `mdb:"omitempty"`
+	Deck  int
+}
+
+func (s Stowaway) TableName() string { return "stowaways" }
+
+// PackedStowaway stores the rows of the stowaways table row by row.
+type PackedStowaway Stowaway
+
+func (s PackedStowaway) TableName() string      { return "stowaways" }
+func (s PackedStowaway) Layout() storage.Layout { return storage.RowMajor }
+
+func TestAggregateCountFindsRowsWhicheverColumnsTheyHold(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Stowaway{Alias: "Doctor", Deck: 1}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Stowaway{Deck: 2}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedStowaway{Deck: 3}))
+
+	count, err := query.Count[Stowaway](store, kvs.RootOwner{}, query.New())
+	is.NoErr(err)
+	is.Equal(count.Value, float64(3))
+
+	count, err = query.AggregateTable(store, "stowaways", kvs.RootOwner{}, nil, query.OpCount, "", nil)
+	is.NoErr(err)
+	is.Equal(count.Value, float64(3))
+}
+
+func TestAggregateCountGroupedBySurname(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	seedPassengers(store)
+
+	count, err := query.Count[Passenger](store, kvs.RootOwner{}, query.New().GroupBy("surname"))
+	is.NoErr(err)
+	is.Equal(count.Value, float64(4))
+	is.Equal(count.Groups, map[string]float64{"Hax": 3, "West": 1})
+}
+
+func TestAggregateNumericTerminalsWithFilter(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	seedPassengers(store)
+
+	q := query.New().Filter("surname").Eq("Hax")
+
+	sum, err := query.Sum[Passenger](store, kvs.RootOwner{}, q, "age")
+	is.NoErr(err)
+	is.Equal(sum.Value, float64(56))
+
+	min, err := query.Min[Passenger](store, kvs.RootOwner{}, q, "age")
+	is.NoErr(err)
+	is.Equal(min.Value, float64(3))
+
+	max, err := query.Max[Passenger](store, kvs.RootOwner{}, q, "age")
+	is.NoErr(err)
+	is.Equal(max.Value, float64(27))
+
+	avg, err := query.Avg[Passenger](store, kvs.RootOwner{}, q.GroupBy("surname"), "age")
+	is.NoErr(err)
+	is.Equal(avg.Value, float64(56)/3)
+	is.Equal(avg.Groups, map[string]float64{"Hax": float64(56) / 3})
+	is.True(!avg.Null)
+}
+
+func TestAggregateOverNoValuesIsNull(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	seedPassengers(store)
+
+	q := query.New().Filter("surname").Eq("Pond")
+
+	// counts and sums over no rows are zero
+	count, err := query.Count[Passenger](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+	is.Equal(count, query.Aggregate{})
+
+	sum, err := query.Sum[Passenger](store, kvs.RootOwner{}, q, "age")
+	is.NoErr(err)
+	is.Equal(sum, query.Aggregate{})
+
+	// but nothing has no smallest, largest or mean value
+	min, err := query.Min[Passenger](store, kvs.RootOwner{}, q, "age")
+	is.NoErr(err)
+	is.Equal(min, query.Aggregate{Null: true})
+
+	max, err := query.Max[Passenger](store, kvs.RootOwner{}, q, "age")
+	is.NoErr(err)
+	is.Equal(max, query.Aggregate{Null: true})
+
+	avg, err := query.Avg[Passenger](store, kvs.RootOwner{}, q.GroupBy("surname"), "age")
+	is.NoErr(err)
+	is.Equal(avg, query.Aggregate{Null: true, Groups: map[string]float64{}})
+}
+
+func TestAggregateOverNonNumericFieldFails(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	seedPassengers(store)
+
+	_, err = query.Sum[Passenger](store, kvs.RootOwner{}, query.New(), "surname")
+	is.True(err != nil)
+
+	_, err = query.Sum[Passenger](store, kvs.RootOwner{}, query.New(), "height")
+	is.Equal(err.Error(), `passengers does not have a column named "height"`)
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+// compareEntry orders an entry's decoded data against a filter value. The
+// second result is false if the data cannot be compared with that value. A
+// string filter value is first read as the type of the data, failing if it
+// can't be, so that numbers compare as numbers rather than as text.
+func compareEntry(e kvs.Entry, v any) (int, bool, error) {
+	d, err := codec.DecodeValue(e.Data, e.Meta)
+	if err != nil {
+		return 0, false, nil
+	}
+
+	if s, ok := v.(string); ok {
+		if v, err = coerce(d, s); err != nil {
+			return 0, false, fmt.Errorf("unable to compare column %q with %q: %w", e.ColumnName, s, err)
+		}
+	}
+
+	switch dv := d.(type) {
+	case time.Time:
+		t, ok := toTime(v)
+		if !ok {
+			return 0, false, nil
+		}
+		return dv.Compare(t), true, nil
+	case time.Duration:
+		if pd, ok := v.(time.Duration); ok {
+			return compareValues(dv, pd), true, nil
+		}
+	}
+
+	switch vv := v.(type) {
+	case string:
+		return strings.Compare(fmt.Sprint(d), vv), true, nil
+	case bool:
+		b, ok := d.(bool)
+		if !ok {
+			return 0, false, nil
+		}
+		return compareValues(b, vv), true, nil
+	}
+
+	if _, ok := toBigFloat(d); !ok {
+		return 0, false, nil
+	}
+	if _, ok := toBigFloat(v); !ok {
+		return 0, false, nil
+	}
+	return compareValues(d, v), true, nil
+}
+
+// coerce reads a string filter value as the type of the decoded data it's
+// compared with. Data of any type but times, durations, bools and numbers
+// compares with the string as text.
+func coerce(d any, s string) (any, error) {
+	switch d.(type) {
+	case time.Time:
+		t, ok := toTime(s)
+		if !ok {
+			return nil, errors.New("not an RFC 3339 time or a date")
+		}
+		return t, nil
+	case time.Duration:
+		pd, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, errors.New("not a duration")
+		}
+		return pd, nil
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("not a bool")
+		}
+		return b, nil
+	}
+
+	if _, ok := toBigFloat(d); ok {
+		n := json.Number(strings.TrimSpace(s))
+		if _, ok := toBigFloat(n); !ok {
+			return nil, errors.New("not a number")
+		}
+		return n, nil
+	}
+	return s, nil
+}
+
+// compareValues orders two decoded values, numerically where both are
+// numbers, chronologically where both are times and otherwise by their
+// textual representation.
+func compareValues(a, b any) int {
+	if af, ok := toBigFloat(a); ok {
+		if bf, ok := toBigFloat(b); ok {
+			return af.Cmp(bf)
+		}
+	}
+
+	if at, ok := a.(time.Time); ok {
+		if bt, ok := b.(time.Time); ok {
+			return at.Compare(bt)
+		}
+	}
+
+	if ab, ok := a.(bool); ok {
+		if bb, ok := b.(bool); ok {
+			switch {
+			case ab == bb:
+				return 0
+			case !ab:
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// toTime reads a filter value as a time, accepting times written in RFC
+// 3339 format or as plain dates.
+func toTime(v any) (time.Time, bool) {
+	switch tv := v.(type) {
+	case time.Time:
+		return tv, true
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+			if t, err := time.Parse(layout, tv); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// toBigFloat holds a number exactly, so that 64-bit integers too large for
+// a float64 still compare correctly.
+func toBigFloat(v any) (*big.Float, bool) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Float).SetInt64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Float).SetUint64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) {
+			return nil, false
+		}
+		return big.NewFloat(f), true
+	case reflect.String:
+		if rv.Type() == reflect.TypeOf(json.Number("")) {
+			f, _, err := big.ParseFloat(rv.String(), 10, 64, big.ToNearestEven)
+			return f, err == nil
+		}
+	}
+	return nil, false
+}
+
+func sortValues[T any](values []T, by []ordering) {
+	if len(by) == 0 {
+		return
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		a, b := reflect.ValueOf(values[i]), reflect.ValueOf(values[j])
+		for _, o := range by {
+			c := compareOrderValues(fieldByColumn(a, o.fieldName), fieldByColumn(b, o.fieldName))
+			if c == 0 {
+				continue
+			}
+			if o.descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// fieldByColumn returns the value a column names within v, following
+// pointers and paths inside maps and slices, or nil if there is none.
+func fieldByColumn(v reflect.Value, column string) any {
+	f, ok := kvs.Lookup(v, column)
+	if !ok {
+		return nil
+	}
+	for f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return nil
+		}
+		f = f.Elem()
+	}
+	return f.Interface()
+}
+
+func sortRows(rows []storage.Row, by []ordering, decode Decoder) error {
+	if len(by) == 0 {
+		return nil
+	}
+
+	type keyedRow struct {
+		row  storage.Row
+		keys []any
+	}
+
+	// decode every ordering value up front so that sorting cannot fail part way
+	keyed := make([]keyedRow, len(rows))
+	for i, row := range rows {
+		keyed[i] = keyedRow{row: row, keys: make([]any, len(by))}
+		for k, o := range by {
+			e, ok := row.Entry(o.fieldName)
+			if !ok {
+				continue
+			}
+			v, err := decode(e)
+			if err != nil {
+				return err
+			}
+			keyed[i].keys[k] = v
+		}
+	}
+
+	sort.SliceStable(keyed, func(i, j int) bool {
+		for k, o := range by {
+			c := compareOrderValues(keyed[i].keys[k], keyed[j].keys[k])
+			if c == 0 {
+				continue
+			}
+			if o.descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	for i := range keyed {
+		rows[i] = keyed[i].row
+	}
+
+	return nil
+}
+
+// compareOrderValues orders decoded values, placing absent values first.
+func compareOrderValues(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return compareValues(a, b)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+// Access describes how a plan reaches the rows it reads.
+type Access int
+
+const (
+	// ScanAccess reads every stored value of each column the plan touches.
+	ScanAccess Access = iota
+	// IndexAccess looks rows up through an index on a filtered column.
+	IndexAccess
+)
+
+func (a Access) String() string {
+	switch a {
+	case IndexAccess:
+		return "index"
+	default:
+		return "scan"
+	}
+}
+
+// Plan describes how a query will be executed.
+type Plan struct {
+	Table   string
+	Access  Access
+	Index   string   // the column looked up, for IndexAccess
+	Columns []string // nil when every column of the table is read
+	Filters []string
+	OrderBy []string
+	Limit   int
+}
+
+func (p Plan) String() string {
+	sb := strings.Builder{}
+	sb.WriteString(p.Access.String())
+	if p.Index != "" {
+		sb.WriteString("(" + p.Index + ")")
+	}
+	if p.Table != "" {
+		sb.WriteString(" " + p.Table)
+	}
+	if p.Columns == nil {
+		sb.WriteString(" columns=*")
+	} else {
+		sb.WriteString(" columns=" + strings.Join(p.Columns, ","))
+	}
+	if len(p.Filters) > 0 {
+		sb.WriteString(" filters=[" + strings.Join(p.Filters, ", ") + "]")
+	}
+	if len(p.OrderBy) > 0 {
+		sb.WriteString(" order=" + strings.Join(p.OrderBy, ","))
+	}
+	if p.Limit > 0 {
+		sb.WriteString(fmt.Sprintf(" limit=%d", p.Limit))
+	}
+	return sb.String()
+}
+
+// Explain returns the plan the query would be executed with.
+func Explain(q *Query) Plan {
+	if q == nil {
+		return Plan{Access: ScanAccess}
+	}
+
+	p := Plan{Table: q.tableName, Access: ScanAccess, Limit: q.limit}
+	if len(q.columns) > 0 {
+		p.Columns = dedupe(append(append(append([]string{}, q.columns...), q.filterColumns()...), q.orderColumns()...))
+	}
+	for _, f := range q.filters {
+		p.Filters = append(p.Filters, f.String())
+	}
+	for _, o := range q.ordering {
+		direction := "asc"
+		if o.descending {
+			direction = "desc"
+		}
+		p.OrderBy = append(p.OrderBy, o.fieldName+" "+direction)
+	}
+
+	return p
+}
+
+// ExplainFor returns the plan Run would execute the query with for rows of
+// type T, which looks rows up through an index when the query filters an
+// indexed column of T for equality.
+func ExplainFor[T storage.Value](q *Query) Plan {
+	p := Explain(q)
+	if q == nil {
+		return p
+	}
+	if f, ok := q.indexFilter(reflect.TypeOf(*new(T))); ok {
+		p.Access = IndexAccess
+		p.Index = strings.ToLower(f.fieldName)
+	}
+	return p
+}
+
+func (f Filter) String() string {
+	values := make([]string, len(f.values))
+	for i, v := range f.values {
+		values[i] = fmt.Sprintf("%#v", v)
+	}
+	if len(values) == 0 {
+		return fmt.Sprintf("%s %s", strings.ToLower(f.fieldName), f.op)
+	}
+	return fmt.Sprintf("%s %s %s", strings.ToLower(f.fieldName), f.op, strings.Join(values, "|"))
+}
+
+// Stats records the work done while executing a query.
+type Stats struct {
+	KeysScanned int
+	BytesRead   int
+	RowsMatched int
+	Duration    time.Duration
+}
+
+// RunWithStats is Run which also reports the work done executing the query.
+func RunWithStats[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) ([]T, Stats, error) {
+	start := time.Now()
+	scanned := storage.ScanStats{}
+	dest, matched, err := run[T](s, owner, q, &scanned)
+	return dest, newStats(scanned, matched, start), err
+}
+
+// RunTableWithStats is RunTable which also reports the work done executing the query.
+func RunTableWithStats(s storage.Store, q *Query, decode Decoder) ([]storage.Row, Stats, error) {
+	start := time.Now()
+	scanned := storage.ScanStats{}
+	rows, matched, err := runTable(s, q, decode, &scanned)
+	return rows, newStats(scanned, matched, start), err
+}
+
+func newStats(scanned storage.ScanStats, matched int, start time.Time) Stats {
+	return Stats{
+		KeysScanned: scanned.KeysScanned,
+		BytesRead:   scanned.BytesRead,
+		RowsMatched: matched,
+		Duration:    time.Since(start),
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query_test
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/query"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+func TestExplainParsedQuery(t *testing.T) {
+	is := is.New(t)
+
+	q, err := query.Parse("SELECT name FROM passengers WHERE surname = 'Hax' AND age > 20 ORDER BY age DESC LIMIT 5")
+	is.NoErr(err)
+
+	plan := query.Explain(q)
+	is.Equal(plan.Table, "passengers")
+	is.Equal(plan.Access, query.ScanAccess)
+	is.Equal(plan.Columns, []string{"name", "surname", "age"})
+	is.Equal(plan.Filters, []string{`surname equal "Hax"`, "age greaterthan 20"})
+	is.Equal(plan.OrderBy, []string{"age desc"})
+	is.Equal(plan.Limit, 5)
+	is.Equal(plan.String(), `scan passengers columns=name,surname,age filters=[surname equal "Hax", age greaterthan 20] order=age desc limit=5`)
+
+	plan = query.Explain(query.New().Filter("color").Eq("RED"))
+	is.Equal(plan.Columns, nil)
+	is.Equal(plan.String(), `scan columns=* filters=[color equal "RED"]`)
+}
+
+func TestRunWithStatsCountsScannedKeysAndMatches(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 112})
+
+	bs, stats, err := query.RunWithStats[Balloon](store, kvs.RootOwner{}, query.New().Filter("color").Eq("RED").Limit(1))
+	is.NoErr(err)
+	is.Equal(len(bs), 1)
+	is.Equal(stats.KeysScanned, 6)
+	is.Equal(stats.RowsMatched, 2)
+	is.True(stats.BytesRead > 0)
+	is.True(stats.Duration > 0)
+
+	_, stats, err = query.RunWithStats[Balloon](store, kvs.RootOwner{}, query.New().Select("size"))
+	is.NoErr(err)
+	is.Equal(stats.KeysScanned, 3)
+	is.Equal(stats.RowsMatched, 3)
+}
+
+type Ticket struct {
+	ID     uint32 `mdb:"ignore"`
+	Title  string
+	Status string `mdb:"index"`
+}
+
+func (t Ticket) TableName() string { return "tickets" }
+
+func TestRunLooksUpIndexedColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for _, status := range []string{"open", "closed", "open", "closed", "closed"} {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "T", Status: status}))
+	}
+
+	q, err := query.Parse("SELECT title FROM tickets WHERE title = 'T' AND status = 'open'")
+	is.NoErr(err)
+
+	plan := query.ExplainFor[Ticket](q)
+	is.Equal(plan.Access, query.IndexAccess)
+	is.Equal(plan.Index, "status")
+	is.Equal(plan.String(), `index(status) tickets columns=title,status filters=[title equal "T", status equal "open"]`)
+	is.Equal(query.ExplainFor[Balloon](query.New().Filter("color").Eq("RED")).Access, query.ScanAccess)
+
+	ts, stats, err := query.RunWithStats[Ticket](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+	is.Equal(len(ts), 2)
+	is.Equal(ts[0], Ticket{ID: 0, Title: "T"})
+	is.Equal(ts[1], Ticket{ID: 2, Title: "T"})
+	is.Equal(stats.KeysScanned, 2+2*2) // two index keys, then two columns of each row
+}
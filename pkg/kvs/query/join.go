@@ -0,0 +1,108 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+// Pair holds a row from each side of a join whose columns matched.
+type Pair[L, R any] struct {
+	Left  L
+	Right R
+}
+
+// Join pairs every L owned by owner with each R whose rightColumn holds the
+// same value as the L's leftColumn, such as cakes and the candles which
+// reference them:
+//
+//	query.Join[Cake, Candle](store, owner, "uuid", "cake")
+//
+// Rows of R are read from every owner, as children are usually owned by the
+// row they reference. Each table is scanned once and the rows of R are
+// matched through a hash table keyed by rightColumn, rather than scanning R
+// once per L. Pairs are returned in the order of L, then of R.
+func Join[L, R storage.Value](s storage.Store, owner kvs.UUID, leftColumn, rightColumn string) ([]Pair[L, R], error) {
+	if err := checkColumn[L](leftColumn); err != nil {
+		return nil, err
+	}
+	if err := checkColumn[R](rightColumn); err != nil {
+		return nil, err
+	}
+
+	lefts, err := storage.LoadAll[L](s, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	rights, err := storage.LoadAll[R](s, kvs.AnyOwner{})
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := map[string][]R{}
+	for _, r := range rights {
+		k := joinKey(fieldByColumn(reflect.ValueOf(r), rightColumn))
+		byKey[k] = append(byKey[k], r)
+	}
+
+	pairs := []Pair[L, R]{}
+	for _, l := range lefts {
+		k := joinKey(fieldByColumn(reflect.ValueOf(l), leftColumn))
+		for _, r := range byKey[k] {
+			pairs = append(pairs, Pair[L, R]{Left: l, Right: r})
+		}
+	}
+
+	return pairs, nil
+}
+
+// joinKey renders a column value so that references held as different
+// types, such as a uuid.UUID and its string form, still match.
+func joinKey(v any) string {
+	return fmt.Sprint(v)
+}
+
+func checkColumn[T storage.Value](column string) error {
+	t := reflect.TypeOf(*new(T))
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if _, ok := kvs.FieldByColumn(reflect.New(t).Elem(), column); !ok {
+		return fmt.Errorf("%s does not have a column named %q", (*new(T)).TableName(), column)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query_test
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/query"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+type Cake struct {
+	ID   uint32 `mdb:"ignore"`
+	UUID uuid.UUID
+	Type string
+}
+
+func (c Cake) TableName() string { return "cakes" }
+
+type Candle struct {
+	ID     uint32 `mdb:"ignore"`
+	Cake   uuid.UUID
+	Colour string
+}
+
+func (c Candle) TableName() string { return "candles" }
+
+func TestJoinPairsRowsOnReferenceColumn(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	child := uuid.New()
+	carrot := Cake{UUID: uuid.New(), Type: "CARROT"}
+	velvet := Cake{UUID: uuid.New(), Type: "RED_VELVET"}
+	plain := Cake{UUID: uuid.New(), Type: "PLAIN"}
+	is.NoErr(store.Save(child, &carrot))
+	is.NoErr(store.Save(child, &velvet))
+	is.NoErr(store.Save(child, &plain))
+
+	is.NoErr(store.Save(carrot.UUID, &Candle{Cake: carrot.UUID, Colour: "ORANGE"}))
+	is.NoErr(store.Save(velvet.UUID, &Candle{Cake: velvet.UUID, Colour: "RED"}))
+	is.NoErr(store.Save(velvet.UUID, &Candle{Cake: velvet.UUID, Colour: "WHITE"}))
+	// a candle for a cake owned by someone else is never paired
+	is.NoErr(store.Save(kvs.RootOwner{}, &Candle{Cake: uuid.New(), Colour: "BLUE"}))
+
+	pairs, err := query.Join[Cake, Candle](store, child, "uuid", "cake")
+	is.NoErr(err)
+	is.Equal(len(pairs), 3)
+
+	is.Equal(pairs[0].Left.Type, "CARROT")
+	is.Equal(pairs[0].Right.Colour, "ORANGE")
+	is.Equal(pairs[1].Left.Type, "RED_VELVET")
+	is.Equal(pairs[2].Left.Type, "RED_VELVET")
+	colours := map[string]bool{pairs[1].Right.Colour: true, pairs[2].Right.Colour: true}
+	is.Equal(colours, map[string]bool{"RED": true, "WHITE": true})
+	for _, p := range pairs {
+		is.Equal(p.Left.UUID, p.Right.Cake)
+	}
+}
+
+func TestJoinWithUnknownColumnReturnsError(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	_, err = query.Join[Cake, Candle](store, kvs.RootOwner{}, "uuid", "cakeid")
+	is.Equal(err.Error(), `candles does not have a column named "cakeid"`)
+}
@@ -0,0 +1,457 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// SyntaxError describes where and why a query could not be parsed.
+type SyntaxError struct {
+	Pos    int // byte offset into the source
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// Parse reads a query written in bluepanda's query language, for example:
+//
+//	SELECT name, age FROM passengers OWNER root WHERE surname = 'Hax' AND age > 20 ORDER BY age DESC LIMIT 10
+//
+// OWNER accepts root, a UUID or * to read rows of any owner, and defaults
+// to root when omitted.
+// WHERE conditions are joined by AND and compare a column using one of
+// =, !=, <>, <, <=, >, >= or IN (...) against a quoted string, a number,
+// TRUE or FALSE, or test it with IS NULL or IS NOT NULL.
+func Parse(src string) (*Query, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{src: src, toks: toks}
+	return p.parse()
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokSymbol
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return fmt.Sprintf("'%s'", t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+var keywords = map[string]struct{}{
+	"SELECT": {}, "FROM": {}, "OWNER": {}, "WHERE": {}, "AND": {}, "IN": {},
+	"ORDER": {}, "BY": {}, "ASC": {}, "DESC": {}, "LIMIT": {}, "TRUE": {}, "FALSE": {},
+	"IS": {}, "NOT": {}, "NULL": {},
+}
+
+func lex(src string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '\'':
+			start := i
+			sb := strings.Builder{}
+			i++
+			for {
+				if i >= len(src) {
+					return nil, syntaxErrorAt(src, start, "unterminated string")
+				}
+				if src[i] == '\'' {
+					// a doubled quote is an escaped quote
+					if i+1 < len(src) && src[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			toks = append(toks, token{kind: tokString, value: sb.String(), pos: start})
+		case isWordByte(c) || (c == '-' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			i++
+			for i < len(src) && (isWordByte(src[i]) || src[i] == '-') {
+				i++
+			}
+			toks = append(toks, token{kind: tokWord, value: src[start:i], pos: start})
+		case strings.ContainsRune(",()*;", rune(c)):
+			toks = append(toks, token{kind: tokSymbol, value: string(c), pos: i})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			start := i
+			i++
+			if i < len(src) && (src[i] == '=' || (c == '<' && src[i] == '>')) {
+				i++
+			}
+			op := src[start:i]
+			if op == "!" {
+				return nil, syntaxErrorAt(src, start, "expected != but found !")
+			}
+			toks = append(toks, token{kind: tokSymbol, value: op, pos: start})
+		default:
+			return nil, syntaxErrorAt(src, i, fmt.Sprintf("unexpected character %q", c))
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type parser struct {
+	src  string
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return syntaxErrorAt(p.src, t.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokWord && strings.EqualFold(t.value, kw)
+}
+
+func (p *parser) isSymbol(sym string) bool {
+	t := p.peek()
+	return t.kind == tokSymbol && t.value == sym
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.isKeyword(kw) {
+		return p.errorf(p.peek(), "expected %s but found %s", kw, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.isSymbol(sym) {
+		return p.errorf(p.peek(), "expected %q but found %s", sym, p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokWord || !isIdent(t.value) {
+		return "", p.errorf(t, "expected column or table name but found %s", t)
+	}
+	if _, ok := keywords[strings.ToUpper(t.value)]; ok {
+		return "", p.errorf(t, "expected column or table name but found keyword %s", strings.ToUpper(t.value))
+	}
+	return t.value, nil
+}
+
+func isIdent(s string) bool {
+	if s == "" || isDigit(s[0]) || s[0] == '.' || strings.Contains(s, "-") {
+		return false
+	}
+	return !strings.HasSuffix(s, ".") && !strings.Contains(s, "..")
+}
+
+func (p *parser) parse() (*Query, error) {
+	q := New()
+
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.isSymbol("*") {
+		p.next()
+	} else {
+		for {
+			column, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			q = q.Select(column)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	q = q.From(table).OwnedBy(kvs.RootOwner{})
+
+	if p.isKeyword("OWNER") {
+		p.next()
+		owner, err := p.owner()
+		if err != nil {
+			return nil, err
+		}
+		q = q.OwnedBy(owner)
+	}
+
+	if p.isKeyword("WHERE") {
+		p.next()
+		for {
+			if q, err = p.condition(q); err != nil {
+				return nil, err
+			}
+			if !p.isKeyword("AND") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("ORDER") {
+		p.next()
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			column, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case p.isKeyword("DESC"):
+				p.next()
+				q = q.OrderByDesc(column)
+			case p.isKeyword("ASC"):
+				p.next()
+				fallthrough
+			default:
+				q = q.OrderBy(column)
+			}
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("LIMIT") {
+		p.next()
+		t := p.next()
+		n, err := strconv.Atoi(t.value)
+		if t.kind != tokWord || err != nil || n < 1 {
+			return nil, p.errorf(t, "expected a positive whole number but found %s", t)
+		}
+		q = q.Limit(n)
+	}
+
+	if p.isSymbol(";") {
+		p.next()
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	return q, nil
+}
+
+func (p *parser) owner() (kvs.UUID, error) {
+	if p.isSymbol("*") {
+		p.next()
+		return AnyOwner(), nil
+	}
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		return nil, p.errorf(t, "expected owner but found %s", t)
+	}
+	if strings.EqualFold(t.value, kvs.RootOwner{}.String()) {
+		return kvs.RootOwner{}, nil
+	}
+	id, err := uuid.Parse(t.value)
+	if err != nil {
+		return nil, p.errorf(t, "owner must be root, * or a UUID but found %s", t)
+	}
+	return id, nil
+}
+
+func (p *parser) condition(q *Query) (*Query, error) {
+	column, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("IS") {
+		p.next()
+		not := p.isKeyword("NOT")
+		if not {
+			p.next()
+		}
+		if t := p.next(); t.kind != tokWord || !strings.EqualFold(t.value, "NULL") {
+			return nil, p.errorf(t, "expected NULL but found %s", t)
+		}
+		if not {
+			return q.Filter(column).IsNotNull(), nil
+		}
+		return q.Filter(column).IsNull(), nil
+	}
+
+	if p.isKeyword("IN") {
+		p.next()
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		values := []any{}
+		for {
+			v, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return q.Filter(column).Eq(values...), nil
+	}
+
+	t := p.next()
+	if t.kind != tokSymbol {
+		return nil, p.errorf(t, "expected comparison operator but found %s", t)
+	}
+	var apply func(*Filter, ...any) *Query
+	switch t.value {
+	case "=":
+		apply = (*Filter).Eq
+	case "!=", "<>":
+		apply = (*Filter).Ne
+	case "<":
+		apply = (*Filter).Lt
+	case "<=":
+		apply = (*Filter).Lte
+	case ">":
+		apply = (*Filter).Gt
+	case ">=":
+		apply = (*Filter).Gte
+	default:
+		return nil, p.errorf(t, "expected comparison operator but found %s", t)
+	}
+
+	v, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return apply(q.Filter(column), v), nil
+}
+
+func (p *parser) literal() (any, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return t.value, nil
+	case tokWord:
+		switch strings.ToUpper(t.value) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+		if i, err := strconv.ParseInt(t.value, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(t.value, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, p.errorf(t, "expected a string, number or boolean but found %s", t)
+}
+
+func syntaxErrorAt(src string, pos int, msg string) *SyntaxError {
+	line, col := 1, 1
+	for _, r := range src[:pos] {
+		if r == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+	return &SyntaxError{Pos: pos, Line: line, Column: col, Msg: msg}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+func TestParseFullQuery(t *testing.T) {
+	is := is.New(t)
+
+	owner := uuid.New()
+	q, err := Parse("SELECT name, age FROM passengers OWNER " + owner.String() + " WHERE surname = 'Hax' AND age > 20 ORDER BY age DESC, name LIMIT 10")
+	is.NoErr(err)
+
+	is.Equal(q.Table(), "passengers")
+	is.Equal(q.Owner(), owner)
+	is.Equal(q.columns, []string{"name", "age"})
+	is.Equal(len(q.filters), 2)
+	is.Equal(q.filters[0].fieldName, "surname")
+	is.Equal(q.filters[0].op, equal)
+	is.Equal(q.filters[0].values, []any{"Hax"})
+	is.Equal(q.filters[1].fieldName, "age")
+	is.Equal(q.filters[1].op, greaterthan)
+	is.Equal(q.filters[1].values, []any{int64(20)})
+	is.Equal(q.ordering, []ordering{{fieldName: "age", descending: true}, {fieldName: "name"}})
+	is.Equal(q.limit, 10)
+}
+
+func TestParseSelectAllDefaultsToRootOwner(t *testing.T) {
+	is := is.New(t)
+
+	q, err := Parse("select * from balloons where color in ('RED', 'it''s white') and size <= 1.5 and flying != false;")
+	is.NoErr(err)
+
+	is.Equal(q.Table(), "balloons")
+	is.Equal(q.Owner(), kvs.RootOwner{})
+	is.Equal(len(q.columns), 0)
+	is.Equal(q.filters[0].values, []any{"RED", "it's white"})
+	is.Equal(q.filters[1].op, lessthanorequal)
+	is.Equal(q.filters[1].values, []any{1.5})
+	is.Equal(q.filters[2].op, notequal)
+	is.Equal(q.filters[2].values, []any{false})
+}
+
+func TestParseAnyOwner(t *testing.T) {
+	is := is.New(t)
+
+	q, err := Parse("SELECT name FROM passengers OWNER * WHERE age > 20")
+	is.NoErr(err)
+
+	is.Equal(q.Owner(), AnyOwner())
+	is.Equal(q.columns, []string{"name"})
+}
+
+func TestParseSyntaxErrorsReportPosition(t *testing.T) {
+	is := is.New(t)
+
+	tests := []struct {
+		src  string
+		pos  int
+		line int
+		col  int
+		msg  string
+	}{
+		{"SELECT name FORM passengers", 12, 1, 13, `expected FROM but found "FORM"`},
+		{"SELECT name FROM passengers\nWHERE age >", 39, 2, 12, "expected a string, number or boolean but found end of query"},
+		{"SELECT name FROM passengers OWNER bob", 34, 1, 35, `owner must be root, * or a UUID but found "bob"`},
+		{"SELECT name FROM passengers WHERE name = 'Hax", 41, 1, 42, "unterminated string"},
+		{"SELECT FROM passengers", 7, 1, 8, "expected column or table name but found keyword FROM"},
+		{"SELECT name FROM passengers LIMIT 10 20", 37, 1, 38, `unexpected "20"`},
+		{"SELECT name FROM passengers LIMIT 0", 34, 1, 35, `expected a positive whole number but found "0"`},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.src)
+		var syntaxErr *SyntaxError
+		is.True(errors.As(err, &syntaxErr)) // parse error should be a syntax error
+		is.Equal(syntaxErr.Pos, tt.pos)
+		is.Equal(syntaxErr.Line, tt.line)
+		is.Equal(syntaxErr.Column, tt.col)
+		is.Equal(syntaxErr.Msg, tt.msg)
+	}
+}
@@ -32,12 +32,28 @@
 package query
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
+
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
 	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 )
 
 type Query struct {
-	filters []Filter
+	tableName string
+	owner     kvs.UUID
+	filters   []Filter
+	columns   []string
+	ordering  []ordering
+	limit     int
+	groupBy   string
+}
+
+type ordering struct {
+	fieldName  string
+	descending bool
 }
 
 type operator int64
@@ -46,12 +62,32 @@ const (
 	undefined operator = iota
 	equal
 	lessthan
+	notequal
+	lessthanorequal
+	greaterthan
+	greaterthanorequal
+	isnull
+	isnotnull
 )
 
 func (op operator) String() string {
 	switch op {
 	case equal:
 		return "equal"
+	case lessthan:
+		return "lessthan"
+	case notequal:
+		return "notequal"
+	case lessthanorequal:
+		return "lessthanorequal"
+	case greaterthan:
+		return "greaterthan"
+	case greaterthanorequal:
+		return "greaterthanorequal"
+	case isnull:
+		return "isnull"
+	case isnotnull:
+		return "isnotnull"
 	default:
 		return "undefined"
 	}
@@ -64,41 +100,334 @@ type Filter struct {
 	values    []any
 }
 
-func (f Filter) cmp(d []byte) bool {
+func (f Filter) cmp(e kvs.Entry) bool {
 	for _, v := range f.values {
-		if kvs.CompareBytesToAny(d, v) {
+		if kvs.CompareEntryToAny(e, v) {
 			return true
 		}
 	}
 	return false
 }
 
+// accepts reports whether the filter's condition holds for the given entry.
+// Null entries are only accepted by IsNull, as nothing compares with them.
+func (f Filter) accepts(e kvs.Entry) (bool, error) {
+	null := e.Meta == codec.Null
+	switch {
+	case f.op == isnull:
+		return null, nil
+	case f.op == isnotnull:
+		return !null, nil
+	case null:
+		return false, nil
+	}
+
+	switch f.op {
+	case equal:
+		return f.cmp(e), nil
+	case notequal:
+		return !f.cmp(e), nil
+	case lessthan, lessthanorequal, greaterthan, greaterthanorequal:
+		if len(f.values) == 0 {
+			return false, nil
+		}
+		c, ok, err := compareEntry(e, f.values[0])
+		if !ok {
+			return false, err
+		}
+		switch f.op {
+		case lessthan:
+			return c < 0, nil
+		case lessthanorequal:
+			return c <= 0, nil
+		case greaterthan:
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	return true, nil
+}
+
+// matches reports whether every filter of the query accepts the given row.
+func (q *Query) matches(row storage.Row) (bool, error) {
+	for _, filter := range q.filters {
+		if filter.op == undefined {
+			continue
+		}
+		e, ok := row.Entry(filter.fieldName)
+		if !ok {
+			// an absent column is null
+			if filter.op == isnull {
+				continue
+			}
+			return false, nil
+		}
+		if ok, err := filter.accepts(e); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// indexFilter finds an equality filter on a column of t declared with the
+// index tag option, through which the rows it accepts can be looked up.
+func (q *Query) indexFilter(t reflect.Type) (Filter, bool) {
+	columns, err := kvs.Columns(t)
+	if err != nil {
+		return Filter{}, false
+	}
+	for _, filter := range q.filters {
+		if filter.op != equal || len(filter.values) == 0 {
+			continue
+		}
+		for _, c := range columns {
+			if c.Indexed && c.Name == strings.ToLower(filter.fieldName) {
+				return filter, true
+			}
+		}
+	}
+	return Filter{}, false
+}
+
+func (q *Query) filterColumns() []string {
+	columns := make([]string, 0, len(q.filters))
+	for _, filter := range q.filters {
+		columns = append(columns, strings.ToLower(filter.fieldName))
+	}
+	return columns
+}
+
 func New() *Query {
 	return &Query{}
 }
 
 func Run[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) ([]T, error) {
-	return storage.LoadAllWithEvaluator[T](s, owner, func(e kvs.Entry) bool {
-		if q == nil || len(q.filters) == 0 {
+	dest, _, err := run[T](s, owner, q, nil)
+	return dest, err
+}
+
+func run[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, stats *storage.ScanStats) ([]T, int, error) {
+	opts := []storage.LoadOption{storage.WithScanStats(stats)}
+	if q != nil {
+		if v := *new(T); q.tableName != "" && q.tableName != v.TableName() {
+			return nil, 0, fmt.Errorf("query reads from %s, not %s", q.tableName, v.TableName())
+		}
+		// ordering needs the values of the columns it sorts by
+		if len(q.columns) > 0 {
+			opts = append(opts, storage.WithColumns(q.orderColumns()...))
+		}
+		opts = append(opts, storage.WithColumns(q.columns...), storage.WithFilterColumns(q.filterColumns()...))
+		if f, ok := q.indexFilter(reflect.TypeOf(*new(T))); ok {
+			opts = append(opts, storage.WithIndex(f.fieldName, f.values...))
+		}
+	}
+
+	var matchErr error
+	dest, err := storage.LoadAllWithEvaluator[T](s, owner, func(r storage.Row) bool {
+		if q == nil {
+			return true
+		}
+		ok, err := q.matches(r)
+		if err != nil && matchErr == nil {
+			matchErr = err
+		}
+		return ok
+	}, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if matchErr != nil {
+		return nil, 0, matchErr
+	}
+	matched := len(dest)
+
+	if q != nil {
+		sortValues(dest, q.ordering)
+		if q.limit > 0 && len(dest) > q.limit {
+			dest = dest[:q.limit]
+		}
+		if len(q.columns) > 0 {
+			unsetUnselected(dest, q.orderColumns(), q.columns)
+		}
+	}
+
+	return dest, matched, nil
+}
+
+// unsetUnselected zeroes the fields of each value that were only loaded
+// to sort by, so a projected result holds just the columns selected.
+func unsetUnselected[T storage.Value](values []T, loaded, selected []string) {
+	columns, err := kvs.Columns(reflect.TypeOf(*new(T)))
+	if err != nil {
+		return
+	}
+	unset := []string{}
+	for _, c := range columns {
+		if covers(loaded, c.Name) && !covers(selected, c.Name) {
+			unset = append(unset, c.Name)
+		}
+	}
+	for i := range values {
+		v := reflect.ValueOf(&values[i]).Elem()
+		for _, column := range unset {
+			if f, ok := kvs.FieldByColumn(v, column); ok && f.CanSet() {
+				f.Set(reflect.Zero(f.Type()))
+			}
+		}
+	}
+}
+
+// covers reports whether any of the paths reads the column, either as the
+// column itself, as an object holding it or as a path inside it.
+func covers(paths []string, column string) bool {
+	for _, p := range paths {
+		p = strings.ToLower(p)
+		if p == column || strings.HasPrefix(column, p+".") || strings.HasPrefix(p, column+".") {
 			return true
 		}
+	}
+	return false
+}
+
+// RunTable runs the query against the table and owner it names, without
+// a Go type describing the table's rows. Each returned row holds only the
+// selected columns, or every column stored for the table if none were.
+func RunTable(s storage.Store, q *Query, decode Decoder) ([]storage.Row, error) {
+	rows, _, err := runTable(s, q, decode, nil)
+	return rows, err
+}
+
+func runTable(s storage.Store, q *Query, decode Decoder, stats *storage.ScanStats) ([]storage.Row, int, error) {
+	if q == nil || q.tableName == "" {
+		return nil, 0, fmt.Errorf("query does not specify a table")
+	}
+
+	selected := q.columns
+	if len(selected) == 0 {
+		columns, err := storage.TableColumns(s, q.tableName, q.owner)
+		if err != nil {
+			return nil, 0, err
+		}
+		selected = columns
+	}
+
+	// objects are stored as sub-columns, and paths inside lists and maps
+	// are read from the column holding them
+	columns, err := storage.ExpandColumns(s, q.tableName, q.owner, dedupe(append(append(append([]string{}, selected...), q.filterColumns()...), q.orderColumns()...)))
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := storage.LoadRowsWithStats(s, q.tableName, q.owner, stats, columns...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	matched := []storage.Row{}
+	for _, row := range rows {
+		ok, err := q.matches(row)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+	count := len(matched)
+
+	if err := sortRows(matched, q.ordering, decode); err != nil {
+		return nil, 0, err
+	}
+	if q.limit > 0 && len(matched) > q.limit {
+		matched = matched[:q.limit]
+	}
 
-		captured := true
-		for i, filter := range q.filters {
-			if i > 0 && !captured {
-				return false
+	for i, row := range matched {
+		projected := make(map[string]kvs.Entry, len(selected))
+		for _, c := range selected {
+			if e, ok := row.Entry(c); ok {
+				projected[e.ColumnName] = e
 			}
-			if filter.fieldName == e.ColumnName {
-				if filter.op == equal {
-					if !filter.cmp(e.Data) {
-						captured = false
-					}
+			for column, e := range row.Entries {
+				if strings.HasPrefix(column, strings.ToLower(c)+".") {
+					projected[column] = e
 				}
 			}
 		}
+		matched[i].Entries = projected
+	}
+
+	return matched, count, nil
+}
+
+// From sets the table an untyped query reads from.
+func (q *Query) From(tableName string) *Query {
+	q = q.clone()
+	q.tableName = tableName
+	return q
+}
+
+// OwnedBy sets the owner whose rows an untyped query reads.
+func (q *Query) OwnedBy(owner kvs.UUID) *Query {
+	q = q.clone()
+	q.owner = owner
+	return q
+}
+
+// AnyOwner returns an owner which matches rows regardless of who owns
+// them, for use with Run, OwnedBy and storage loads.
+func AnyOwner() kvs.UUID { return kvs.AnyOwner{} }
+
+// Table returns the name of the table the query reads from, if set.
+func (q *Query) Table() string { return q.tableName }
+
+// Owner returns the owner whose rows the query reads, if set.
+func (q *Query) Owner() kvs.UUID { return q.owner }
+
+// Columns returns the names of the selected columns, or nil if the query
+// selects every column.
+func (q *Query) Columns() []string { return append([]string(nil), q.columns...) }
+
+// OrderBy sorts results by the given field in ascending order. Subsequent
+// calls add further fields which break ties left by earlier ones.
+func (q *Query) OrderBy(fieldName string) *Query {
+	return q.orderBy(fieldName, false)
+}
+
+// OrderByDesc sorts results by the given field in descending order.
+func (q *Query) OrderByDesc(fieldName string) *Query {
+	return q.orderBy(fieldName, true)
+}
+
+func (q *Query) orderBy(fieldName string, descending bool) *Query {
+	q = q.clone()
+	q.ordering = append(q.ordering, ordering{fieldName: strings.ToLower(fieldName), descending: descending})
+	return q
+}
 
-		return captured
-	})
+// Limit caps the number of results returned. Zero means no limit.
+func (q *Query) Limit(n int) *Query {
+	q = q.clone()
+	q.limit = n
+	return q
+}
+
+func (q *Query) orderColumns() []string {
+	columns := make([]string, 0, len(q.ordering))
+	for _, o := range q.ordering {
+		columns = append(columns, o.fieldName)
+	}
+	return columns
+}
+
+// Select limits the columns loaded for each result to those named,
+// along with any needed to evaluate the query's filters.
+func (q *Query) Select(fieldNames ...string) *Query {
+	q = q.clone()
+	for _, name := range fieldNames {
+		q.columns = append(q.columns, strings.ToLower(name))
+	}
+	return q
 }
 
 func (q *Query) Filter(fieldName string) *Filter {
@@ -114,12 +443,51 @@ func (f *Filter) Eq(value ...any) *Query {
 	return f.q
 }
 
+func (f *Filter) Ne(value ...any) *Query {
+	f.values = value
+	f.op = notequal
+	return f.q
+}
+
 func (f *Filter) Lt(value ...any) *Query {
 	f.values = value
 	f.op = lessthan
 	return f.q
 }
 
+func (f *Filter) Lte(value ...any) *Query {
+	f.values = value
+	f.op = lessthanorequal
+	return f.q
+}
+
+func (f *Filter) Gt(value ...any) *Query {
+	f.values = value
+	f.op = greaterthan
+	return f.q
+}
+
+func (f *Filter) Gte(value ...any) *Query {
+	f.values = value
+	f.op = greaterthanorequal
+	return f.q
+}
+
+// IsNull matches rows which hold null for the column, or have no value
+// stored for it at all.
+func (f *Filter) IsNull() *Query {
+	f.values = nil
+	f.op = isnull
+	return f.q
+}
+
+// IsNotNull matches rows which hold a value other than null for the column.
+func (f *Filter) IsNotNull() *Query {
+	f.values = nil
+	f.op = isnotnull
+	return f.q
+}
+
 func (q *Query) clone() *Query {
 	x := *q
 	// Copy the contents of the slice-typed fields to a new backing store.
@@ -127,5 +495,13 @@ func (q *Query) clone() *Query {
 		x.filters = make([]Filter, len(q.filters))
 		copy(x.filters, q.filters)
 	}
+	if len(q.columns) > 0 {
+		x.columns = make([]string, len(q.columns))
+		copy(x.columns, q.columns)
+	}
+	if len(q.ordering) > 0 {
+		x.ordering = make([]ordering, len(q.ordering))
+		copy(x.ordering, q.ordering)
+	}
 	return &x
 }
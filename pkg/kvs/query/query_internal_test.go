@@ -66,3 +66,15 @@ func TestQueryFilterSubsequentOperatorAndValueOverwritesPrevious(t *testing.T) {
 	is.Equal(q.filters[0].op, equal)
 	is.Equal(q.filters[0].values, []any{"blue"})
 }
+
+func TestParseAggregateOp(t *testing.T) {
+	is := is.New(t)
+
+	op, err := ParseAggregateOp("AVG")
+	is.NoErr(err)
+	is.Equal(op, OpAvg)
+	is.Equal(op.String(), "avg")
+
+	_, err = ParseAggregateOp("median")
+	is.Equal(err.Error(), `unknown aggregate operation "median"`)
+}
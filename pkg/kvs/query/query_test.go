@@ -33,9 +33,12 @@ package query_test
 
 import (
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger/v3"
 	"github.com/matryer/is"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
 	"github.com/tauraamui/bluepanda/pkg/kvs/query"
 	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 )
@@ -228,3 +231,370 @@ func TestQueryFilterWithMultiplePredicateMultipleValuesFailure(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(len(bs), 0)
 }
+
+func TestQuerySelectLoadsOnlyProjectedColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366})
+
+	bs, err := query.Run[Balloon](store, kvs.RootOwner{}, query.New().Select("size").Filter("color").Eq("WHITE"))
+	is.NoErr(err)
+	is.Equal(len(bs), 1)
+	is.Equal(bs[0], Balloon{ID: 1, Size: 366})
+
+	// columns only sorted by are read but left unset
+	bs, err = query.Run[Balloon](store, kvs.RootOwner{}, query.New().Select("size").OrderByDesc("color"))
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 1, Size: 366}, {ID: 0, Size: 695}})
+
+	_, err = query.Run[Balloon](store, kvs.RootOwner{}, query.New().Select("weight"))
+	is.Equal(err.Error(), `balloons does not have a column named "weight"`)
+}
+
+func TestQueryOrderByAndLimit(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 112})
+
+	bs, err := query.Run[Balloon](store, kvs.RootOwner{}, query.New().Filter("size").Gt(200).OrderBy("size"))
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 1, Color: "WHITE", Size: 366}, {ID: 0, Color: "RED", Size: 695}})
+
+	bs, err = query.Run[Balloon](store, kvs.RootOwner{}, query.New().OrderByDesc("color").Limit(2))
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 1, Color: "WHITE", Size: 366}, {ID: 0, Color: "RED", Size: 695}})
+}
+
+func TestRunTableWithParsedQuery(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 112})
+
+	q, err := query.Parse("SELECT color FROM balloons WHERE size < 500 ORDER BY size DESC")
+	is.NoErr(err)
+
+	rows, err := query.RunTable(store, q, func(e kvs.Entry) (any, error) { return string(e.Data), nil })
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+
+	is.Equal(rows[0].ID, uint32(1))
+	is.Equal(len(rows[0].Entries), 1)
+	is.Equal(rows[0].Entries["color"].Data, []byte("WHITE"))
+	is.Equal(rows[1].Entries["color"].Data, []byte("BLUE"))
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, q)
+	is.Equal(err.Error(), "query reads from balloons, not passengers")
+}
+
+func TestQueryFilterOverSparseAndDeletedRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	balloons := make([]Balloon, 15)
+	for i := range balloons {
+		color := "RED"
+		if i%3 == 0 {
+			color = "WHITE"
+		}
+		balloons[i] = Balloon{Color: color, Size: i * 10}
+		is.NoErr(store.Save(kvs.RootOwner{}, &balloons[i]))
+	}
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &balloons[3], balloons[3].ID))
+	// leave row 6 without a size, it must neither match nor shift other rows
+	is.NoErr(db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("balloons.size.root.6"))
+	}))
+
+	bs, err := query.Run[Balloon](store, kvs.RootOwner{}, query.New().Filter("color").Eq("WHITE").Filter("size").Gte(0))
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{
+		{ID: 0, Color: "WHITE", Size: 0},
+		{ID: 9, Color: "WHITE", Size: 90},
+		{ID: 12, Color: "WHITE", Size: 120},
+	})
+}
+
+type Address struct {
+	City     string
+	Postcode string
+}
+
+type Customer struct {
+	ID      uint32 `mdb:"ignore"`
+	Name    string
+	Address Address
+	Tags    []string
+}
+
+func (c Customer) TableName() string { return "customers" }
+
+func TestQueryFiltersAndOrdersOnNestedPaths(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Name: "Amy", Address: Address{City: "Leadworth", Postcode: "LW2"}, Tags: []string{"companion"}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Name: "Clara", Address: Address{City: "Blackpool", Postcode: "BP1"}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Name: "Rory", Address: Address{City: "Leadworth", Postcode: "LW1"}}))
+
+	cs, err := query.Run[Customer](store, kvs.RootOwner{}, query.New().Filter("address.city").Eq("Leadworth").OrderBy("address.postcode"))
+	is.NoErr(err)
+	is.Equal(len(cs), 2)
+	is.Equal(cs[0].Name, "Rory")
+	is.Equal(cs[1].Name, "Amy")
+	is.Equal(cs[1].Tags, []string{"companion"})
+
+	// selecting a nested struct loads each of its sub-columns
+	cs, err = query.Run[Customer](store, kvs.RootOwner{}, query.New().Select("address").Filter("name").Eq("Clara"))
+	is.NoErr(err)
+	is.Equal(cs, []Customer{{ID: 1, Address: Address{City: "Blackpool", Postcode: "BP1"}}})
+
+	rows, err := query.RunTable(store, query.New().From("customers").OwnedBy(kvs.RootOwner{}).Select("address.postcode").Filter("address.city").Eq("Blackpool"), nil)
+	is.NoErr(err)
+	is.Equal(len(rows), 1)
+	_, ok := rows[0].Entry("address.postcode")
+	is.True(ok)
+}
+
+type Parcel struct {
+	ID   uint32 `mdb:"ignore"`
+	Name string
+	Tags []string
+	Dims map[string]int
+}
+
+func (p Parcel) TableName() string { return "parcels" }
+
+func TestQueryFiltersOnPathsInsideListsAndMaps(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Parcel{Name: "crate", Tags: []string{"a", "b"}, Dims: map[string]int{"w": 1, "h": 2}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Parcel{Name: "box", Tags: []string{"c"}, Dims: map[string]int{"w": 3, "h": 1}}))
+
+	ps, err := query.Run[Parcel](store, kvs.RootOwner{}, query.New().Filter("dims.w").Gt(2))
+	is.NoErr(err)
+	is.Equal(len(ps), 1)
+	is.Equal(ps[0].Name, "box")
+
+	ps, err = query.Run[Parcel](store, kvs.RootOwner{}, query.New().Filter("tags.1").Eq("b"))
+	is.NoErr(err)
+	is.Equal(len(ps), 1)
+	is.Equal(ps[0].Name, "crate")
+	is.Equal(ps[0].Dims, map[string]int{"w": 1, "h": 2})
+
+	q, err := query.Parse("SELECT name, dims.h FROM parcels WHERE tags.0 IN ('a', 'c') ORDER BY dims.h")
+	is.NoErr(err)
+	rows, err := query.RunTable(store, q, func(e kvs.Entry) (any, error) { return codec.DecodeValue(e.Data, e.Meta) })
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+	is.Equal(rows[0].ID, uint32(1))
+	ent, ok := rows[0].Entry("dims.h")
+	is.True(ok)
+	h, err := codec.DecodeValue(ent.Data, ent.Meta)
+	is.NoErr(err)
+	is.Equal(h, 1)
+}
+
+// PackedBalloon stores the rows of the balloons table row by row.
+type PackedBalloon Balloon
+
+func (b PackedBalloon) TableName() string      { return "balloons" }
+func (b PackedBalloon) Layout() storage.Layout { return storage.RowMajor }
+
+func TestQueryRunsOverRowMajorTables(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedBalloon{Color: "RED", Size: 695}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedBalloon{Color: "BLUE", Size: 112}))
+
+	bs, err := query.Run[PackedBalloon](store, kvs.RootOwner{}, query.New().Filter("size").Gt(200).OrderBy("size"))
+	is.NoErr(err)
+	is.Equal(bs, []PackedBalloon{{ID: 1, Color: "WHITE", Size: 366}, {ID: 0, Color: "RED", Size: 695}})
+
+	total, err := query.Sum[Balloon](store, kvs.RootOwner{}, query.New(), "size")
+	is.NoErr(err)
+	is.Equal(total.Value, float64(1173))
+}
+
+type Launch struct {
+	ID     uint32 `mdb:"ignore"`
+	Name   string
+	At     time.Time
+	Window time.Duration
+}
+
+func (l Launch) TableName() string { return "launches" }
+
+func TestQueryFiltersAndOrdersByTime(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	bst := time.FixedZone("BST", 3600)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Launch{Name: "dawn", At: time.Date(2023, 8, 18, 6, 0, 0, 0, bst), Window: time.Hour}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Launch{Name: "noon", At: time.Date(2023, 8, 18, 12, 0, 0, 0, time.UTC), Window: 10 * time.Minute}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Launch{Name: "dusk", At: time.Date(2023, 8, 18, 20, 0, 0, 0, bst), Window: 2 * time.Hour}))
+
+	ls, err := query.Run[Launch](store, kvs.RootOwner{}, query.New().Filter("at").Gt(time.Date(2023, 8, 18, 5, 30, 0, 0, time.UTC)).OrderByDesc("at"))
+	is.NoErr(err)
+	is.Equal(len(ls), 2)
+	is.Equal(ls[0].Name, "dusk")
+	is.Equal(ls[1].Name, "noon")
+
+	q, err := query.Parse("SELECT name FROM launches WHERE at >= '2023-08-18' AND at < '2023-08-18T12:00:00Z' AND window > '30m'")
+	is.NoErr(err)
+	ls, err = query.Run[Launch](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+	is.Equal(len(ls), 1)
+	is.Equal(ls[0].Name, "dawn")
+
+	ls, err = query.Run[Launch](store, kvs.RootOwner{}, query.New().Filter("at").Eq(time.Date(2023, 8, 18, 13, 0, 0, 0, bst)))
+	is.NoErr(err)
+	is.Equal(len(ls), 1)
+	is.Equal(ls[0].Name, "noon")
+}
+
+func TestQueryComparesStringsAsTheTypeOfTheColumn(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 3})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 25})
+	store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 100})
+
+	// as text, "100" and "3" would be on the wrong sides of "20"
+	bs, err := query.Run[Balloon](store, kvs.RootOwner{}, query.New().Filter("size").Gt("20").OrderBy("size"))
+	is.NoErr(err)
+	is.Equal(len(bs), 2)
+	is.Equal(bs[0].Color, "WHITE")
+	is.Equal(bs[1].Color, "BLUE")
+
+	q, err := query.Parse("SELECT color FROM balloons WHERE size <= '25'")
+	is.NoErr(err)
+	rows, err := query.RunTable(store, q, func(e kvs.Entry) (any, error) { return codec.DecodeValue(e.Data, e.Meta) })
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+
+	_, err = query.Run[Balloon](store, kvs.RootOwner{}, query.New().Filter("size").Gt("big"))
+	is.Equal(err.Error(), `unable to compare column "size" with "big": not a number`)
+	_, err = query.Count[Balloon](store, kvs.RootOwner{}, query.New().Filter("size").Lt("small"))
+	is.Equal(err.Error(), `unable to compare column "size" with "small": not a number`)
+}
+
+type Survey struct {
+	ID     uint32 `mdb:"ignore"`
+	Name   string
+	Rating *int
+}
+
+func (s Survey) TableName() string { return "surveys" }
+
+func TestQueryIsNullAndIsNotNull(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	zero, five := 0, 5
+	is.NoErr(store.Save(kvs.RootOwner{}, &Survey{Name: "zero", Rating: &zero}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Survey{Name: "null"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Survey{Name: "five", Rating: &five}))
+	is.NoErr(kvs.Store(db, kvs.Entry{TableName: "surveys", ColumnName: "name", OwnerUUID: kvs.RootOwner{}, RowID: 3, Data: []byte("absent"), Meta: codec.Meta(codec.TagString)}))
+
+	names := func(q *query.Query) []string {
+		ss, err := query.Run[Survey](store, kvs.RootOwner{}, q)
+		is.NoErr(err)
+		names := []string{}
+		for _, s := range ss {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+
+	is.Equal(names(query.New().Filter("rating").IsNull()), []string{"null", "absent"})
+	is.Equal(names(query.New().Filter("rating").IsNotNull().OrderByDesc("rating")), []string{"five", "zero"})
+	is.Equal(names(query.New().Filter("rating").Eq(0)), []string{"zero"})          // null is not zero
+	is.Equal(names(query.New().Filter("rating").Lt(10)), []string{"zero", "five"}) // nor less than anything
+	is.Equal(names(query.New().OrderBy("rating")), []string{"null", "absent", "zero", "five"})
+
+	q, err := query.Parse("SELECT name FROM surveys WHERE rating IS NOT NULL AND name IS NULL")
+	is.NoErr(err)
+	is.Equal(query.Explain(q).Filters, []string{"rating isnotnull", "name isnull"})
+	is.Equal(names(q), []string{})
+
+	q, err = query.Parse("SELECT name FROM surveys WHERE rating IS NULL")
+	is.NoErr(err)
+	is.Equal(names(q), []string{"null", "absent"})
+
+	avg, err := query.Avg[Survey](store, kvs.RootOwner{}, nil, "rating")
+	is.NoErr(err)
+	is.Equal(avg.Value, 2.5) // nulls are left out
+}
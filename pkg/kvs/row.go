@@ -0,0 +1,142 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// rowVersion is the version of the encoding EncodeRow writes.
+const rowVersion = 1
+
+// RowKey is the key a whole row is stored under when its table is laid
+// out row by row, rather than with a key per column. Its table, owner and
+// row ID are taken from e.
+func RowKey(e Entry) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s", e.TableName, e.resolveOwnerID(), e.ResolveRowID().segment()))
+}
+
+// RowPrefix is the prefix shared by the row keys of a table and owner, or
+// of every owner for AnyOwner. It is also shared by some column keys, so
+// keys found with it need checking with IsRowKey.
+func RowPrefix(tableName string, owner UUID) []byte {
+	if _, ok := owner.(AnyOwner); ok {
+		return []byte(tableName + ".")
+	}
+	return []byte(fmt.Sprintf("%s.%s.", tableName, Entry{OwnerUUID: owner}.resolveOwnerID()))
+}
+
+// IsRowKey reports whether k is a table.owner.row key holding a whole row.
+// Column keys always have at least one more part.
+func IsRowKey(k []byte) bool {
+	_, err := ParseRowKey(k)
+	return err == nil
+}
+
+// ParseRowKey reverses RowKey, recovering the table, owner and row ID a
+// row was stored under.
+func ParseRowKey(k []byte) (Entry, error) {
+	parts := strings.Split(string(k), ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || IsIndexKey(k) {
+		return Entry{}, fmt.Errorf("malformed row key: %s", k)
+	}
+	rowID, ok := parseRowSegment(parts[2])
+	if !ok {
+		return Entry{}, fmt.Errorf("malformed row key: %s", k)
+	}
+	return Entry{TableName: parts[0], OwnerUUID: ParseOwner(parts[1])}.WithRowID(rowID), nil
+}
+
+// EncodeRow encodes the columns of a row into the single value stored
+// under its row key. Each column is written as its name, meta and data,
+// with the name and data prefixed by their lengths.
+func EncodeRow(entries []Entry) []byte {
+	size := 1
+	for _, e := range entries {
+		size += 2*binary.MaxVarintLen64 + len(e.ColumnName) + 1 + len(e.Data)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, rowVersion)
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(len(e.ColumnName)))
+		buf = append(buf, e.ColumnName...)
+		buf = append(buf, e.Meta)
+		buf = binary.AppendUvarint(buf, uint64(len(e.Data)))
+		buf = append(buf, e.Data...)
+	}
+	return buf
+}
+
+// DecodeRow reverses EncodeRow, returning an entry for each column of the
+// row with the table, owner and row ID of row.
+func DecodeRow(row Entry, data []byte) ([]Entry, error) {
+	if len(data) == 0 || data[0] != rowVersion {
+		return nil, fmt.Errorf("%s: unknown row encoding", RowKey(row))
+	}
+
+	entries := []Entry{}
+	for pos := 1; pos < len(data); {
+		name, n := readChunk(data[pos:])
+		if n <= 0 || pos+n >= len(data) {
+			return nil, fmt.Errorf("%s: truncated row", RowKey(row))
+		}
+		pos += n
+		meta := data[pos]
+		pos++
+		value, n := readChunk(data[pos:])
+		if n <= 0 {
+			return nil, fmt.Errorf("%s: truncated row", RowKey(row))
+		}
+		pos += n
+
+		e := row
+		e.ColumnName = string(name)
+		e.Meta = meta
+		e.Data = value
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readChunk reads a length prefixed chunk from the start of data,
+// returning it and the number of bytes read, or 0 if data is too short.
+func readChunk(data []byte) ([]byte, int) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, 0
+	}
+	end := n + int(size)
+	return data[n:end:end], end
+}
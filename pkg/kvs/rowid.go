@@ -0,0 +1,228 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"encoding"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// RowID identifies a row among the rows of its owner's table. IDs handed
+// out by sequences are the decimal text of a number, while UUIDs, ULIDs and
+// natural keys are held as their text.
+type RowID string
+
+// NumericID is the row ID of the given number.
+func NumericID(n uint64) RowID {
+	return RowID(strconv.FormatUint(n, 10))
+}
+
+// Numeric returns the number id holds, if it's the decimal text of one
+// written without leading zeros.
+func (id RowID) Numeric() (uint64, bool) {
+	n, err := strconv.ParseUint(string(id), 10, 64)
+	if err != nil || strconv.FormatUint(n, 10) != string(id) {
+		return 0, false
+	}
+	return n, true
+}
+
+func (id RowID) String() string { return string(id) }
+
+// textRowID marks the key segment of a row ID which isn't a number. Numbers
+// are written bare, so the keys of rows numbered by sequences read as they
+// always have.
+const textRowID = "~"
+
+// rowIDEscaper escapes the characters separating the parts of keys.
+var rowIDEscaper = strings.NewReplacer("%", "%25", ".", "%2E", "!", "%21")
+
+// segment is how id is written as the last part of a key.
+func (id RowID) segment() string {
+	if _, ok := id.Numeric(); ok {
+		return string(id)
+	}
+	return textRowID + rowIDEscaper.Replace(string(id))
+}
+
+// parseRowSegment reverses RowID.segment.
+func parseRowSegment(s string) (RowID, bool) {
+	if text, ok := strings.CutPrefix(s, textRowID); ok {
+		id, err := url.PathUnescape(text)
+		return RowID(id), err == nil && id != ""
+	}
+	id := RowID(s)
+	_, ok := id.Numeric()
+	return id, ok
+}
+
+// CompareRowIDs orders row IDs, putting numbers first in numeric order and
+// the rest after them in the order of their text.
+func CompareRowIDs(a, b RowID) int {
+	an, aok := a.Numeric()
+	bn, bok := b.Numeric()
+	switch {
+	case aok && bok:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aok:
+		return -1
+	case bok:
+		return 1
+	}
+	return strings.Compare(string(a), string(b))
+}
+
+// RowIDOf converts the value of a natural key into the row ID it names.
+// Unsigned and non-negative integers become numeric IDs, strings are taken
+// as they are, and types which marshal themselves to text, such as UUIDs,
+// are given as that text.
+func RowIDOf(v any) (RowID, error) {
+	switch k := v.(type) {
+	case RowID:
+		if k == "" {
+			return "", fmt.Errorf("row ID is empty")
+		}
+		return k, nil
+	case encoding.TextMarshaler:
+		text, err := k.MarshalText()
+		if err != nil {
+			return "", err
+		}
+		return RowIDOf(string(text))
+	case fmt.Stringer:
+		return RowIDOf(k.String())
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		if rv.Len() == 0 {
+			return "", fmt.Errorf("row ID is empty")
+		}
+		return RowID(rv.String()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return NumericID(rv.Uint()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Int() >= 0 {
+			return NumericID(uint64(rv.Int())), nil
+		}
+		return RowID(strconv.FormatInt(rv.Int(), 10)), nil
+	}
+	return "", fmt.Errorf("%T cannot be used as a row ID", v)
+}
+
+// KeyOf returns the row ID named by the field of x declared with the key
+// tag option, reporting false if x has no such field.
+func KeyOf(x any) (RowID, bool, error) {
+	v := reflect.Indirect(reflect.ValueOf(x))
+	if v.Kind() != reflect.Struct {
+		return "", false, nil
+	}
+	d := describe(v.Type())
+	if d.err != nil {
+		return "", false, d.err
+	}
+	if d.key == nil {
+		return "", false, nil
+	}
+
+	id, err := RowIDOf(v.FieldByIndex(d.key).Interface())
+	if err != nil {
+		return "", true, fmt.Errorf("%s key: %w", v.Type().Name(), err)
+	}
+	return id, true, nil
+}
+
+// LoadID sets the ID field of s to the numeric row ID it was stored under.
+func LoadID(s any, rowID uint32) error {
+	return LoadRowID(s, NumericID(uint64(rowID)))
+}
+
+// LoadRowID sets the ID field of s to the row ID it was stored under.
+// Numeric IDs can be loaded into any integer field they fit, while other
+// IDs need a string field or one of a type which unmarshals itself from
+// text, such as a UUID. Values without an ID field are left as they are if
+// they're keyed by one of their other fields.
+func LoadRowID(s any, rowID RowID) error {
+	val := reflect.ValueOf(s).Elem()
+
+	field, err := resolveFieldRef(val, "ID")
+	if err != nil {
+		if _, keyed, _ := KeyOf(s); keyed {
+			return nil
+		}
+		return err
+	}
+
+	if err := assignRowID(rowID, field); err != nil {
+		return fmt.Errorf("failed to load row ID %s into field ID: %w", rowID, err)
+	}
+
+	return nil
+}
+
+func assignRowID(rowID RowID, field reflect.Value) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(rowID))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(string(rowID))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := rowID.Numeric()
+		if !ok || field.OverflowUint(n) {
+			return fmt.Errorf("it does not fit %s", field.Type())
+		}
+		field.SetUint(n)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := rowID.Numeric()
+		if !ok || n > 1<<63-1 || field.OverflowInt(int64(n)) {
+			return fmt.Errorf("it does not fit %s", field.Type())
+		}
+		field.SetInt(int64(n))
+		return nil
+	}
+	return fmt.Errorf("%s cannot hold a row ID", field.Type())
+}
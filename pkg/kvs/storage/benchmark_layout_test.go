@@ -0,0 +1,131 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+type Sample struct {
+	ID                           uint32 `mdb:"ignore"`
+	A, B, C, D, E, F, G, H, I, J int
+}
+
+func (s Sample) TableName() string { return "samples" }
+
+type PackedSample Sample
+
+func (s PackedSample) TableName() string      { return "samples" }
+func (s PackedSample) Layout() storage.Layout { return storage.RowMajor }
+
+func seedSamples[T storage.Value](b *testing.B, newValue func(i int) T, n int) storage.Store {
+	db, err := kvs.NewMemKVDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	store := storage.New(db)
+	b.Cleanup(func() { store.Close() })
+
+	for i := 0; i < n; i++ {
+		if err := store.Save(kvs.RootOwner{}, newValue(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store
+}
+
+func newSample(i int) *Sample {
+	return &Sample{A: i, B: i, C: i, D: i, E: i, F: i, G: i, H: i, I: i, J: i}
+}
+
+func newPackedSample(i int) *PackedSample {
+	return (*PackedSample)(newSample(i))
+}
+
+func BenchmarkLoadAllFiveHundredColumnMajorRows(b *testing.B) {
+	store := seedSamples(b, newSample, 500)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.LoadAll[Sample](store, kvs.RootOwner{})
+	}
+}
+
+func BenchmarkLoadAllFiveHundredRowMajorRows(b *testing.B) {
+	store := seedSamples(b, newPackedSample, 500)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.LoadAll[PackedSample](store, kvs.RootOwner{})
+	}
+}
+
+func BenchmarkLoadColumnMajorRow(b *testing.B) {
+	store := seedSamples(b, newSample, 500)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.Load(store, &Sample{}, kvs.RootOwner{}, uint32(i%500))
+	}
+}
+
+func BenchmarkLoadRowMajorRow(b *testing.B) {
+	store := seedSamples(b, newPackedSample, 500)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.Load(store, &PackedSample{}, kvs.RootOwner{}, uint32(i%500))
+	}
+}
+
+func BenchmarkSaveColumnMajorRow(b *testing.B) {
+	store := seedSamples(b, newSample, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Save(kvs.RootOwner{}, newSample(i))
+	}
+}
+
+func BenchmarkSaveRowMajorRow(b *testing.B) {
+	store := seedSamples(b, newPackedSample, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Save(kvs.RootOwner{}, newPackedSample(i))
+	}
+}
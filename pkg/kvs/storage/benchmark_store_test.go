@@ -0,0 +1,119 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+func BenchmarkSaveFiveHundredRowsOneByOne(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store := seedSamples(b, newSample, 0)
+		b.StartTimer()
+
+		for j := 0; j < 500; j++ {
+			store.Save(kvs.RootOwner{}, newSample(j))
+		}
+	}
+}
+
+func BenchmarkSaveManyFiveHundredRows(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store := seedSamples(b, newSample, 0)
+		values := make([]storage.Value, 500)
+		for j := range values {
+			values[j] = newSample(j)
+		}
+		b.StartTimer()
+
+		store.SaveMany(kvs.RootOwner{}, values)
+	}
+}
+
+func sampleIDs() []uint32 {
+	ids := make([]uint32, 0, 100)
+	for i := uint32(0); i < 500; i += 5 {
+		ids = append(ids, i)
+	}
+	return ids
+}
+
+func BenchmarkLoadHundredRowsOneByOne(b *testing.B) {
+	store := seedSamples(b, newSample, 500)
+	ids := sampleIDs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			storage.Load(store, &Sample{}, kvs.RootOwner{}, id)
+		}
+	}
+}
+
+func BenchmarkLoadManyHundredRows(b *testing.B) {
+	store := seedSamples(b, newSample, 500)
+	ids := sampleIDs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.LoadMany[Sample](store, kvs.RootOwner{}, ids)
+	}
+}
+
+func BenchmarkLoadHundredCachedRowsOneByOne(b *testing.B) {
+	db, err := kvs.NewMemKVDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	store := storage.New(db, storage.WithRowCache(100))
+	b.Cleanup(func() { store.Close() })
+	for j := 0; j < 500; j++ {
+		if err := store.Save(kvs.RootOwner{}, newSample(j)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ids := sampleIDs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			storage.Load(store, &Sample{}, kvs.RootOwner{}, id)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// CacheStats counts how the row cache of a Store has been used since the
+// Store was created.
+type CacheStats struct {
+	Hits      int
+	Misses    int
+	Evictions int
+	Rows      int // rows held right now
+}
+
+type cacheKey struct {
+	table string
+	owner string
+	id    kvs.RowID
+}
+
+func cacheKeyOf(row kvs.Entry) cacheKey {
+	return cacheKey{table: row.TableName, owner: resolveOwnerID(row.OwnerUUID), id: row.ResolveRowID()}
+}
+
+// cachedRow holds the entries read for the given columns of a row, leaving
+// out the columns which had nothing stored, as of the read timestamp of the
+// transaction which read them.
+type cachedRow struct {
+	key     cacheKey
+	readTs  uint64
+	columns map[string]struct{}
+	entries map[string]kvs.Entry
+}
+
+// rowCache keeps the most recently loaded rows of a Store, shared by every
+// copy of it. Writes made through the Store drop the rows they touch as
+// soon as they commit, while writes made through any other connection or
+// Store drop them once badger publishes them to the cache's subscription.
+// As the subscription also hears the Store's own writes, a published write
+// only drops rows read before it was committed. A nil rowCache caches
+// nothing.
+type rowCache struct {
+	mu         sync.Mutex
+	size       int
+	rows       map[cacheKey]*list.Element
+	order      *list.List // most recently used first
+	generation uint64     // bumped by every write made through the Store
+	published  uint64     // the newest version of any published write
+	stats      CacheStats
+
+	stop context.CancelFunc
+	done chan struct{}
+	err  error
+}
+
+// cacheReadyKey is deleted over and over by a new rowCache until its
+// subscription hears of it, which shows the subscription is listening.
+// Nothing is ever stored under it.
+var cacheReadyKey = []byte("!cache!ready")
+
+// newRowCache returns a rowCache once its subscription is listening, so
+// that no write committed after it returns can go unheard.
+func newRowCache(db kvs.KVDB, size int) *rowCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &rowCache{
+		size:  size,
+		rows:  map[cacheKey]*list.Element{},
+		order: list.New(),
+		stop:  cancel,
+		done:  make(chan struct{}),
+	}
+
+	ready := make(chan struct{})
+	var once sync.Once
+	go func() {
+		defer close(c.done)
+		c.err = db.Subscribe(ctx, func(written *badger.KVList) error {
+			for _, kv := range written.Kv {
+				if bytes.Equal(kv.Key, cacheReadyKey) {
+					once.Do(func() { close(ready) })
+					continue
+				}
+				c.invalidatePublished(kv.Key, kv.Version)
+			}
+			return nil
+		}, nil)
+	}()
+
+	// the subscription only hears writes committed once it has started
+	// listening, which can't be told from outside until it hears one
+	tick := time.NewTicker(time.Millisecond)
+	defer tick.Stop()
+	for {
+		if err := db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(cacheReadyKey)
+		}); err != nil {
+			// rows written through other connections may then be served
+			// stale, as they were before the cache waited at all
+			return c
+		}
+		select {
+		case <-ready:
+			return c
+		case <-c.done:
+			return c
+		case <-tick.C:
+		}
+	}
+}
+
+// get returns the stored entries of the given columns of row, if every one
+// of them is cached.
+func (c *rowCache) get(row kvs.Entry, columns []string) (map[string]kvs.Entry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if _, ok := row.OwnerUUID.(kvs.AnyOwner); ok {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.rows[cacheKeyOf(row)]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	cached := el.Value.(*cachedRow)
+	for _, column := range columns {
+		if _, ok := cached.columns[column]; !ok {
+			c.stats.Misses++
+			return nil, false
+		}
+	}
+
+	c.order.MoveToFront(el)
+	c.stats.Hits++
+
+	// entries are handed out as copies, as they may be loaded into fields
+	// which keep hold of their data
+	entries := make(map[string]kvs.Entry, len(columns))
+	for _, column := range columns {
+		if ent, ok := cached.entries[column]; ok {
+			ent.Data = append([]byte(nil), ent.Data...)
+			entries[column] = ent
+		}
+	}
+	return entries, true
+}
+
+// snapshot returns the cache's generation, which should be taken before
+// reading the rows to be put into it, so that put can tell whether a write
+// made through the Store has come in between.
+func (c *rowCache) snapshot() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches the entries read for the given columns of row by a transaction
+// with the given read timestamp, unless a write has been seen since which
+// they may be from before.
+func (c *rowCache) put(row kvs.Entry, generation, readTs uint64, columns []string, entries map[string]kvs.Entry) {
+	if c == nil {
+		return
+	}
+	if _, ok := row.OwnerUUID.(kvs.AnyOwner); ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || c.published > readTs {
+		return
+	}
+
+	key := cacheKeyOf(row)
+	cached := &cachedRow{key: key, readTs: readTs, columns: map[string]struct{}{}, entries: map[string]kvs.Entry{}}
+	if el, ok := c.rows[key]; ok {
+		// nothing has been written since the columns already held were read
+		cached = el.Value.(*cachedRow)
+		c.order.MoveToFront(el)
+	} else {
+		c.rows[key] = c.order.PushFront(cached)
+	}
+	for _, column := range columns {
+		cached.columns[column] = struct{}{}
+		if ent, ok := entries[column]; ok {
+			ent.Data = append([]byte(nil), ent.Data...)
+			cached.entries[column] = ent
+		}
+	}
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.rows, oldest.Value.(*cachedRow).key)
+		c.stats.Evictions++
+	}
+}
+
+// invalidate drops the given rows from the cache.
+func (c *rowCache) invalidate(rows ...kvs.Entry) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, row := range rows {
+		key := cacheKeyOf(row)
+		if el, ok := c.rows[key]; ok {
+			c.order.Remove(el)
+			delete(c.rows, key)
+		}
+	}
+}
+
+// invalidateKeys drops the rows which have a column or row key among the
+// given keys. Index and sequence keys are ignored, as the rows they point
+// to are written alongside them.
+func (c *rowCache) invalidateKeys(keys [][]byte) {
+	if c == nil {
+		return
+	}
+
+	rows := make([]kvs.Entry, 0, len(keys))
+	for _, k := range keys {
+		if row, ok := parseRowOf(k); ok {
+			rows = append(rows, row)
+		}
+	}
+	c.invalidate(rows...)
+}
+
+// parseRowOf returns the row a column or row key belongs to.
+func parseRowOf(k []byte) (kvs.Entry, bool) {
+	if kvs.IsIndexKey(k) {
+		return kvs.Entry{}, false
+	}
+	if row, err := kvs.ParseRowKey(k); err == nil {
+		return row, true
+	}
+	row, err := kvs.ParseKey(k)
+	return row, err == nil
+}
+
+// invalidatePublished drops the row with a column or row key of key, if it
+// was read before the write of the given version.
+func (c *rowCache) invalidatePublished(key []byte, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version > c.published {
+		c.published = version
+	}
+	row, ok := parseRowOf(key)
+	if !ok {
+		return
+	}
+	if el, ok := c.rows[cacheKeyOf(row)]; ok && el.Value.(*cachedRow).readTs < version {
+		c.order.Remove(el)
+		delete(c.rows, cacheKeyOf(row))
+	}
+}
+
+func (c *rowCache) cacheStats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Rows = c.order.Len()
+	return stats
+}
+
+// close ends the cache's subscription.
+func (c *rowCache) close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.stop()
+	<-c.done
+	if errors.Is(c.err, context.Canceled) {
+		return nil
+	}
+	return c.err
+}
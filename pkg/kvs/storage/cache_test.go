@@ -0,0 +1,178 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+func TestRowCacheServesRepeatLoadsUntilRowsAreWritten(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithRowCache(10))
+	defer store.Close()
+
+	b := Balloon{Color: "RED", Size: 3}
+	is.NoErr(store.Save(kvs.RootOwner{}, &b))
+
+	loaded := Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	stats := storage.ScanStats{}
+	loaded = Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0, storage.WithScanStats(&stats)))
+	is.Equal(loaded, Balloon{ID: 0, Color: "RED", Size: 3})
+	is.Equal(stats.KeysScanned, 0) // read from the cache
+	is.Equal(store.CacheStats(), storage.CacheStats{Hits: 1, Misses: 1, Rows: 1})
+
+	is.NoErr(store.Update(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 5}, 0))
+	loaded = Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Balloon{ID: 0, Color: "BLUE", Size: 5})
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Balloon{}, 0))
+	loaded = Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Balloon{})
+	is.Equal(store.CacheStats(), storage.CacheStats{Hits: 1, Misses: 3, Rows: 1})
+}
+
+func TestRowCacheHoldsOnlyTheColumnsLoaded(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithRowCache(10))
+	defer store.Close()
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 3}))
+
+	loaded := Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0, storage.WithColumns("color")))
+	is.Equal(loaded, Balloon{Color: "RED"})
+
+	// the size was never read, so loading it misses and fills in the rest
+	loaded = Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Balloon{Color: "RED", Size: 3})
+	loaded = Balloon{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0, storage.WithColumns("size")))
+	is.Equal(loaded, Balloon{Size: 3})
+	is.Equal(store.CacheStats(), storage.CacheStats{Hits: 1, Misses: 2, Rows: 1})
+}
+
+func TestRowCacheEvictsTheLeastRecentlyUsedRow(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithRowCache(2))
+	defer store.Close()
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, []storage.Value{
+		&Balloon{Color: "RED"}, &Balloon{Color: "GREEN"}, &Balloon{Color: "BLUE"},
+	}))
+
+	for _, rowID := range []uint32{0, 1, 0, 2, 0, 1} {
+		is.NoErr(storage.Load(store, &Balloon{}, kvs.RootOwner{}, rowID))
+	}
+	is.Equal(store.CacheStats(), storage.CacheStats{Hits: 2, Misses: 4, Evictions: 2, Rows: 2})
+}
+
+func TestRowCacheDropsRowsWrittenByOtherStores(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	cached := storage.New(db, storage.WithRowCache(10))
+	defer cached.Close()
+	other := storage.New(db)
+	defer other.Close()
+
+	is.NoErr(other.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 3}))
+	loaded := Balloon{}
+	is.NoErr(storage.Load(cached, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded.Color, "RED")
+
+	is.NoErr(other.Update(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 3}, 0))
+
+	// the write reaches the cache once badger publishes it
+	deadline := time.Now().Add(5 * time.Second)
+	for loaded.Color != "BLUE" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		is.NoErr(storage.Load(cached, &loaded, kvs.RootOwner{}, 0))
+	}
+	is.Equal(loaded.Color, "BLUE")
+}
+
+func TestRowCacheHearsWritesMadeAsSoonAsItIsCreated(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	other := storage.New(db)
+	defer other.Close()
+	is.NoErr(other.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 3}))
+
+	for i := 0; i < 20; i++ {
+		cached := storage.New(db, storage.WithRowCache(10))
+		loaded := Balloon{}
+		is.NoErr(storage.Load(cached, &loaded, kvs.RootOwner{}, 0))
+
+		// New only returns once the cache's subscription is listening, so
+		// the write is published to it however soon it's made
+		color := fmt.Sprintf("C%d", i)
+		is.NoErr(other.Update(kvs.RootOwner{}, &Balloon{Color: color, Size: 3}, 0))
+		deadline := time.Now().Add(5 * time.Second)
+		for loaded.Color != color && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			is.NoErr(storage.Load(cached, &loaded, kvs.RootOwner{}, 0))
+		}
+		is.Equal(loaded.Color, color)
+		is.NoErr(cached.Close())
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+func TestConcurrentSavesHandOutEachRowIDOnce(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+
+	owners := []kvs.UUID{kvs.RootOwner{}, uuid.New(), uuid.New()}
+	const workers, saves = 16, 25
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			owner := owners[w%len(owners)]
+			copied := store
+			for i := 0; i < saves; i++ {
+				var err error
+				switch i % 4 {
+				case 0:
+					err = store.Save(owner, &Balloon{Color: fmt.Sprintf("W%d", w), Size: i})
+				case 1:
+					err = store.Save(owner, &Cake{Type: fmt.Sprintf("W%d", w), Calories: i})
+				case 2:
+					err = store.Save(owner, &Ticket{Title: "T", Status: fmt.Sprintf("W%d", w)})
+				default:
+					// copies of a store share its sequences
+					err = copied.SaveMany(owner, []storage.Value{&Balloon{Size: i}, &Cake{Calories: i}})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := storage.LoadAll[Balloon](store, owner, storage.WithColumns("size")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		is.NoErr(err)
+	}
+
+	for _, owner := range owners {
+		bs, err := storage.LoadAll[Balloon](store, owner)
+		is.NoErr(err)
+		cs, err := storage.LoadAll[Cake](store, owner)
+		is.NoErr(err)
+		ts, err := storage.LoadAll[Ticket](store, owner)
+		is.NoErr(err)
+
+		ids := func(n int, id func(i int) uint32) []uint32 {
+			got := make([]uint32, n)
+			for i := range got {
+				got[i] = id(i)
+			}
+			return got
+		}
+		for _, got := range [][]uint32{
+			ids(len(bs), func(i int) uint32 { return bs[i].ID }),
+			ids(len(cs), func(i int) uint32 { return cs[i].ID }),
+			ids(len(ts), func(i int) uint32 { return ts[i].ID }),
+		} {
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			for i := 1; i < len(got); i++ {
+				is.True(got[i] != got[i-1]) // no row ID handed out twice
+			}
+		}
+	}
+
+	is.NoErr(store.Close())
+
+	// every row saved was given its own row ID
+	total := 0
+	for _, owner := range owners {
+		bs, _ := storage.LoadAll[Balloon](store, owner)
+		cs, _ := storage.LoadAll[Cake](store, owner)
+		ts, _ := storage.LoadAll[Ticket](store, owner)
+		total += len(bs) + len(cs) + len(ts)
+	}
+	is.Equal(total, workers*(saves+saves/4))
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+	for _, p := range report.Problems {
+		is.Equal(p.Kind, kvs.OrphanedOwner) // only the owners made up for the test
+	}
+}
+
+func TestConcurrentSaveManysWriteEachNaturalKeyOnce(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithTableIDs("members", storage.NaturalKeys()))
+	defer store.Close()
+
+	const workers, keys = 16, 50
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	saved := make(chan string, workers*keys)
+	errs := make(chan error, workers*keys)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<-start
+			for k := 0; k < keys; k++ {
+				email := fmt.Sprintf("%d@pond.example", k)
+				err := store.SaveMany(kvs.RootOwner{}, []storage.Value{&Member{Email: email, Name: fmt.Sprintf("W%d", w)}})
+				if err == nil {
+					saved <- email
+					continue
+				}
+				// the check and the write of each row are one transaction,
+				// so those beaten to it either see the row or conflict
+				if !errors.Is(err, storage.ErrRowExists) && !errors.Is(err, badger.ErrConflict) {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	close(start)
+	wg.Wait()
+	close(saved)
+	close(errs)
+	for err := range errs {
+		is.NoErr(err)
+	}
+
+	times := map[string]int{}
+	for email := range saved {
+		times[email]++
+	}
+	is.Equal(len(times), keys)
+	for _, n := range times {
+		is.Equal(n, 1) // each key was saved by only one worker
+	}
+}
+
+func TestCloseReleasesEverySequence(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Cake{}))
+	is.NoErr(store.Close())
+
+	// once released, a new store carries on where the sequences left off
+	// rather than after the leases the first had taken
+	next := storage.New(db)
+	defer next.Close()
+
+	b, c := Balloon{}, Cake{}
+	is.NoErr(next.Save(kvs.RootOwner{}, &b))
+	is.NoErr(next.Save(kvs.RootOwner{}, &c))
+	is.Equal(b.ID, uint32(1))
+	is.Equal(c.ID, uint32(1))
+
+	// and the first can be used again after closing
+	is.NoErr(store.Save(kvs.RootOwner{}, &b))
+	is.Equal(b.ID, uint32(2))
+	is.NoErr(store.Close())
+}
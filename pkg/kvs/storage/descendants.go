@@ -0,0 +1,164 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// LoadDescendants loads every row of T owned by root or by any owner found
+// beneath it. The owner tree is walked through UUID-typed columns: a row
+// owned by root which holds a UUID makes that UUID a child owner, whose
+// rows may hold further UUIDs and so on. Depth limits how many levels of
+// owners below root are included, where 0 loads only root's own rows and a
+// negative depth walks the whole tree.
+func LoadDescendants[T Value](s Store, root kvs.UUID, depth int, opts ...LoadOption) ([]T, error) {
+	owners, err := DescendantOwners(s, root, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerIDs := make(map[string]struct{}, len(owners))
+	for _, owner := range owners {
+		ownerIDs[owner.String()] = struct{}{}
+	}
+
+	return loadAllWithPredicate[T](s, kvs.AnyOwner{}, func(r Row) bool {
+		_, ok := ownerIDs[r.Owner.String()]
+		return ok
+	}, resolveLoadOptions(opts))
+}
+
+// DescendantOwners lists root followed by each owner beneath it, level by
+// level, down to the given depth. A negative depth walks the whole tree.
+// Each level is found in one pass over the keys, reading only those of the
+// rows owned by the level above and skipping every other owner's.
+func DescendantOwners(s Store, root kvs.UUID, depth int) ([]kvs.UUID, error) {
+	if root == nil {
+		root = kvs.RootOwner{}
+	}
+
+	owners := []kvs.UUID{root}
+	visited := map[string]struct{}{root.String(): {}}
+	err := s.db.View(func(txn *badger.Txn) error {
+		level := []kvs.UUID{root}
+		for d := 0; len(level) > 0 && (depth < 0 || d < depth); d++ {
+			parents := make(map[string]struct{}, len(level))
+			for _, owner := range level {
+				parents[owner.String()] = struct{}{}
+			}
+
+			var next []kvs.UUID
+			if err := ownedRefs(txn, parents, func(ref kvs.UUID) {
+				if _, ok := visited[ref.String()]; !ok {
+					visited[ref.String()] = struct{}{}
+					next = append(next, ref)
+				}
+			}); err != nil {
+				return err
+			}
+			owners = append(owners, next...)
+			level = next
+		}
+		return nil
+	})
+	return owners, err
+}
+
+// ownedRefs calls found with each UUID held in the columns of the rows of
+// the given owners, in any table. Of the keys of every other owner, only
+// the first of each column is read, along with their row keys.
+func ownedRefs(txn *badger.Txn, owners map[string]struct{}, found func(kvs.UUID)) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	refs := func(entries []kvs.Entry) {
+		for _, e := range entries {
+			if ref, ok := kvs.UUIDFromData(e.Data, e.Meta); ok {
+				found(ref)
+			}
+		}
+	}
+
+	for it.Rewind(); it.Valid(); {
+		item := it.Item()
+		if bytes.HasPrefix(item.Key(), []byte("!")) {
+			// indexes and other bookkeeping keys all begin with '!'
+			it.Seek([]byte{'!' + 1})
+			continue
+		}
+
+		if row, err := kvs.ParseRowKey(item.Key()); err == nil {
+			if _, ok := owners[row.OwnerUUID.String()]; ok {
+				entries, err := decodeRowItem(item, row)
+				if err != nil {
+					return err
+				}
+				refs(entries)
+			}
+			it.Next()
+			continue
+		}
+
+		e, err := kvs.ParseKey(item.Key())
+		if err != nil {
+			// sequences don't parse
+			it.Next()
+			continue
+		}
+		group := kvs.Entry{TableName: e.TableName, ColumnName: e.ColumnName, OwnerUUID: e.OwnerUUID}.PrefixKey()
+		if _, ok := owners[e.OwnerUUID.String()]; ok {
+			prefix := append(group, '.')
+			for ; it.ValidForPrefix(prefix); it.Next() {
+				e, err := kvs.ParseKey(it.Item().Key())
+				if err != nil {
+					return err
+				}
+				if e.Data, err = it.Item().ValueCopy(nil); err != nil {
+					return err
+				}
+				e.Meta = it.Item().UserMeta()
+				refs([]kvs.Entry{e})
+			}
+			continue
+		}
+		// every other key of the column and owner differs only by row ID,
+		// which sorts before 0xff
+		it.Seek(append(group, '.', 0xff))
+	}
+	return nil
+}
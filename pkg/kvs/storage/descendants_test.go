@@ -0,0 +1,162 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+type Shelf struct {
+	ID   uint32 `mdb:"ignore"`
+	UUID uuid.UUID
+	Name string
+}
+
+func (s Shelf) TableName() string { return "shelves" }
+
+type Jar struct {
+	ID       uint32 `mdb:"ignore"`
+	UUID     uuid.UUID
+	Contents string
+}
+
+func (j Jar) TableName() string { return "jars" }
+
+func TestLoadAllWithAnyOwnerSpansOwners(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	first, second := uuid.New(), uuid.New()
+	is.NoErr(store.Save(first, &Balloon{Color: "RED", Size: 695}))
+	is.NoErr(store.Save(second, &Balloon{Color: "WHITE", Size: 366}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 112}))
+
+	balloons, err := storage.LoadAll[Balloon](store, kvs.AnyOwner{})
+	is.NoErr(err)
+	is.Equal(len(balloons), 3)
+
+	rows, err := storage.LoadRows(store, "balloons", kvs.AnyOwner{}, "color")
+	is.NoErr(err)
+	is.Equal(len(rows), 3)
+	for _, row := range rows {
+		is.True(row.Owner != nil)
+	}
+}
+
+func TestLoadDescendantsWalksOwnerTree(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	pantry := uuid.New()
+	top := Shelf{UUID: uuid.New(), Name: "top"}
+	bottom := Shelf{UUID: uuid.New(), Name: "bottom"}
+	is.NoErr(store.Save(pantry, &top))
+	is.NoErr(store.Save(pantry, &bottom))
+
+	honey := Jar{UUID: uuid.New(), Contents: "honey"}
+	is.NoErr(store.Save(pantry, &Jar{UUID: uuid.New(), Contents: "flour"}))
+	is.NoErr(store.Save(top.UUID, &honey))
+	is.NoErr(store.Save(bottom.UUID, &Jar{UUID: uuid.New(), Contents: "jam"}))
+	// a jar inside a jar sits two levels below the shelves
+	is.NoErr(store.Save(honey.UUID, &Jar{UUID: uuid.New(), Contents: "comb"}))
+	is.NoErr(store.Save(uuid.New(), &Jar{UUID: uuid.New(), Contents: "elsewhere"}))
+
+	contents := func(jars []Jar) map[string]bool {
+		m := map[string]bool{}
+		for _, j := range jars {
+			m[j.Contents] = true
+		}
+		return m
+	}
+
+	jars, err := storage.LoadDescendants[Jar](store, pantry, 0)
+	is.NoErr(err)
+	is.Equal(contents(jars), map[string]bool{"flour": true})
+
+	jars, err = storage.LoadDescendants[Jar](store, pantry, 1)
+	is.NoErr(err)
+	is.Equal(contents(jars), map[string]bool{"flour": true, "honey": true, "jam": true})
+
+	jars, err = storage.LoadDescendants[Jar](store, pantry, -1)
+	is.NoErr(err)
+	is.Equal(contents(jars), map[string]bool{"flour": true, "honey": true, "jam": true, "comb": true})
+
+	owners, err := storage.DescendantOwners(store, pantry, 1)
+	is.NoErr(err)
+	is.Equal(owners[0], kvs.UUID(pantry))
+	// both shelves and the pantry's own jar hold UUIDs, making them owners
+	is.Equal(len(owners), 4)
+}
+
+func TestDescendantOwnersFollowBothLayoutsOnly(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	pantry := uuid.New()
+	shelf := Shelf{UUID: uuid.New(), Name: "top"}
+	is.NoErr(store.Save(pantry, &shelf))
+	// a packed row's UUIDs make owners as its columns' do
+	sensor := uuid.New()
+	is.NoErr(store.Save(shelf.UUID, &PackedReading{Sensor: sensor, Station: "pantry"}))
+	// indexed and sequenced tables keep keys which belong to no owner
+	is.NoErr(store.Save(pantry, &Ticket{Title: "restock", Status: "open"}))
+	// other owners' UUIDs are never followed
+	is.NoErr(store.Save(uuid.New(), &Shelf{UUID: uuid.New(), Name: "elsewhere"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedReading{Sensor: uuid.New()}))
+
+	owners, err := storage.DescendantOwners(store, pantry, -1)
+	is.NoErr(err)
+	is.Equal(owners, []kvs.UUID{pantry, shelf.UUID, sensor})
+}
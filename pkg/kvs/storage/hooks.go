@@ -0,0 +1,90 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+// BeforeSaver is implemented by values which adjust themselves, or refuse
+// to be written, before Save, SaveMany, Update or Patch writes them. It is
+// called before a new row is given its ID, so it may set the value's
+// natural key.
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+// AfterSaver is implemented by values which need to know they've been
+// written. It is called once the row is written but before the write is
+// committed, so an error keeps the row from being written at all.
+type AfterSaver interface {
+	AfterSave() error
+}
+
+// BeforeDeleter is implemented by values which refuse to be removed by
+// Delete or DeleteCascade, whichever value is passed to them standing in
+// for the row.
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+// AfterLoader is implemented by values which work something out from their
+// columns once they've been loaded, including any eager children. It is
+// called within the transaction which read the row, or, for a row taken
+// from the row cache, within one opened for it, so an error fails the load.
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+func beforeSave(v any) error {
+	if h, ok := v.(BeforeSaver); ok {
+		return h.BeforeSave()
+	}
+	return nil
+}
+
+func afterSave(v any) error {
+	if h, ok := v.(AfterSaver); ok {
+		return h.AfterSave()
+	}
+	return nil
+}
+
+func beforeDelete(v any) error {
+	if h, ok := v.(BeforeDeleter); ok {
+		return h.BeforeDelete()
+	}
+	return nil
+}
+
+func afterLoad(v any) error {
+	if h, ok := v.(AfterLoader); ok {
+		return h.AfterLoad()
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+var errAccountLocked = errors.New("account is locked")
+
+// Account normalises its email before it's saved, and works out its handle
+// once loaded.
+type Account struct {
+	ID     uint32 `mdb:"ignore"`
+	Email  string
+	Locked bool
+	Handle string `mdb:"ignore"`
+	saves  int
+}
+
+func (a Account) TableName() string { return "accounts" }
+
+func (a *Account) BeforeSave() error {
+	a.Email = strings.ToLower(strings.TrimSpace(a.Email))
+	if a.Email == "" {
+		return errors.New("accounts need an email")
+	}
+	return nil
+}
+
+func (a *Account) AfterSave() error {
+	if strings.HasSuffix(a.Email, ".invalid") {
+		return errors.New("emails can't be sent to " + a.Email)
+	}
+	a.saves++
+	return nil
+}
+
+func (a *Account) BeforeDelete() error {
+	if a.Locked {
+		return errAccountLocked
+	}
+	return nil
+}
+
+func (a *Account) AfterLoad() error {
+	a.Handle, _, _ = strings.Cut(a.Email, "@")
+	return nil
+}
+
+func TestHooksRunAroundSavesAndLoads(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	amy := Account{Email: " Amy@Pond.Example "}
+	is.NoErr(store.Save(kvs.RootOwner{}, &amy))
+	is.Equal(amy.saves, 1)
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, []storage.Value{&Account{Email: "RORY@Pond.Example"}}))
+	update := Account{Email: "Amelia@Pond.Example"}
+	is.NoErr(store.Update(kvs.RootOwner{}, &update, 0))
+	is.Equal(update.saves, 1)
+
+	loaded := Account{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Account{Email: "amelia@pond.example", Handle: "amelia"})
+
+	accounts, err := storage.LoadAll[Account](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(accounts, []Account{
+		{ID: 0, Email: "amelia@pond.example", Handle: "amelia"},
+		{ID: 1, Email: "rory@pond.example", Handle: "rory"},
+	})
+}
+
+func TestAfterLoadRunsForRowsTakenFromTheCache(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithRowCache(10))
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Account{Email: "amy@pond.example"}))
+	for i := 0; i < 2; i++ {
+		loaded := Account{}
+		is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+		is.Equal(loaded.Handle, "amy")
+	}
+	is.Equal(store.CacheStats().Hits, 1)
+}
+
+func TestHookErrorsAbortWrites(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Account{Email: "amy@pond.example", Locked: true}))
+
+	is.Equal(store.Save(kvs.RootOwner{}, &Account{Email: "  "}).Error(), "accounts need an email")
+	is.Equal(store.Save(kvs.RootOwner{}, &Account{Email: "doctor@tardis.invalid"}).Error(), "emails can't be sent to doctor@tardis.invalid")
+	err = store.Update(kvs.RootOwner{}, &Account{Email: "amy@pond.invalid"}, 0)
+	is.Equal(err.Error(), "emails can't be sent to amy@pond.invalid")
+	err = store.Patch(kvs.RootOwner{}, &Account{Email: "amy@pond.invalid"}, 0, "email")
+	is.Equal(err.Error(), "emails can't be sent to amy@pond.invalid")
+
+	is.True(errors.Is(store.Delete(kvs.RootOwner{}, &Account{Locked: true}, 0), errAccountLocked))
+	is.True(errors.Is(store.DeleteCascade(kvs.RootOwner{}, &Account{Locked: true}, 0), errAccountLocked))
+
+	accounts, err := storage.LoadAll[Account](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(accounts, []Account{{ID: 0, Email: "amy@pond.example", Locked: true, Handle: "amy"}})
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Account{}, 0))
+	accounts, err = storage.LoadAll[Account](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(accounts), 0)
+}
+
+// Subscriber is keyed by its email, which it normalises before it's saved.
+type Subscriber struct {
+	Email string `mdb:"key"`
+}
+
+func (s Subscriber) TableName() string { return "subscribers" }
+
+func (s *Subscriber) BeforeSave() error {
+	s.Email = strings.ToLower(s.Email)
+	return nil
+}
+
+func TestBeforeSaveRunsBeforeNaturalKeysAreTaken(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithTableIDs("subscribers", storage.NaturalKeys()))
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Subscriber{Email: "Amy@Pond.Example"}))
+	err = store.Save(kvs.RootOwner{}, &Subscriber{Email: "AMY@pond.example"})
+	is.True(errors.Is(err, storage.ErrRowExists))
+
+	loaded := Subscriber{}
+	is.NoErr(storage.LoadByID(store, &loaded, kvs.RootOwner{}, "amy@pond.example"))
+	is.Equal(loaded.Email, "amy@pond.example")
+}
+
+// oversizedTable makes keys too big for badger to write.
+var oversizedTable = strings.Repeat("t", 70000)
+
+type Oversized struct {
+	ID   string `mdb:"ignore"`
+	Name string
+}
+
+func (o Oversized) TableName() string { return oversizedTable }
+
+func TestSaveManyRunsAfterSaveOnlyOnceRowsAreWritten(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db,
+		storage.WithTableIDs("subscribers", storage.NaturalKeys()),
+		storage.WithTableIDs(oversizedTable, storage.UUIDv7IDs()),
+	)
+	defer store.Close()
+
+	amy := Account{Email: "amy@pond.example"}
+	err = store.SaveMany(kvs.RootOwner{}, []storage.Value{
+		&amy,
+		&Subscriber{Email: "rory@pond.example"},
+		&Oversized{Name: "never written"},
+	})
+	is.True(err != nil)
+	is.Equal(amy.saves, 0) // the batch failed, so amy was never saved
+
+	accounts, err := storage.LoadAll[Account](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(accounts), 0)
+
+	// natural-key rows are committed before the batch is written
+	subscribers, err := storage.LoadAll[Subscriber](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(subscribers, []Subscriber{{Email: "rory@pond.example"}})
+}
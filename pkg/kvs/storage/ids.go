@@ -0,0 +1,209 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// IDGenerator hands out the row IDs of new rows. A generator which keeps
+// state in the database, as sequences do, belongs to the one Store it's
+// given to, which closes it if it's an io.Closer.
+type IDGenerator interface {
+	// NextID returns the row ID of a new row of tableName owned by owner,
+	// which is to hold value.
+	NextID(db kvs.KVDB, owner kvs.UUID, tableName string, value any) (kvs.RowID, error)
+}
+
+// ErrRowExists is returned when saving a new row under a natural key
+// another row already has.
+var ErrRowExists = errors.New("row already exists")
+
+// idGenerators holds the generator of each table of a Store.
+type idGenerators struct {
+	fallback IDGenerator
+	tables   map[string]IDGenerator
+}
+
+func (g idGenerators) forTable(tableName string) IDGenerator {
+	if ids, ok := g.tables[tableName]; ok {
+		return ids
+	}
+	return g.fallback
+}
+
+// close closes each generator which is an io.Closer once, however many
+// tables share it.
+func (g idGenerators) close() error {
+	closed := map[IDGenerator]struct{}{}
+	errs := []error{}
+	for _, ids := range append([]IDGenerator{g.fallback}, values(g.tables)...) {
+		c, ok := ids.(io.Closer)
+		if _, done := closed[ids]; !ok || done {
+			continue
+		}
+		closed[ids] = struct{}{}
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func values[K comparable, V any](m map[K]V) []V {
+	vs := make([]V, 0, len(m))
+	for _, v := range m {
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// isNatural reports whether ids takes row IDs from the rows themselves, so
+// that a new row may collide with one already stored.
+func isNatural(ids IDGenerator) bool {
+	_, ok := ids.(naturalKeys)
+	return ok
+}
+
+type uuidV7IDs struct{}
+
+// UUIDv7IDs identifies rows by version 7 UUIDs, which begin with the time
+// they were made, so rows sort roughly in the order they were saved. They
+// can be loaded into ID fields of type uuid.UUID or string.
+func UUIDv7IDs() IDGenerator {
+	return uuidV7IDs{}
+}
+
+func (uuidV7IDs) NextID(kvs.KVDB, kvs.UUID, string, any) (kvs.RowID, error) {
+	id := uuid.UUID{}
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(id[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:], uint32(ms))
+	id[6] = id[6]&0x0f | 0x70 // version 7
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return kvs.RowID(id.String()), nil
+}
+
+// ulidIDs hands out ULIDs, incrementing the random part of the last one
+// for IDs made within the same millisecond, so that they always ascend.
+type ulidIDs struct {
+	mu   sync.Mutex
+	ms   uint64
+	last [10]byte
+}
+
+// ULIDs identifies rows by ULIDs, 26 characters which sort in the order
+// they were made. They can be loaded into ID fields of type string, or of
+// any ULID type which unmarshals itself from text.
+func ULIDs() IDGenerator {
+	return &ulidIDs{}
+}
+
+func (u *ulidIDs) NextID(kvs.KVDB, kvs.UUID, string, any) (kvs.RowID, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+	if ms > u.ms {
+		u.ms = ms
+		if _, err := rand.Read(u.last[:]); err != nil {
+			return "", err
+		}
+	} else if !increment(u.last[:]) {
+		return "", errors.New("too many ULIDs made within a millisecond")
+	}
+
+	id := [16]byte{}
+	binary.BigEndian.PutUint16(id[0:], uint16(u.ms>>32))
+	binary.BigEndian.PutUint32(id[2:], uint32(u.ms))
+	copy(id[6:], u.last[:])
+	return kvs.RowID(encodeULID(id)), nil
+}
+
+// increment adds one to the big-endian number b, reporting false if it
+// overflows.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeULID writes the 128 bits of id as 26 Crockford base32 characters,
+// the first of which holds only the top three bits.
+func encodeULID(id [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	text := make([]byte, 26)
+	for i := len(text) - 1; i >= 0; i-- {
+		text[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(text)
+}
+
+type naturalKeys struct{}
+
+// NaturalKeys identifies rows by the value of the field declared with the
+// key tag option, such as `mdb:"key"`, so that rows are looked up by what
+// they hold. Saving a second row with the same key returns ErrRowExists.
+func NaturalKeys() IDGenerator {
+	return naturalKeys{}
+}
+
+func (naturalKeys) NextID(_ kvs.KVDB, _ kvs.UUID, tableName string, value any) (kvs.RowID, error) {
+	id, ok, err := kvs.KeyOf(value)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%s rows have no field tagged as their key", tableName)
+	}
+	return id, nil
+}
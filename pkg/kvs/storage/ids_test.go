@@ -0,0 +1,211 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+type Event struct {
+	ID   uuid.UUID `mdb:"ignore"`
+	Kind string
+}
+
+func (e Event) TableName() string { return "events" }
+
+type Reading64 struct {
+	ID    uint64 `mdb:"ignore"`
+	Value int
+}
+
+func (r Reading64) TableName() string { return "readings64" }
+
+type Member struct {
+	Email string `mdb:"key"`
+	Name  string
+}
+
+func (m Member) TableName() string { return "members" }
+
+type Visit struct {
+	ID   string `mdb:"ignore"`
+	Page string
+}
+
+func (v Visit) TableName() string { return "visits" }
+
+func TestSequenceIDsLeaseBandwidthAtOnce(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithIDs(storage.SequenceIDs(10)))
+	for i := 0; i < 3; i++ {
+		b := Balloon{Size: i}
+		is.NoErr(store.Save(kvs.RootOwner{}, &b))
+		is.Equal(b.ID, uint32(i))
+	}
+
+	// a lease of ten was taken, but closing hands back what wasn't used
+	is.NoErr(store.Close())
+	next := storage.New(db)
+	defer next.Close()
+	b := Balloon{}
+	is.NoErr(next.Save(kvs.RootOwner{}, &b))
+	is.Equal(b.ID, uint32(3))
+}
+
+func TestUint64AndUUIDAndULIDRowIDs(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db,
+		storage.WithTableIDs("readings64", storage.Uint64IDs(1)),
+		storage.WithTableIDs("events", storage.UUIDv7IDs()),
+		storage.WithTableIDs("visits", storage.ULIDs()),
+	)
+	defer store.Close()
+
+	r := Reading64{Value: 7}
+	is.NoErr(store.Save(kvs.RootOwner{}, &r))
+	is.Equal(r.ID, uint64(0))
+
+	events := []Event{{Kind: "signup"}, {Kind: "login"}, {Kind: "logout"}}
+	for i := range events {
+		is.NoErr(store.Save(kvs.RootOwner{}, &events[i]))
+		is.Equal(events[i].ID.Version(), uuid.Version(7))
+	}
+
+	visits := []storage.Value{&Visit{Page: "/"}, &Visit{Page: "/about"}, &Visit{Page: "/"}}
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, visits))
+	ids := []string{}
+	for _, v := range visits {
+		ids = append(ids, v.(*Visit).ID)
+	}
+	is.Equal(len(ids[0]), 26)
+	is.True(sort.StringsAreSorted(ids)) // ULIDs ascend in the order they're made
+
+	loaded := Event{}
+	is.NoErr(storage.LoadByID(store, &loaded, kvs.RootOwner{}, kvs.RowID(events[1].ID.String())))
+	is.Equal(loaded, events[1])
+
+	// IDs which aren't numbers are sorted by their text, which for UUIDv7s
+	// made in different milliseconds is the order they were made in
+	all, err := storage.LoadAll[Event](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(all), 3)
+
+	vs, err := storage.LoadManyByID[Visit](store, kvs.RootOwner{}, []kvs.RowID{kvs.RowID(ids[2]), kvs.RowID(ids[0])})
+	is.NoErr(err)
+	is.Equal(vs, []Visit{{ID: ids[2], Page: "/"}, {ID: ids[0], Page: "/"}})
+
+	is.NoErr(store.UpdateByID(kvs.RootOwner{}, &Visit{Page: "/contact"}, kvs.RowID(ids[1])))
+	is.NoErr(store.DeleteByID(kvs.RootOwner{}, &Visit{}, kvs.RowID(ids[0])))
+	vs, err = storage.LoadAll[Visit](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(vs, []Visit{{ID: ids[1], Page: "/contact"}, {ID: ids[2], Page: "/"}})
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 0)
+}
+
+func TestNaturalKeysIdentifyRowsByTheirTaggedField(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithTableIDs("members", storage.NaturalKeys()))
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Member{Email: "amy@pond.example", Name: "Amy"}))
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, []storage.Value{&Member{Email: "rory@pond.example", Name: "Rory"}}))
+
+	err = store.Save(kvs.RootOwner{}, &Member{Email: "amy@pond.example", Name: "Impostor"})
+	is.True(errors.Is(err, storage.ErrRowExists))
+	err = store.SaveMany(kvs.RootOwner{}, []storage.Value{&Member{Email: "river@song.example"}, &Member{Email: "river@song.example"}})
+	is.True(errors.Is(err, storage.ErrRowExists))
+
+	loaded := Member{}
+	is.NoErr(storage.LoadByID(store, &loaded, kvs.RootOwner{}, "amy@pond.example"))
+	is.Equal(loaded, Member{Email: "amy@pond.example", Name: "Amy"})
+
+	// dots in keys are escaped, so they can't be mistaken for separators
+	keys := []string{}
+	is.NoErr(db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek([]byte("members.name.")); it.ValidForPrefix([]byte("members.name.")); it.Next() {
+			keys = append(keys, string(it.Item().Key()))
+		}
+		return nil
+	}))
+	is.Equal(keys, []string{"members.name.root.~amy@pond%2Eexample", "members.name.root.~rory@pond%2Eexample"})
+
+	err = storage.New(db, storage.WithIDs(storage.NaturalKeys())).Save(kvs.RootOwner{}, &Balloon{})
+	is.Equal(err.Error(), "balloons rows have no field tagged as their key")
+}
+
+func TestIDsMustFitTheIDField(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithIDs(storage.UUIDv7IDs()))
+	defer store.Close()
+
+	err = store.Save(kvs.RootOwner{}, &Balloon{Color: "RED"})
+	is.True(strings.Contains(err.Error(), "does not fit uint32"))
+
+	// nothing is written for a row whose ID can't be loaded
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bs), 0)
+}
@@ -0,0 +1,445 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+)
+
+// WithIndex loads only the rows whose value of the given column equals one
+// of the values given, finding them through the column's index rather than
+// by scanning. The column must be declared with the index tag option. The
+// index is built from the values already stored the first time it's used,
+// and the column is scanned instead until it's been built.
+func WithIndex(column string, values ...any) LoadOption {
+	return func(o *loadOptions) {
+		o.index = &indexLookup{column: lowerAll([]string{column})[0], values: values}
+	}
+}
+
+type indexLookup struct {
+	column string
+	values []any
+}
+
+// The states recorded under an index's kvs.IndexStateKey. Once building,
+// every write of the column indexes its value, whether or not the type
+// written declares the index. Once ready, every value stored before then
+// has been indexed too, so lookups can rely on the index alone.
+var (
+	indexBuilding = []byte("building")
+	indexReady    = []byte("ready")
+)
+
+// indexState reads the state of a column's index, or nil if its values
+// have never been indexed.
+func indexState(txn *badger.Txn, tableName, columnName string) ([]byte, error) {
+	item, err := txn.Get(kvs.IndexStateKey(tableName, columnName))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// keptIndexes adds the columns of a table whose index has a state to the
+// given set, so that writes keep them whether or not the type written
+// declares them indexed.
+func keptIndexes(txn *badger.Txn, tableName string, indexed map[string]struct{}) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := kvs.IndexTablePrefix(tableName)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); {
+		column, rest, _ := strings.Cut(string(it.Item().Key()[len(prefix):]), "!")
+		if rest == "" {
+			indexed[tableName+"."+column] = struct{}{}
+		}
+		// every other key of the column is one of its index keys
+		it.Seek(append(kvs.IndexColumnPrefix(tableName, column), 0xff))
+	}
+	return nil
+}
+
+// KeepIndexes writes the index keys of those of entries' columns whose
+// index has been started, replacing those of the values they overwrite.
+// Rows written other than through a Store must call it in the transaction
+// writing them, before they're written, so lookups through the index find
+// them.
+func KeepIndexes(txn *badger.Txn, entries []kvs.Entry) error {
+	indexed := map[string]struct{}{}
+	tables := map[string]struct{}{}
+	for _, e := range entries {
+		if _, ok := tables[e.TableName]; ok {
+			continue
+		}
+		tables[e.TableName] = struct{}{}
+		if err := keptIndexes(txn, e.TableName, indexed); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if _, ok := indexed[e.TableName+"."+e.ColumnName]; ok {
+			if err := reindex(txn, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndex indexes every value stored for a column whose index isn't
+// ready, such as those saved before it was declared with the index tag
+// option or written other than through a Store, then marks it ready. It's
+// marked as building first, so that every write made while the stored
+// values are read indexes itself.
+func buildIndex(s Store, tableName, columnName string) error {
+	key := kvs.IndexStateKey(tableName, columnName)
+	ready := false
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		state, err := indexState(txn, tableName, columnName)
+		if err != nil {
+			return err
+		}
+		if ready = bytes.Equal(state, indexReady); ready || state != nil {
+			return nil
+		}
+		return txn.Set(key, indexBuilding)
+	}); err != nil || ready {
+		return err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	if err := s.db.View(func(txn *badger.Txn) error {
+		rows, err := loadRows(txn, tableName, kvs.AnyOwner{}, []string{columnName}, nil)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if e, ok := row.Entries[columnName]; ok {
+				if err := wb.Set(kvs.IndexKey(e), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, indexReady)
+	})
+}
+
+// ensureIndex builds the index of the given column of t's table, unless
+// it's ready already. Lookups don't need it to be, so losing a race to
+// build it is no error.
+func ensureIndex(s Store, t reflect.Type, columnName string) error {
+	v, ok := reflect.New(t).Elem().Interface().(Value)
+	if !ok {
+		return fmt.Errorf("%s does not implement storage.Value", t)
+	}
+	column, _, err := indexedColumn(v.TableName(), t, columnName)
+	if err != nil {
+		return err
+	}
+	if err := buildIndex(s, v.TableName(), column.Name); err != nil && !errors.Is(err, badger.ErrConflict) {
+		return err
+	}
+	return nil
+}
+
+// indexedColumns adds the indexed columns of a table to the given set,
+// keyed by the table and column name.
+func indexedColumns(set map[string]struct{}, tableName string, columns []kvs.Column) {
+	for _, c := range columns {
+		if c.Indexed {
+			set[tableName+"."+c.Name] = struct{}{}
+		}
+	}
+}
+
+// reindex replaces the index key of the value an entry overwrites with one
+// for the entry's own value.
+func reindex(txn *badger.Txn, e kvs.Entry) error {
+	old, err := getEntry(txn, e)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if err == nil {
+		if err := txn.Delete(kvs.IndexKey(old)); err != nil {
+			return err
+		}
+	}
+	return txn.Set(kvs.IndexKey(e), nil)
+}
+
+// unindex removes the index key of the value stored for an entry's
+// column, if it has one.
+func unindex(txn *badger.Txn, e kvs.Entry) error {
+	old, err := getEntry(txn, e)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+	return txn.Delete(kvs.IndexKey(old))
+}
+
+// indexKeys lists the index keys of the stored values of the given
+// entries, for those of their columns which are indexed.
+func indexKeys(txn *badger.Txn, entries []kvs.Entry, indexed map[string]struct{}) ([][]byte, error) {
+	keys := [][]byte{}
+	for _, e := range entries {
+		if _, ok := indexed[e.TableName+"."+e.ColumnName]; !ok {
+			continue
+		}
+		stored, err := getEntry(txn, e)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, kvs.IndexKey(stored))
+	}
+	return keys, nil
+}
+
+// getEntry reads the value stored for an entry's column, from its row's
+// row key or from its own key.
+func getEntry(txn *badger.Txn, e kvs.Entry) (kvs.Entry, error) {
+	stored, err := loadRow(txn, e, []string{e.ColumnName}, nil)
+	if err != nil {
+		return kvs.Entry{}, err
+	}
+	found, ok := stored[e.ColumnName]
+	if !ok {
+		return kvs.Entry{}, badger.ErrKeyNotFound
+	}
+	return found, nil
+}
+
+// getColumn reads the value stored under an entry's own key.
+func getColumn(txn *badger.Txn, e kvs.Entry) (kvs.Entry, error) {
+	item, err := txn.Get(e.Key())
+	if err != nil {
+		return kvs.Entry{}, err
+	}
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return kvs.Entry{}, err
+	}
+	e.Data = data
+	e.Meta = item.UserMeta()
+	return e, nil
+}
+
+// indexValue encodes a value the way it is stored in the given field type,
+// so it can be found in the field's index. It reports false if the value
+// can't be held by the field without loss.
+func indexValue(t reflect.Type, v any) ([]byte, byte, bool) {
+	data, meta, err := codec.Encode(v)
+	if err != nil {
+		return nil, 0, false
+	}
+	dest := reflect.New(t)
+	if err := codec.Decode(data, meta, dest.Interface()); err != nil {
+		return nil, 0, false
+	}
+	if data, meta, err = codec.Encode(dest.Elem().Interface()); err != nil {
+		return nil, 0, false
+	}
+	return data, meta, true
+}
+
+// indexedColumn finds the column of t declared with the index tag option
+// under the given name, along with the type of its field.
+func indexedColumn(tableName string, t reflect.Type, columnName string) (kvs.Column, reflect.Type, error) {
+	all, err := kvs.Columns(t)
+	if err != nil {
+		return kvs.Column{}, nil, err
+	}
+	for _, c := range all {
+		if c.Name == columnName && c.Indexed {
+			return c, t.FieldByIndex(c.Field).Type, nil
+		}
+	}
+	return kvs.Column{}, nil, fmt.Errorf("%s column %q is not indexed", tableName, columnName)
+}
+
+// indexedValue is a value looked up through an index, encoded as stored.
+type indexedValue struct {
+	data []byte
+	meta byte
+}
+
+func (v indexedValue) matches(e kvs.Entry) bool {
+	return e.Meta == v.meta && bytes.Equal(e.Data, v.data)
+}
+
+// lookupRows loads the rows of a table holding any of the values of an
+// index lookup, through the index if it's ready and by scanning the
+// column otherwise.
+func lookupRows(txn *badger.Txn, tableName string, owner kvs.UUID, t reflect.Type, lookup indexLookup, columns []string, stats *ScanStats) ([]Row, error) {
+	column, fieldType, err := indexedColumn(tableName, t, lookup.column)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]indexedValue, 0, len(lookup.values))
+	for _, v := range lookup.values {
+		if data, meta, ok := indexValue(fieldType, v); ok {
+			values = append(values, indexedValue{data: data, meta: meta})
+		}
+	}
+
+	state, err := indexState(txn, tableName, column.Name)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(state, indexReady) {
+		return loadIndexedRows(txn, tableName, owner, column.Name, values, columns, stats)
+	}
+
+	selected := false
+	for _, c := range columns {
+		selected = selected || c == column.Name
+	}
+	scanned := columns
+	if !selected {
+		scanned = append(append([]string{}, columns...), column.Name)
+	}
+	rows, err := loadRows(txn, tableName, owner, scanned, stats)
+	if err != nil {
+		return nil, err
+	}
+	found := rows[:0]
+	for _, row := range rows {
+		e, ok := row.Entries[column.Name]
+		if !ok {
+			continue
+		}
+		for _, v := range values {
+			if v.matches(e) {
+				if !selected {
+					delete(row.Entries, column.Name)
+				}
+				found = append(found, row)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// loadIndexedRows looks up the rows of a table holding any of the given
+// values in a column whose index is ready, reading each of the given
+// columns of those rows directly rather than scanning them.
+func loadIndexedRows(txn *badger.Txn, tableName string, owner kvs.UUID, columnName string, values []indexedValue, columns []string, stats *ScanStats) ([]Row, error) {
+	rows := map[rowKey]*Row{}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	// index keys hold a hash of the value, so each row found is checked
+	// against the value it was found by
+	type indexRef struct {
+		row   kvs.Entry
+		value indexedValue
+	}
+	refs := []indexRef{}
+	for _, v := range values {
+		prefix := kvs.IndexPrefix(tableName, columnName, owner, v.data, v.meta)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			ref, err := kvs.ParseIndexKey(it.Item().Key())
+			if err != nil {
+				return nil, err
+			}
+			if stats != nil {
+				stats.KeysScanned++
+				stats.BytesRead += len(it.Item().Key())
+			}
+			refs = append(refs, indexRef{row: ref, value: v})
+		}
+	}
+
+	for _, ref := range refs {
+		k := rowKey{owner: ref.row.OwnerUUID.String(), id: ref.row.ResolveRowID()}
+		if _, ok := rows[k]; ok {
+			continue
+		}
+		// an index key can also outlive its value, as deletes which don't
+		// know of the index leave it behind
+		e := ref.row
+		e.ColumnName = columnName
+		stored, err := getEntry(txn, e)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if !ref.value.matches(stored) {
+			continue
+		}
+
+		e.ColumnName = ""
+		entries, err := loadRow(txn, e, columns, stats)
+		if err != nil {
+			return nil, err
+		}
+		row := newRow(ref.row)
+		row.Entries = entries
+		rows[k] = row
+	}
+	return sortRows(rows), nil
+}
@@ -0,0 +1,414 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// Layout is how the rows of a table are stored.
+type Layout int
+
+const (
+	// ColumnMajor stores each column of a row under its own
+	// table.column.owner.row key, so columns can be scanned on their own.
+	ColumnMajor Layout = iota
+	// RowMajor stores a whole row as a single encoded value under a
+	// table.owner.row key, so a row is read with one key.
+	RowMajor
+)
+
+func (l Layout) String() string {
+	switch l {
+	case ColumnMajor:
+		return "column"
+	case RowMajor:
+		return "row"
+	}
+	return "unknown"
+}
+
+// ParseLayout resolves the name of a layout, column or row.
+func ParseLayout(s string) (Layout, error) {
+	switch strings.ToLower(s) {
+	case ColumnMajor.String():
+		return ColumnMajor, nil
+	case RowMajor.String():
+		return RowMajor, nil
+	}
+	return 0, fmt.Errorf("unknown layout %q, expected column or row", s)
+}
+
+// LayoutValue is implemented by values whose table is stored in a layout
+// other than ColumnMajor. Rows are read whichever layout they were written
+// in, so a table's layout can change before its rows are converted. A row
+// is only ever written in one layout, but should both be found, the row
+// key takes precedence.
+type LayoutValue interface {
+	Value
+	Layout() Layout
+}
+
+func layoutOf(v any) Layout {
+	if lv, ok := v.(LayoutValue); ok {
+		return lv.Layout()
+	}
+	return ColumnMajor
+}
+
+// rowWrite is a row to be written, in the layout of its table.
+type rowWrite struct {
+	row     kvs.Entry // table, owner and row ID of the row
+	value   Value     // the value the row is written from, if it has one
+	columns []string  // every column of the row's type
+	entries []kvs.Entry
+	cleared []string // columns of an updated row to remove
+	layout  Layout
+	update  bool
+	unique  bool // fail if anything is stored for the row already
+}
+
+// writeRow writes a row in its layout, updating the indexes of indexed
+// columns. Updated rows keep the stored values of columns not written, as
+// they always have column by column, and are moved out of the other
+// layout if they were stored in it.
+func writeRow(txn *badger.Txn, w rowWrite, indexed map[string]struct{}) error {
+	for _, e := range w.entries {
+		if _, ok := indexed[e.TableName+"."+e.ColumnName]; ok {
+			if err := reindex(txn, e); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range w.cleared {
+		if _, ok := indexed[w.row.TableName+"."+c]; ok {
+			e := w.row
+			e.ColumnName = c
+			if err := unindex(txn, e); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.layout == RowMajor {
+		return writeRowMajor(txn, w)
+	}
+
+	if w.update {
+		if err := unpackRow(txn, w.row, w.entries); err != nil {
+			return err
+		}
+	}
+	for _, e := range w.entries {
+		if err := txn.SetEntry(badger.NewEntry(e.Key(), e.Data).WithMeta(e.Meta)); err != nil {
+			return err
+		}
+	}
+	for _, c := range w.cleared {
+		e := w.row
+		e.ColumnName = c
+		if err := txn.Delete(e.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRowMajor(txn *badger.Txn, w rowWrite) error {
+	merged := map[string]kvs.Entry{}
+	if w.update {
+		stored, err := readRow(txn, w.row, nil)
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			merged = stored
+		}
+		for _, c := range w.columns {
+			e := w.row
+			e.ColumnName = c
+			stored, err := getColumn(txn, e)
+			if err != nil {
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					continue
+				}
+				return err
+			}
+			merged[c] = stored
+			if err := txn.Delete(e.Key()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range w.entries {
+		merged[e.ColumnName] = e
+	}
+	for _, c := range w.cleared {
+		delete(merged, c)
+	}
+
+	entries := make([]kvs.Entry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ColumnName < entries[j].ColumnName })
+
+	return txn.Set(kvs.RowKey(w.row), kvs.EncodeRow(entries))
+}
+
+// newRowEntries returns everything to write for a row which has never been
+// stored, including the index keys of its indexed columns. Unlike
+// writeRow, nothing is read first, so it can be written by a write batch.
+func newRowEntries(w rowWrite, indexed map[string]struct{}) []*badger.Entry {
+	written := []*badger.Entry{}
+	for _, e := range w.entries {
+		if _, ok := indexed[e.TableName+"."+e.ColumnName]; ok {
+			written = append(written, badger.NewEntry(kvs.IndexKey(e), nil))
+		}
+	}
+
+	if w.layout == RowMajor {
+		entries := append([]kvs.Entry{}, w.entries...)
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ColumnName < entries[j].ColumnName })
+		return append(written, badger.NewEntry(kvs.RowKey(w.row), kvs.EncodeRow(entries)))
+	}
+	for _, e := range w.entries {
+		written = append(written, badger.NewEntry(e.Key(), e.Data).WithMeta(e.Meta))
+	}
+	return written
+}
+
+// unpackRow moves a row stored under a row key into column keys, leaving
+// out the given entries about to be written in its place.
+func unpackRow(txn *badger.Txn, row kvs.Entry, entries []kvs.Entry) error {
+	stored, err := readRow(txn, row, nil)
+	if err != nil || stored == nil {
+		return err
+	}
+	for _, e := range entries {
+		delete(stored, e.ColumnName)
+	}
+	for _, e := range stored {
+		if err := txn.SetEntry(badger.NewEntry(e.Key(), e.Data).WithMeta(e.Meta)); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(kvs.RowKey(row))
+}
+
+// readRow reads the columns of a row stored under its row key, keyed by
+// column name. It returns nil if the row has no row key.
+func readRow(txn *badger.Txn, row kvs.Entry, stats *ScanStats) (map[string]kvs.Entry, error) {
+	key := kvs.RowKey(row)
+	item, err := txn.Get(key)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	if stats != nil {
+		stats.KeysScanned++
+		stats.BytesRead += len(key) + len(data)
+	}
+
+	entries, err := kvs.DecodeRow(row, data)
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]kvs.Entry, len(entries))
+	for _, e := range entries {
+		columns[e.ColumnName] = e
+	}
+	return columns, nil
+}
+
+// loadRow reads the given columns of a row, from the row's row key or
+// from their own keys, whichever layout they're stored in. Columns with no
+// value stored are left out.
+func loadRow(txn *badger.Txn, row kvs.Entry, columns []string, stats *ScanStats) (map[string]kvs.Entry, error) {
+	stored, err := readRow(txn, row, stats)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]kvs.Entry, len(columns))
+	for _, c := range columns {
+		if found, ok := stored[c]; ok {
+			entries[c] = found
+			continue
+		}
+
+		e := row
+		e.ColumnName = c
+		found, err := getColumn(txn, e)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if stats != nil {
+			stats.KeysScanned++
+			stats.BytesRead += len(found.Key()) + len(found.Data)
+		}
+		entries[c] = found
+	}
+	return entries, nil
+}
+
+// ConvertTable rewrites every row of a table, across all owners, in the
+// given layout, returning how many rows it moved. Rows are written in
+// batches rather than a single transaction, so nothing else should write
+// to the table while it runs.
+func ConvertTable(s Store, tableName string, layout Layout) (int, error) {
+	type pending struct {
+		row     kvs.Entry
+		entries []kvs.Entry
+		keys    [][]byte
+	}
+	rows := map[rowKey]*pending{}
+	order := []rowKey{}
+
+	prefix := []byte(tableName + ".")
+	if err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			row, err := kvs.ParseRowKey(item.Key())
+			isRow := err == nil
+			if !isRow {
+				if row, err = kvs.ParseKey(item.Key()); err != nil {
+					continue
+				}
+			}
+			// only rows stored in the other layout are moved
+			if isRow == (layout == RowMajor) {
+				continue
+			}
+
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			k := rowKey{owner: row.OwnerUUID.String(), id: row.ResolveRowID()}
+			p, ok := rows[k]
+			if !ok {
+				p = &pending{row: kvs.Entry{TableName: tableName, OwnerUUID: row.OwnerUUID, RowID: row.RowID, TextID: row.TextID}}
+				rows[k] = p
+				order = append(order, k)
+			}
+			p.keys = append(p.keys, item.KeyCopy(nil))
+
+			if !isRow {
+				row.Data = data
+				row.Meta = item.UserMeta()
+				p.entries = append(p.entries, row)
+				continue
+			}
+			entries, err := kvs.DecodeRow(p.row, data)
+			if err != nil {
+				return err
+			}
+			p.entries = append(p.entries, entries...)
+		}
+
+		if layout != RowMajor {
+			return nil
+		}
+		// columns being packed join any stored under the row key already,
+		// which take precedence
+		for _, k := range order {
+			p := rows[k]
+			stored, err := readRow(txn, p.row, nil)
+			if err != nil {
+				return err
+			}
+			if stored == nil {
+				continue
+			}
+			for _, e := range p.entries {
+				if _, ok := stored[e.ColumnName]; !ok {
+					stored[e.ColumnName] = e
+				}
+			}
+			p.entries = p.entries[:0]
+			for _, e := range stored {
+				p.entries = append(p.entries, e)
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range order {
+		p := rows[k]
+		for _, key := range p.keys {
+			if err := wb.Delete(key); err != nil {
+				return 0, err
+			}
+		}
+		if layout == RowMajor {
+			sort.Slice(p.entries, func(i, j int) bool { return p.entries[i].ColumnName < p.entries[j].ColumnName })
+			if err := wb.Set(kvs.RowKey(p.row), kvs.EncodeRow(p.entries)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		for _, e := range p.entries {
+			if err := wb.SetEntry(badger.NewEntry(e.Key(), e.Data).WithMeta(e.Meta)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(order), nil
+}
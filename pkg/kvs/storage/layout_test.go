@@ -0,0 +1,209 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+type Reading struct {
+	ID      uint32 `mdb:"ignore"`
+	Sensor  uuid.UUID
+	Station string `mdb:"index"`
+	Value   float64
+	Unit    string `mdb:"readonly"`
+	Note    string `mdb:"omitempty"`
+}
+
+func (r Reading) TableName() string { return "readings" }
+
+// PackedReading stores the rows of the readings table row by row.
+type PackedReading Reading
+
+func (r PackedReading) TableName() string      { return "readings" }
+func (r PackedReading) Layout() storage.Layout { return storage.RowMajor }
+
+// storedKeys lists every key stored under the given prefix, other than
+// index keys.
+func storedKeys(db kvs.KVDB, prefix string) []string {
+	keys := []string{}
+	db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte(prefix)})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Item().Key()))
+		}
+		return nil
+	})
+	return keys
+}
+
+func TestRowMajorTablesStoreEachRowUnderOneKey(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	sensor := uuid.New()
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedReading{Sensor: sensor, Station: "north", Value: 21.5, Unit: "C"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedReading{Station: "south", Value: 19, Unit: "C", Note: "shaded"}))
+	is.Equal(storedKeys(db, "readings."), []string{"readings.root.0", "readings.root.1"})
+
+	loaded := PackedReading{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, PackedReading{Sensor: sensor, Station: "north", Value: 21.5, Unit: "C"})
+
+	readings, err := storage.LoadAll[PackedReading](store, kvs.RootOwner{}, storage.WithColumns("value", "note"))
+	is.NoErr(err)
+	is.Equal(readings, []PackedReading{{ID: 0, Value: 21.5}, {ID: 1, Value: 19, Note: "shaded"}})
+
+	readings, err = storage.LoadAll[PackedReading](store, kvs.RootOwner{}, storage.WithIndex("station", "south"))
+	is.NoErr(err)
+	is.Equal(len(readings), 1)
+	is.Equal(readings[0].ID, uint32(1))
+
+	columns, err := storage.TableColumns(store, "readings", kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(columns), 5)
+
+	// updates keep readonly and omitted columns, as they do column by column
+	is.NoErr(store.Update(kvs.RootOwner{}, &PackedReading{Station: "east", Value: 18, Unit: "F"}, 1))
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 1))
+	is.Equal(loaded, PackedReading{ID: 1, Station: "east", Value: 18, Unit: "C", Note: "shaded"})
+
+	readings, err = storage.LoadAll[PackedReading](store, kvs.RootOwner{}, storage.WithIndex("station", "south"))
+	is.NoErr(err)
+	is.Equal(len(readings), 0)
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &PackedReading{}, 1))
+	is.Equal(storedKeys(db, "readings."), []string{"readings.root.0"})
+	is.Equal(storedKeys(db, "!index!readings!")[0], "!index!readings!station!") // the index's state
+	is.Equal(len(storedKeys(db, "!index!readings!")), 2)
+
+	// a UUID held in a packed row is only a reference, so its rows stay
+	is.NoErr(store.Save(sensor, &PackedReading{Station: "north", Value: 3}))
+	is.NoErr(store.DeleteCascade(kvs.RootOwner{}, &PackedReading{}, 0))
+	is.Equal(storedKeys(db, "readings."), []string{"readings." + sensor.String() + ".0"})
+}
+
+func TestBothLayoutsAreReadTransparently(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Reading{Station: "north", Value: 21.5, Unit: "C"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedReading{Station: "south", Value: 19, Unit: "C"}))
+
+	readings, err := storage.LoadAll[Reading](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(readings, []Reading{{ID: 0, Station: "north", Value: 21.5, Unit: "C"}, {ID: 1, Station: "south", Value: 19, Unit: "C"}})
+
+	rows, err := storage.LoadRows(store, "readings", kvs.AnyOwner{}, "station")
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+	is.Equal(len(rows[1].Entries), 1)
+
+	// updating a row moves it into the layout of the value written
+	is.NoErr(store.Update(kvs.RootOwner{}, &PackedReading{Station: "north", Value: 22}, 0))
+	is.Equal(storedKeys(db, "readings."), []string{"readings.root.0", "readings.root.1"})
+	is.NoErr(store.Update(kvs.RootOwner{}, &Reading{Station: "south", Value: 20}, 1))
+	is.Equal(len(storedKeys(db, "readings.")), 5)
+
+	readings, err = storage.LoadAll[Reading](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(readings, []Reading{{ID: 0, Station: "north", Value: 22, Unit: "C"}, {ID: 1, Station: "south", Value: 20, Unit: "C"}})
+}
+
+func TestConvertTableBetweenLayouts(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	owner := uuid.New()
+	is.NoErr(store.Save(kvs.RootOwner{}, &Reading{Station: "north", Value: 21.5, Unit: "C"}))
+	is.NoErr(store.Save(owner, &Reading{Station: "south", Value: 19, Unit: "C", Note: "shaded"}))
+	before, err := storage.LoadAll[Reading](store, kvs.AnyOwner{})
+	is.NoErr(err)
+
+	converted, err := storage.ConvertTable(store, "readings", storage.RowMajor)
+	is.NoErr(err)
+	is.Equal(converted, 2)
+	is.Equal(storedKeys(db, "readings."), []string{"readings." + owner.String() + ".0", "readings.root.0"})
+
+	after, err := storage.LoadAll[Reading](store, kvs.AnyOwner{})
+	is.NoErr(err)
+	is.Equal(after, before)
+
+	converted, err = storage.ConvertTable(store, "readings", storage.RowMajor)
+	is.NoErr(err)
+	is.Equal(converted, 0)
+
+	converted, err = storage.ConvertTable(store, "readings", storage.ColumnMajor)
+	is.NoErr(err)
+	is.Equal(converted, 2)
+	is.Equal(len(storedKeys(db, "readings.")), 9)
+
+	after, err = storage.LoadAll[Reading](store, kvs.AnyOwner{})
+	is.NoErr(err)
+	is.Equal(after, before)
+
+	// fsck reads both layouts alike
+	for _, layout := range []storage.Layout{storage.RowMajor, storage.ColumnMajor} {
+		_, err = storage.ConvertTable(store, "readings", layout)
+		is.NoErr(err)
+		report, err := kvs.Check(db)
+		is.NoErr(err)
+		is.Equal(len(report.Problems), 2)
+		is.Equal(report.Problems[0].String(), "partial row: readings.root.0 lacks note, which other rows hold")
+		is.Equal(report.Problems[1].Kind, kvs.OrphanedOwner)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// LoadOption adjusts how rows are read by Load and LoadAll.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	columns       []string
+	filterColumns []string
+	eager         []string
+	index         *indexLookup
+	rowIDs        []kvs.RowID
+	stats         *ScanStats
+}
+
+// WithColumns limits loading to the named columns. Every other field of
+// the destination value is left as its zero value.
+func WithColumns(columns ...string) LoadOption {
+	return func(o *loadOptions) {
+		o.columns = append(o.columns, lowerAll(columns)...)
+	}
+}
+
+// WithFilterColumns names columns which must be scanned so that an evaluator
+// can inspect them, without loading them into the destination unless they
+// are also selected with WithColumns.
+func WithFilterColumns(columns ...string) LoadOption {
+	return func(o *loadOptions) {
+		o.filterColumns = append(o.filterColumns, lowerAll(columns)...)
+	}
+}
+
+// WithScanStats adds the keys and bytes read while loading to the given stats.
+func WithScanStats(stats *ScanStats) LoadOption {
+	return func(o *loadOptions) {
+		o.stats = stats
+	}
+}
+
+// WithEager fills the named relationship fields, declared with an mdb tag
+// such as `mdb:"children=cake"`, with the child rows each loaded row owns.
+func WithEager(relations ...string) LoadOption {
+	return func(o *loadOptions) {
+		o.eager = append(o.eager, lowerAll(relations)...)
+	}
+}
+
+func resolveLoadOptions(opts []LoadOption) loadOptions {
+	o := loadOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// SaveOption adjusts how rows are written by Save.
+type SaveOption func(*saveOptions)
+
+type saveOptions struct {
+	cascade bool
+	update  bool
+	unique  bool // the row ID is a natural key another row may have
+}
+
+// WithCascade also saves the child rows held by the value's relationship
+// fields, owned by the value's UUID and within the same transaction.
+func WithCascade() SaveOption {
+	return func(o *saveOptions) {
+		o.cascade = true
+	}
+}
+
+func resolveSaveOptions(opts []SaveOption) saveOptions {
+	o := saveOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// StoreOption adjusts how a Store created by New behaves.
+type StoreOption func(*storeOptions)
+
+type storeOptions struct {
+	ids       IDGenerator
+	tableIDs  map[string]IDGenerator
+	cacheRows int
+}
+
+// WithIDs hands out the row IDs of new rows of every table with the given
+// generator, rather than numbering them with SequenceIDs(1).
+func WithIDs(ids IDGenerator) StoreOption {
+	return func(o *storeOptions) {
+		o.ids = ids
+	}
+}
+
+// WithTableIDs hands out the row IDs of new rows of the named table with
+// the given generator, whichever the store's other tables use.
+func WithTableIDs(tableName string, ids IDGenerator) StoreOption {
+	return func(o *storeOptions) {
+		if o.tableIDs == nil {
+			o.tableIDs = map[string]IDGenerator{}
+		}
+		o.tableIDs[tableName] = ids
+	}
+}
+
+// WithRowCache keeps up to the given number of the rows most recently read
+// by Load in memory, so that reading them again reads nothing stored. New
+// waits until the cache hears every write committed, through whichever
+// connection, so none made once it returns are missed. See
+// Store.CacheStats for how well it is doing.
+func WithRowCache(rows int) StoreOption {
+	return func(o *storeOptions) {
+		o.cacheRows = rows
+	}
+}
+
+func resolveStoreOptions(opts []StoreOption) storeOptions {
+	o := storeOptions{ids: SequenceIDs(1)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// project narrows the given blank entries down to those which need to be
+// scanned, returning them alongside the set of columns to load.
+func (o loadOptions) project(blankEntries []kvs.Entry) ([]kvs.Entry, map[string]struct{}, error) {
+	known := map[string]struct{}{}
+	for _, e := range blankEntries {
+		known[e.ColumnName] = struct{}{}
+	}
+
+	loaded := map[string]struct{}{}
+	if len(o.columns) == 0 {
+		loaded = known
+	}
+
+	// a nested struct's name selects each of its sub-columns, while a path
+	// inside a map or slice field selects the field
+	expand := func(c string) ([]string, error) {
+		if _, ok := known[c]; ok {
+			return []string{c}, nil
+		}
+		expanded := []string{}
+		for _, e := range blankEntries {
+			if strings.HasPrefix(e.ColumnName, c+".") {
+				expanded = append(expanded, e.ColumnName)
+			}
+		}
+		for _, ancestor := range Ancestors(c) {
+			if _, ok := known[ancestor]; ok && len(expanded) == 0 {
+				expanded = append(expanded, ancestor)
+			}
+		}
+		if len(expanded) == 0 {
+			tableName := ""
+			if len(blankEntries) > 0 {
+				tableName = blankEntries[0].TableName
+			}
+			return nil, fmt.Errorf("%s does not have a column named %q", tableName, c)
+		}
+		return expanded, nil
+	}
+
+	scanned := map[string]struct{}{}
+	for _, columns := range [][]string{o.columns, o.filterColumns} {
+		for _, c := range columns {
+			expanded, err := expand(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, ec := range expanded {
+				scanned[ec] = struct{}{}
+			}
+		}
+	}
+	for _, c := range o.columns {
+		expanded, _ := expand(c)
+		for _, ec := range expanded {
+			loaded[ec] = struct{}{}
+		}
+	}
+
+	if len(o.columns) == 0 {
+		return blankEntries, loaded, nil
+	}
+
+	projected := []kvs.Entry{}
+	for _, e := range blankEntries {
+		if _, ok := scanned[e.ColumnName]; ok {
+			projected = append(projected, e)
+		}
+	}
+	return projected, loaded, nil
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// ErrRowNotFound is returned when patching a row which has nothing stored.
+var ErrRowNotFound = errors.New("row not found")
+
+// Patch overwrites only the named columns of the given row with the values
+// value holds for them, leaving every other column as stored, so that it
+// needn't be loaded first. Naming a nested struct selects each of its
+// sub-columns, and an omitempty column patched with its zero value is
+// removed, as though it had been saved that way. Columns declared readonly
+// can't be patched, and the row must already be stored. The value's save
+// hooks run as they do for Update.
+func (s Store) Patch(owner kvs.UUID, value Value, rowID uint32, fields ...string) error {
+	return s.PatchByID(owner, value, kvs.NumericID(uint64(rowID)), fields...)
+}
+
+// PatchByID is Patch for rows with IDs of any kind.
+func (s Store) PatchByID(owner kvs.UUID, value Value, rowID kvs.RowID, fields ...string) error {
+	tableName := value.TableName()
+	columns, err := kvs.Columns(reflect.TypeOf(value))
+	if err != nil {
+		return err
+	}
+	selected, err := selectColumns(tableName, columns, fields)
+	if err != nil {
+		return err
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+
+	indexed := map[string]struct{}{}
+	indexedColumns(indexed, tableName, columns)
+
+	w := rowWrite{
+		row:     kvs.Entry{TableName: tableName, OwnerUUID: owner}.WithRowID(rowID),
+		value:   value,
+		columns: columnNames(columns),
+		layout:  layoutOf(value),
+		update:  true,
+	}
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		if err := checkRowExists(txn, w.row, w.columns); err != nil {
+			return err
+		}
+		if err := beforeSave(value); err != nil {
+			return err
+		}
+
+		entries, err := entriesOf(tableName, owner, rowID, value)
+		if err != nil {
+			return err
+		}
+		unwritten := make(map[string]struct{}, len(selected))
+		for c := range selected {
+			unwritten[c] = struct{}{}
+		}
+		for _, e := range entries {
+			if _, ok := selected[e.ColumnName]; ok {
+				w.entries = append(w.entries, e)
+				delete(unwritten, e.ColumnName)
+			}
+		}
+		// whatever is left was omitted for being empty
+		for _, c := range columns {
+			if _, ok := unwritten[c.Name]; ok {
+				w.cleared = append(w.cleared, c.Name)
+			}
+		}
+
+		if err := kvs.LoadRowID(value, rowID); err != nil {
+			return err
+		}
+		if err := keptIndexes(txn, tableName, indexed); err != nil {
+			return err
+		}
+		if err := writeRow(txn, w, indexed); err != nil {
+			return err
+		}
+		return afterSave(value)
+	}); err != nil {
+		return err
+	}
+
+	s.cache.invalidate(w.row)
+	return nil
+}
+
+// selectColumns resolves the names given to Patch into the set of columns
+// they select.
+func selectColumns(tableName string, columns []kvs.Column, fields []string) (map[string]struct{}, error) {
+	selected := map[string]struct{}{}
+	for _, f := range lowerAll(fields) {
+		found := false
+		for _, c := range columns {
+			if c.Name != f && !strings.HasPrefix(c.Name, f+".") {
+				continue
+			}
+			if c.ReadOnly {
+				return nil, fmt.Errorf("column %q of %s is readonly", c.Name, tableName)
+			}
+			selected[c.Name] = struct{}{}
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("%s does not have a column named %q", tableName, f)
+		}
+	}
+	return selected, nil
+}
+
+// PatchMap overwrites the given columns of a row with the values mapped to
+// them, leaving every other column as stored, for tables with no Go type
+// to hand. Values are converted as inserted documents are, by
+// kvs.MapEntries, so objects are flattened into dotted sub-columns unless
+// they are stored whole and a nil value is stored as null. Strings are
+// stored as text, so codec.InferAll should be used first if their types
+// are to be inferred. Every column must already be stored for some row of
+// the table, and the row itself must already be stored. The row keeps the
+// layout it is stored in, and columns with an index stay indexed.
+func (s Store) PatchMap(tableName string, owner kvs.UUID, rowID uint32, values map[string]any) error {
+	return s.PatchMapByID(tableName, owner, kvs.NumericID(uint64(rowID)), values)
+}
+
+// PatchMapByID is PatchMap for rows with IDs of any kind.
+func (s Store) PatchMapByID(tableName string, owner kvs.UUID, rowID kvs.RowID, values map[string]any) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	row := kvs.Entry{TableName: tableName, OwnerUUID: owner}.WithRowID(rowID)
+	w := rowWrite{row: row, update: true}
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		known := &knownColumns{txn: txn, row: row, found: map[string]bool{}}
+		entries, err := kvs.MapEntries(row, values, known.has)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !known.has(e.ColumnName) {
+				if known.err != nil {
+					return known.err
+				}
+				return fmt.Errorf("%s does not have a column named %q", tableName, e.ColumnName)
+			}
+			w.columns = append(w.columns, e.ColumnName)
+		}
+		if known.err != nil {
+			return known.err
+		}
+		w.entries = entries
+
+		if err := checkPatchedRowExists(txn, row, w.columns); err != nil {
+			return err
+		}
+
+		if _, err := txn.Get(kvs.RowKey(row)); err == nil {
+			w.layout = RowMajor
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		indexed := map[string]struct{}{}
+		if err := keptIndexes(txn, tableName, indexed); err != nil {
+			return err
+		}
+		return writeRow(txn, w, indexed)
+	}); err != nil {
+		return err
+	}
+
+	s.cache.invalidate(row)
+	return nil
+}
+
+// knownColumns finds whether columns are stored for any row of a table,
+// looking at the row being patched first, then at the keys of the column
+// itself, and only then decoding the table's rows stored under row keys.
+type knownColumns struct {
+	txn   *badger.Txn
+	row   kvs.Entry
+	found map[string]bool
+	own   map[string]kvs.Entry // columns of the row's row key, once read
+	rows  bool                 // whether every row key has been decoded
+	err   error
+}
+
+// has reports whether column is stored, rather than flattened into
+// sub-columns or not stored at all. Errors are kept for the caller to
+// check once it's done.
+func (k *knownColumns) has(column string) bool {
+	if known, ok := k.found[column]; ok || k.err != nil {
+		return known
+	}
+	known, err := k.lookup(column)
+	if err != nil {
+		k.err = err
+		return false
+	}
+	k.found[column] = known
+	return known
+}
+
+func (k *knownColumns) lookup(column string) (bool, error) {
+	if k.own == nil {
+		own, err := readRow(k.txn, k.row, nil)
+		if err != nil {
+			return false, err
+		}
+		if own == nil {
+			own = map[string]kvs.Entry{}
+		}
+		k.own = own
+	}
+	if _, ok := k.own[column]; ok {
+		return true, nil
+	}
+	for c := range k.own {
+		if strings.HasPrefix(c, column+".") {
+			return false, nil
+		}
+	}
+
+	e := k.row
+	e.ColumnName = column
+	if _, err := k.txn.Get(e.Key()); err == nil {
+		return true, nil
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
+		return false, err
+	}
+
+	// the column's own keys are followed by those of its sub-columns
+	known, found := false, false
+	if err := scanKeys(k.txn, []byte(k.row.TableName+"."+column+"."), func(_ *badger.Item, e kvs.Entry, isRow bool) (bool, error) {
+		if isRow {
+			return false, nil
+		}
+		known, found = e.ColumnName == column, true
+		return true, nil
+	}); err != nil || found {
+		return known, err
+	}
+
+	if k.rows {
+		return false, nil
+	}
+	k.rows = true
+	err := scanKeys(k.txn, kvs.RowPrefix(k.row.TableName, kvs.AnyOwner{}), func(item *badger.Item, e kvs.Entry, isRow bool) (bool, error) {
+		if !isRow {
+			return false, nil
+		}
+		entries, err := decodeRowItem(item, e)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range entries {
+			if _, ok := k.found[e.ColumnName]; !ok {
+				k.found[e.ColumnName] = true
+			}
+		}
+		return false, nil
+	})
+	return k.found[column], err
+}
+
+// checkPatchedRowExists returns ErrRowNotFound unless something is stored
+// for row, looking first at the columns patched, and only then seeking the
+// row's key in each of the table's other columns.
+func checkPatchedRowExists(txn *badger.Txn, row kvs.Entry, columns []string) error {
+	stored, err := loadRow(txn, row, columns, nil)
+	if err != nil || len(stored) > 0 {
+		return err
+	}
+	found, err := RowStored(txn, row)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s %s: %w", row.TableName, row.ResolveRowID(), ErrRowNotFound)
+	}
+	return nil
+}
+
+// checkRowExists returns ErrRowNotFound unless something is stored for one
+// of the given columns of row.
+func checkRowExists(txn *badger.Txn, row kvs.Entry, columns []string) error {
+	stored, err := loadRow(txn, row, columns, nil)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return fmt.Errorf("%s %s: %w", row.TableName, row.ResolveRowID(), ErrRowNotFound)
+	}
+	return nil
+}
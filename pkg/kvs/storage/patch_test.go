@@ -0,0 +1,192 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"github.com/matryer/is"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
+)
+
+func TestPatchWritesOnlyTheNamedColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "Broken", Status: "open", Priority: 1, Reporter: "amy"}))
+	patch := Ticket{ID: 7, Title: "Fixed", Status: "closed", Reporter: "rory"}
+	is.NoErr(store.Patch(kvs.RootOwner{}, &patch, 0, "Status", "priority"))
+	is.Equal(patch.ID, uint32(0))
+
+	loaded := Ticket{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Ticket{Title: "Broken", Status: "closed", Priority: 3, Reporter: "amy"}) // an empty omitempty column is removed
+
+	open, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"))
+	is.NoErr(err)
+	is.Equal(len(open), 0)
+	closed, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "closed"))
+	is.NoErr(err)
+	is.Equal(len(closed), 1)
+
+	err = store.Patch(kvs.RootOwner{}, &patch, 0, "reporter")
+	is.Equal(err.Error(), `column "reporter" of tickets is readonly`)
+	err = store.Patch(kvs.RootOwner{}, &patch, 0, "title")
+	is.Equal(err.Error(), `tickets does not have a column named "title"`)
+	err = store.Patch(kvs.RootOwner{}, &patch, 9, "summary")
+	is.True(errors.Is(err, storage.ErrRowNotFound))
+}
+
+func TestPatchSelectsEachSubColumnOfNestedStructs(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Shipment{Contents: "teacups", To: Destination{City: "Leadworth", Postcode: "LW1"}}))
+	is.NoErr(store.Patch(kvs.RootOwner{}, &Shipment{Contents: "saucers", To: Destination{City: "London", Postcode: "SE1"}}, 0, "to"))
+
+	loaded := Shipment{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded.Contents, "teacups")
+	is.Equal(loaded.To, Destination{City: "London", Postcode: "SE1"})
+}
+
+func TestPatchKeepsRowsInTheirLayout(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	sensor := uuid.New()
+	is.NoErr(store.Save(kvs.RootOwner{}, &PackedReading{Sensor: sensor, Station: "north", Value: 12.5, Unit: "C", Note: "dawn"}))
+	is.NoErr(store.Patch(kvs.RootOwner{}, &PackedReading{Value: 14}, 0, "value"))
+	is.NoErr(store.PatchMap("readings", kvs.RootOwner{}, 0, map[string]any{"note": nil, "station": "south"}))
+
+	loaded := PackedReading{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, PackedReading{Sensor: sensor, Station: "south", Value: 14, Unit: "C"})
+
+	is.NoErr(db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(kvs.RowKey(kvs.Entry{TableName: "readings", OwnerUUID: kvs.RootOwner{}, RowID: 0}))
+		is.NoErr(err)
+		_, err = txn.Get(kvs.Entry{TableName: "readings", ColumnName: "value", OwnerUUID: kvs.RootOwner{}, RowID: 0}.Key())
+		is.True(errors.Is(err, badger.ErrKeyNotFound)) // nothing was written column by column
+		return nil
+	}))
+
+	south, err := storage.LoadAll[PackedReading](store, kvs.RootOwner{}, storage.WithIndex("station", "south"))
+	is.NoErr(err)
+	is.Equal(len(south), 1)
+}
+
+func TestPatchMapValidatesColumnsAgainstThoseStored(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "Broken", Status: "open", Priority: 1, Reporter: "amy"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Shipment{Contents: "teacups", To: Destination{City: "Leadworth", Postcode: "LW1"}}))
+
+	is.NoErr(store.PatchMap("tickets", kvs.RootOwner{}, 0, map[string]any{"Status": "closed", "priority": nil}))
+	loaded := Ticket{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Ticket{Title: "Broken", Status: "closed", Reporter: "amy"})
+	rows, err := storage.LoadRows(store, "tickets", kvs.RootOwner{}, "priority")
+	is.NoErr(err)
+	is.Equal(rows[0].Entries["priority"].Meta, codec.Null) // nil is stored as null
+	closed, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "closed"))
+	is.NoErr(err)
+	is.Equal(len(closed), 1)
+
+	// objects are flattened into the sub-columns they were stored as
+	is.NoErr(store.PatchMap("shipments", kvs.RootOwner{}, 0, map[string]any{"to": map[string]any{"city": "London"}}))
+	shipment := Shipment{}
+	is.NoErr(storage.Load(store, &shipment, kvs.RootOwner{}, 0))
+	is.Equal(shipment.To, Destination{City: "London", Postcode: "LW1"})
+
+	err = store.PatchMap("tickets", kvs.RootOwner{}, 0, map[string]any{"colour": "red"})
+	is.Equal(err.Error(), `tickets does not have a column named "colour"`)
+	err = store.PatchMap("tickets", kvs.RootOwner{}, 4, map[string]any{"status": "open"})
+	is.True(errors.Is(err, storage.ErrRowNotFound))
+}
+
+func TestPatchMapFindsRowsStoredWithOtherColumnsOnly(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for i := 0; i < 3; i++ {
+		is.NoErr(store.Save(uuid.New(), &Shipment{Contents: "teacups", To: Destination{City: "Leadworth", Postcode: "LW1"}}))
+	}
+	is.NoErr(store.Save(kvs.RootOwner{}, &Shipment{Contents: "teacups", To: Destination{City: "Leadworth", Postcode: "LW1"}}))
+	// a row holding nothing but one sub-column, which sorts among owners
+	is.NoErr(kvs.Store(db, kvs.Entry{TableName: "shipments", ColumnName: "to.postcode", OwnerUUID: kvs.RootOwner{}, RowID: 7, Data: []byte("LW2")}))
+
+	is.NoErr(store.PatchMap("shipments", kvs.RootOwner{}, 7, map[string]any{"label": "saucers"}))
+	rows, err := storage.LoadRows(store, "shipments", kvs.RootOwner{}, "label", "to.postcode")
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+	is.Equal(len(rows[1].Entries), 2)
+
+	err = store.PatchMap("shipments", kvs.RootOwner{}, 8, map[string]any{"label": "saucers"})
+	is.True(errors.Is(err, storage.ErrRowNotFound))
+}
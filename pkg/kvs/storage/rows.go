@@ -0,0 +1,534 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
+)
+
+// Row holds every loaded column entry which shares a single owner and row ID.
+type Row struct {
+	ID uint32
+	// TextID holds the row's ID in place of ID when it isn't a number which
+	// fits a uint32, as with kvs.Entry.
+	TextID  kvs.RowID
+	Owner   kvs.UUID
+	Entries map[string]kvs.Entry
+}
+
+// newRow returns an empty row with the owner and row ID of e.
+func newRow(e kvs.Entry) *Row {
+	return &Row{ID: e.RowID, TextID: e.TextID, Owner: e.OwnerUUID, Entries: map[string]kvs.Entry{}}
+}
+
+// ResolveRowID returns the ID of the row, whichever field holds it.
+func (r Row) ResolveRowID() kvs.RowID {
+	return kvs.Entry{RowID: r.ID, TextID: r.TextID}.ResolveRowID()
+}
+
+// Entry returns the entry stored for the given column, if it was loaded.
+// A column naming a path inside a loaded list or map, such as tags.0 or
+// dims.w, returns an entry holding the value found there.
+func (r Row) Entry(column string) (kvs.Entry, bool) {
+	column = strings.ToLower(column)
+	if e, ok := r.Entries[column]; ok {
+		return e, ok
+	}
+
+	for _, ancestor := range Ancestors(column) {
+		e, ok := r.Entries[ancestor]
+		if !ok {
+			continue
+		}
+		v, err := codec.DecodeValue(e.Data, e.Meta)
+		if err != nil {
+			return kvs.Entry{}, false
+		}
+		found, ok := kvs.Lookup(reflect.ValueOf(v), column[len(ancestor)+1:])
+		if !ok {
+			return kvs.Entry{}, false
+		}
+		if e.Data, e.Meta, err = codec.Encode(found.Interface()); err != nil {
+			return kvs.Entry{}, false
+		}
+		e.ColumnName = column
+		return e, true
+	}
+
+	return kvs.Entry{}, false
+}
+
+// Ancestors lists the columns a dotted column name is nested within,
+// nearest first, so a.b.c has the ancestors a.b and a.
+func Ancestors(column string) []string {
+	ancestors := []string{}
+	for i := strings.LastIndex(column, "."); i > 0; i = strings.LastIndex(column[:i], ".") {
+		ancestors = append(ancestors, column[:i])
+	}
+	return ancestors
+}
+
+// ExpandColumns lists the stored columns needed to read each of the given
+// columns of a table: the column itself where it has values, the nested
+// sub-columns an object or struct was flattened into, and the column
+// holding a whole list or map which the name is a path inside.
+// Only the keys under each column's top level name are scanned, along with
+// the row keys of the owner.
+func ExpandColumns(s Store, tableName string, owner kvs.UUID, columns []string) ([]string, error) {
+	roots := map[string]struct{}{}
+	for _, column := range lowerAll(columns) {
+		root, _, _ := strings.Cut(column, ".")
+		roots[root] = struct{}{}
+	}
+
+	stored := []string{}
+	seen := map[string]struct{}{}
+	add := func(c string) {
+		root, _, _ := strings.Cut(c, ".")
+		if _, ok := roots[root]; !ok {
+			return
+		}
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			stored = append(stored, c)
+		}
+	}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		for root := range roots {
+			if err := scanColumns(txn, tableName, owner, []byte(tableName+"."+root+"."), add); err != nil {
+				return err
+			}
+		}
+		return scanColumns(txn, tableName, owner, kvs.RowPrefix(tableName, owner), add)
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(stored)
+	known := map[string]struct{}{}
+	for _, c := range stored {
+		known[c] = struct{}{}
+	}
+
+	seen = map[string]struct{}{}
+	expanded := []string{}
+	add = func(c string) {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			expanded = append(expanded, c)
+		}
+	}
+
+	for _, column := range lowerAll(columns) {
+		found := false
+		if _, ok := known[column]; ok {
+			add(column)
+			found = true
+		}
+		for _, c := range stored {
+			if strings.HasPrefix(c, column+".") {
+				add(c)
+				found = true
+			}
+		}
+		for _, ancestor := range Ancestors(column) {
+			if _, ok := known[ancestor]; ok {
+				add(ancestor)
+				found = true
+			}
+		}
+		// columns with no values at all are kept, so they read as absent
+		if !found {
+			add(column)
+		}
+	}
+
+	return expanded, nil
+}
+
+// ScanStats counts the work done while scanning stored rows.
+type ScanStats struct {
+	KeysScanned int
+	BytesRead   int
+}
+
+// LoadRows scans each of the given columns of a table and assembles
+// the entries found into rows keyed by their owner and row ID. Rows are
+// returned in ascending row ID order, grouped by owner if the owner given
+// is kvs.AnyOwner.
+func LoadRows(s Store, tableName string, owner kvs.UUID, columns ...string) ([]Row, error) {
+	return LoadRowsWithStats(s, tableName, owner, nil, columns...)
+}
+
+// LoadRowsWithStats is LoadRows which also adds the keys and bytes it
+// reads to the given stats.
+func LoadRowsWithStats(s Store, tableName string, owner kvs.UUID, stats *ScanStats, columns ...string) (rows []Row, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		rows, err = loadRows(txn, tableName, owner, columns, stats)
+		return err
+	})
+	return rows, err
+}
+
+// CountRows returns the number of rows of a table with anything stored for
+// them, in either layout, counting each row once whichever of its columns
+// are stored. Only keys are read.
+func CountRows(s Store, tableName string, owner kvs.UUID) (int, error) {
+	ownerID := resolveOwnerID(owner)
+	_, anyOwner := owner.(kvs.AnyOwner)
+
+	rows := map[rowKey]struct{}{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(tableName + ".")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			e, err := kvs.ParseRowKey(it.Item().Key())
+			if err != nil {
+				if e, err = kvs.ParseKey(it.Item().Key()); err != nil {
+					return err
+				}
+			}
+			if !anyOwner && e.OwnerUUID.String() != ownerID {
+				continue
+			}
+			rows[rowKey{owner: e.OwnerUUID.String(), id: e.ResolveRowID()}] = struct{}{}
+		}
+		return nil
+	})
+	return len(rows), err
+}
+
+// rowKey identifies a row of a table across owners.
+type rowKey struct {
+	owner string
+	id    kvs.RowID
+}
+
+func loadRows(txn *badger.Txn, tableName string, owner kvs.UUID, columns []string, stats *ScanStats) ([]Row, error) {
+	rows := map[rowKey]*Row{}
+	if err := loadColumnMajor(txn, tableName, owner, columns, rows, stats); err != nil {
+		return nil, err
+	}
+	if err := loadRowMajor(txn, tableName, owner, columns, rows, stats); err != nil {
+		return nil, err
+	}
+	return sortRows(rows), nil
+}
+
+// loadColumnMajor adds the given columns of rows stored under their own
+// keys to rows.
+func loadColumnMajor(txn *badger.Txn, tableName string, owner kvs.UUID, columns []string, rows map[rowKey]*Row, stats *ScanStats) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for _, column := range columns {
+		column = strings.ToLower(column)
+		prefix := kvs.Entry{TableName: tableName, ColumnName: column, OwnerUUID: owner}.PrefixKey()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if kvs.IsRowKey(item.Key()) {
+				continue
+			}
+			e, err := kvs.ParseKey(item.Key())
+			if err != nil {
+				return err
+			}
+			// a prefix spanning owners also spans any nested columns
+			if e.ColumnName != column {
+				continue
+			}
+
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			if stats != nil {
+				stats.KeysScanned++
+				stats.BytesRead += len(item.Key()) + len(data)
+			}
+
+			e.Data = data
+			e.Meta = item.UserMeta()
+
+			k := rowKey{owner: e.OwnerUUID.String(), id: e.ResolveRowID()}
+			row, ok := rows[k]
+			if !ok {
+				row = newRow(e)
+				rows[k] = row
+			}
+			row.Entries[e.ColumnName] = e
+		}
+	}
+	return nil
+}
+
+// loadRowMajor adds the given columns of rows stored under row keys to
+// rows, taking precedence over any found under their own keys.
+func loadRowMajor(txn *badger.Txn, tableName string, owner kvs.UUID, columns []string, rows map[rowKey]*Row, stats *ScanStats) error {
+	wanted := make(map[string]struct{}, len(columns))
+	for _, c := range lowerAll(columns) {
+		wanted[c] = struct{}{}
+	}
+
+	// the prefix is shared with column keys, so only keys are read until
+	// a row key is found
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := kvs.RowPrefix(tableName, owner)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		ref, err := kvs.ParseRowKey(item.Key())
+		if err != nil {
+			continue
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if stats != nil {
+			stats.KeysScanned++
+			stats.BytesRead += len(item.Key()) + len(data)
+		}
+
+		entries, err := kvs.DecodeRow(ref, data)
+		if err != nil {
+			return err
+		}
+		k := rowKey{owner: ref.OwnerUUID.String(), id: ref.ResolveRowID()}
+		for _, e := range entries {
+			if _, ok := wanted[e.ColumnName]; !ok {
+				continue
+			}
+			row, ok := rows[k]
+			if !ok {
+				row = newRow(ref)
+				rows[k] = row
+			}
+			row.Entries[e.ColumnName] = e
+		}
+	}
+	return nil
+}
+
+// loadRowsByID reads each of the given columns of the rows with the given
+// IDs, in the order given, leaving out rows with nothing stored.
+func loadRowsByID(txn *badger.Txn, tableName string, owner kvs.UUID, rowIDs []kvs.RowID, columns []string, stats *ScanStats) ([]Row, error) {
+	if _, ok := owner.(kvs.AnyOwner); ok {
+		return nil, fmt.Errorf("rows of %s can only be read by ID for a single owner", tableName)
+	}
+
+	rows := make([]Row, 0, len(rowIDs))
+	for _, id := range rowIDs {
+		row := kvs.Entry{TableName: tableName, OwnerUUID: owner}.WithRowID(id)
+		entries, err := loadRow(txn, row, columns, stats)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		r := newRow(row)
+		r.Entries = entries
+		rows = append(rows, *r)
+	}
+	return rows, nil
+}
+
+// RowStored reports whether anything is stored for row, under its row key
+// or the key of any of its columns. Within the keys of each column held by
+// the row's owner it seeks straight to the row's own key, skipping over
+// every other owner's, and it stops at the first key found.
+func RowStored(txn *badger.Txn, row kvs.Entry) (bool, error) {
+	if _, err := txn.Get(kvs.RowKey(row)); err == nil {
+		return true, nil
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
+		return false, err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	owner := resolveOwnerID(row.OwnerUUID)
+	prefix := []byte(row.TableName + ".")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); {
+		key := it.Item().Key()
+		if kvs.IsRowKey(key) {
+			it.Next()
+			continue
+		}
+		e, err := kvs.ParseKey(key)
+		if err != nil {
+			return false, err
+		}
+		group := kvs.Entry{TableName: e.TableName, ColumnName: e.ColumnName, OwnerUUID: e.OwnerUUID}.PrefixKey()
+		if e.OwnerUUID.String() == owner {
+			c := row
+			c.ColumnName = e.ColumnName
+			if it.Seek(c.Key()); it.Valid() && bytes.Equal(it.Item().Key(), c.Key()) {
+				return true, nil
+			}
+		}
+		// every other key of the column and owner differs only by row ID,
+		// which sorts before 0xff
+		it.Seek(append(group, '.', 0xff))
+	}
+	return false, nil
+}
+
+// sortRows orders rows by owner, then by ascending row ID.
+func sortRows(rows map[rowKey]*Row) []Row {
+	dest := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		dest = append(dest, *row)
+	}
+	sort.Slice(dest, func(i, j int) bool {
+		if oi, oj := dest[i].Owner.String(), dest[j].Owner.String(); oi != oj {
+			return oi < oj
+		}
+		return kvs.CompareRowIDs(dest[i].ResolveRowID(), dest[j].ResolveRowID()) < 0
+	})
+	return dest
+}
+
+// TableColumns lists the names of all columns which have at least one
+// value stored for the given table and owner, in either layout.
+func TableColumns(s Store, tableName string, owner kvs.UUID) ([]string, error) {
+	seen := map[string]struct{}{}
+	columns := []string{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		return scanColumns(txn, tableName, owner, []byte(tableName+"."), func(c string) {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				columns = append(columns, c)
+			}
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+// scanColumns calls found with the name of each column of the table and
+// owner stored under prefix, in either layout. Column keys are read only
+// until one of each column and owner is found, skipping the rest of their
+// rows, while rows stored under row keys are each decoded.
+func scanColumns(txn *badger.Txn, tableName string, owner kvs.UUID, prefix []byte, found func(string)) error {
+	ownerID := resolveOwnerID(owner)
+	_, anyOwner := owner.(kvs.AnyOwner)
+
+	return scanKeys(txn, prefix, func(item *badger.Item, e kvs.Entry, isRow bool) (bool, error) {
+		if !anyOwner && e.OwnerUUID.String() != ownerID {
+			return false, nil
+		}
+		if !isRow {
+			found(e.ColumnName)
+			return false, nil
+		}
+		entries, err := decodeRowItem(item, e)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range entries {
+			found(e.ColumnName)
+		}
+		return false, nil
+	})
+}
+
+// scanKeys reads the keys under prefix, handing fn each row key and the
+// first key of each column and owner, with the rest of their rows skipped
+// over, until fn reports it is done.
+func scanKeys(txn *badger.Txn, prefix []byte, fn func(item *badger.Item, e kvs.Entry, isRow bool) (bool, error)) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); {
+		item := it.Item()
+		if ref, err := kvs.ParseRowKey(item.Key()); err == nil {
+			if done, err := fn(item, ref, true); done || err != nil {
+				return err
+			}
+			it.Next()
+			continue
+		}
+
+		e, err := kvs.ParseKey(item.Key())
+		if err != nil {
+			return err
+		}
+		if done, err := fn(item, e, false); done || err != nil {
+			return err
+		}
+		// every other key of the column and owner differs only by row ID,
+		// which sorts before 0xff
+		skip := append(kvs.Entry{TableName: e.TableName, ColumnName: e.ColumnName, OwnerUUID: e.OwnerUUID}.PrefixKey(), '.', 0xff)
+		it.Seek(skip)
+	}
+	return nil
+}
+
+// decodeRowItem decodes the columns of the row stored under a row key.
+func decodeRowItem(item *badger.Item, row kvs.Entry) ([]kvs.Entry, error) {
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return kvs.DecodeRow(row, data)
+}
+
+func resolveOwnerID(owner kvs.UUID) string {
+	if owner == nil {
+		return kvs.RootOwner{}.String()
+	}
+	return owner.String()
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/bluepanda/pkg/kvs"
+)
+
+// sequenceIDs numbers the rows of each owner's tables in order, leasing a
+// badger sequence for each the first time it's needed. Row IDs are handed
+// out one at a time under a lock, as reserving a block of them has to hand
+// back a sequence's lease without another caller leasing it again
+// meanwhile.
+type sequenceIDs struct {
+	mu        sync.Mutex
+	bandwidth uint64
+	max       uint64
+	seqs      map[string]*badger.Sequence
+}
+
+// SequenceIDs numbers rows from zero upwards, as Store always has, leasing
+// bandwidth IDs at a time from the database. Leasing more at once means
+// fewer writes, at the cost of a gap in the numbering for the IDs leased
+// but never handed out should the process stop without closing its Store.
+// IDs stay within the range of a uint32, so can be loaded into uint32 ID
+// fields.
+func SequenceIDs(bandwidth uint64) IDGenerator {
+	return newSequenceIDs(bandwidth, math.MaxUint32)
+}
+
+// Uint64IDs numbers rows as SequenceIDs does, but across the whole range of
+// a uint64, for tables which may outgrow a uint32. They need ID fields of
+// type uint64.
+func Uint64IDs(bandwidth uint64) IDGenerator {
+	return newSequenceIDs(bandwidth, math.MaxUint64)
+}
+
+func newSequenceIDs(bandwidth, max uint64) *sequenceIDs {
+	if bandwidth == 0 {
+		bandwidth = 1
+	}
+	return &sequenceIDs{bandwidth: bandwidth, max: max, seqs: map[string]*badger.Sequence{}}
+}
+
+func sequenceKey(owner kvs.UUID, tableName string) string {
+	return fmt.Sprintf("%s.%s", owner, tableName)
+}
+
+func (s *sequenceIDs) NextID(db kvs.KVDB, owner kvs.UUID, tableName string, _ any) (kvs.RowID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sequenceKey(owner, tableName)
+	seq, ok := s.seqs[key]
+	if !ok {
+		var err error
+		if seq, err = db.GetSeq([]byte(key), s.bandwidth); err != nil {
+			return "", err
+		}
+		s.seqs[key] = seq
+	}
+
+	id, err := seq.Next()
+	if err != nil {
+		return "", err
+	}
+	if id > s.max {
+		return "", fmt.Errorf("%s has run out of row IDs", tableName)
+	}
+	return kvs.NumericID(id), nil
+}
+
+// reserve reserves n consecutive row IDs of a table, returning the first
+// of them.
+func (s *sequenceIDs) reserve(db kvs.KVDB, owner kvs.UUID, tableName string, n int) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sequenceKey(owner, tableName)
+
+	// a leased sequence would go on to hand out IDs from within the block,
+	// so its lease is given back first and it's fetched again when needed
+	if seq, ok := s.seqs[key]; ok {
+		if err := seq.Release(); err != nil {
+			return 0, err
+		}
+		delete(s.seqs, key)
+	}
+
+	var first uint64
+	err := db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			if err := item.Value(func(val []byte) error {
+				first = binary.BigEndian.Uint64(val)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		if n > 0 && first > s.max-uint64(n-1) {
+			return fmt.Errorf("%s has run out of row IDs", tableName)
+		}
+		next := make([]byte, 8)
+		binary.BigEndian.PutUint64(next, first+uint64(n))
+		return txn.Set([]byte(key), next)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return first, nil
+}
+
+// Close gives back the leases of every sequence, carrying on past any
+// which fail so as not to leave the rest leased.
+func (s *sequenceIDs) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := []error{}
+	for key, seq := range s.seqs {
+		if err := seq.Release(); err != nil {
+			errs = append(errs, fmt.Errorf("releasing sequence %s: %w", key, err))
+		}
+		delete(s.seqs, key)
+	}
+	return errors.Join(errs...)
+}
@@ -32,8 +32,9 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
+	"reflect"
 	"strings"
 
 	"github.com/dgraph-io/badger/v3"
@@ -44,237 +45,1092 @@ type Value interface {
 	TableName() string
 }
 
+// Store saves and loads values in a KVDB. It is safe for concurrent use,
+// including copies of it, which share their ID generators and row cache.
 type Store struct {
-	db  kvs.KVDB
-	pks map[string]*badger.Sequence
+	db    kvs.KVDB
+	ids   idGenerators
+	cache *rowCache
 }
 
-func New(db kvs.KVDB) Store {
-	return Store{db: db, pks: map[string]*badger.Sequence{}}
+// New returns a Store of db, which numbers the rows of every table with
+// SequenceIDs(1) unless given another IDGenerator, and caches no rows
+// unless given WithRowCache.
+func New(db kvs.KVDB, opts ...StoreOption) Store {
+	o := resolveStoreOptions(opts)
+	s := Store{db: db, ids: idGenerators{fallback: o.ids, tables: o.tableIDs}}
+	if o.cacheRows > 0 {
+		s.cache = newRowCache(db, o.cacheRows)
+	}
+	return s
+}
+
+// Save writes value as a new row owned by owner, assigning it a row ID
+// from its table's IDGenerator.
+func (s Store) Save(owner kvs.UUID, value Value, opts ...SaveOption) error {
+	ids := s.ids.forTable(value.TableName())
+	o := resolveSaveOptions(opts)
+	o.unique = isNatural(ids)
+	return s.saveValue(value.TableName(), owner, value, o, func() (kvs.RowID, error) {
+		return ids.NextID(s.db, owner, value.TableName(), value)
+	})
 }
 
-func (s Store) Save(owner kvs.UUID, value Value) error {
-	rowID, err := nextRowID(s.db, owner, value.TableName(), s.pks)
+// SaveMany writes each of values as a new row owned by owner. A block of
+// row IDs is reserved for each table numbered by a sequence at once, and
+// the rows are written through a write batch rather than a transaction per
+// row, so unlike Save the rows written are not all or nothing should it
+// fail part way. Rows keyed by NaturalKeys are the exception, each being
+// checked for and written in the same transaction, as many to a
+// transaction as fit. They're committed before the rest are batched, so
+// they stay written should the batch fail. Every value's BeforeSave hook
+// runs before any row is written, and each AfterSave hook once its row's
+// transaction is committed or the whole batch is flushed.
+func (s Store) SaveMany(owner kvs.UUID, values []Value) error {
+	counts := map[string]int{}
+	tables := []string{}
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if _, err := kvs.Columns(reflect.TypeOf(v)); err != nil {
+			return err
+		}
+		if err := beforeSave(v); err != nil {
+			return err
+		}
+		if _, ok := counts[v.TableName()]; !ok {
+			tables = append(tables, v.TableName())
+		}
+		counts[v.TableName()]++
+	}
+
+	next := map[string]uint64{}
+	for _, tableName := range tables {
+		seqs, ok := s.ids.forTable(tableName).(*sequenceIDs)
+		if !ok {
+			continue
+		}
+		first, err := seqs.reserve(s.db, owner, tableName, counts[tableName])
+		if err != nil {
+			return err
+		}
+		next[tableName] = first
+	}
+
+	rowIDs, err := s.newRowIDs(owner, values, next)
 	if err != nil {
 		return err
 	}
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if err := kvs.LoadRowID(v, rowIDs[i]); err != nil {
+			return err
+		}
+	}
+
+	// rows may have been written in part even if it fails
+	defer s.invalidateRows(owner, values, rowIDs)
+
+	// columns whose index has been started are indexed whether or not the
+	// types saved declare them
+	indexed := map[string]struct{}{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		for _, tableName := range tables {
+			if err := keptIndexes(txn, tableName, indexed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
 
-	return saveValue(s.db, value.TableName(), owner, rowID, value)
-}
+	natural := []unsavedRow{}
+	batched := []unsavedRow{}
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		tableName := v.TableName()
 
-func (s Store) Update(owner kvs.UUID, value Value, rowID uint32) error {
-	return saveValue(s.db, value.TableName(), owner, rowID, value)
+		columns, err := kvs.Columns(reflect.TypeOf(v))
+		if err != nil {
+			return err
+		}
+		entries, err := entriesOf(tableName, owner, rowIDs[i], v)
+		if err != nil {
+			return err
+		}
+		w := rowWrite{
+			row:     kvs.Entry{TableName: tableName, OwnerUUID: owner}.WithRowID(rowIDs[i]),
+			value:   v,
+			columns: columnNames(columns),
+			entries: entries,
+			layout:  layoutOf(v),
+		}
+		indexedColumns(indexed, tableName, columns)
+		r := unsavedRow{w: w, entries: newRowEntries(w, indexed)}
+		if isNatural(s.ids.forTable(tableName)) {
+			natural = append(natural, r)
+			continue
+		}
+		batched = append(batched, r)
+	}
+
+	if err := writeNewRows(s.db, natural); err != nil {
+		return err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, r := range batched {
+		for _, e := range r.entries {
+			if err := wb.SetEntry(e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	if err := indexLateRows(s.db, batched, indexed); err != nil {
+		return err
+	}
+
+	for _, r := range batched {
+		if err := afterSave(r.w.value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func saveValue(db kvs.KVDB, tableName string, ownerID kvs.UUID, rowID uint32, v Value) error {
-	if v == nil {
+// indexLateRows indexes batched rows for any column whose index was
+// started after the batch was made. Unlike a transaction, a batch doesn't
+// conflict with the index being built, so it may have been written after
+// the stored values were read to build it.
+func indexLateRows(db kvs.KVDB, rows []unsavedRow, indexed map[string]struct{}) error {
+	late := map[string]struct{}{}
+	if err := db.View(func(txn *badger.Txn) error {
+		tables := map[string]struct{}{}
+		for _, r := range rows {
+			if _, ok := tables[r.w.row.TableName]; ok {
+				continue
+			}
+			tables[r.w.row.TableName] = struct{}{}
+			if err := keptIndexes(txn, r.w.row.TableName, late); err != nil {
+				return err
+			}
+		}
 		return nil
+	}); err != nil {
+		return err
 	}
-	entries := kvs.ConvertToEntries(tableName, ownerID, rowID, v)
-	for _, e := range entries {
-		if err := kvs.Store(db, e); err != nil {
+	for c := range indexed {
+		delete(late, c)
+	}
+	if len(late) == 0 {
+		return nil
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, r := range rows {
+		for _, e := range r.w.entries {
+			if _, ok := late[e.TableName+"."+e.ColumnName]; ok {
+				if err := wb.Set(kvs.IndexKey(e), nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return wb.Flush()
+}
+
+// unsavedRow is a row never stored before, with everything to write for it.
+type unsavedRow struct {
+	w       rowWrite
+	entries []*badger.Entry
+}
+
+// errTxnFull stops a transaction of new rows which has grown too big to
+// commit, so that it can be retried with only the rows before the one
+// which didn't fit.
+var errTxnFull = errors.New("transaction full")
+
+// writeNewRows checks that nothing is stored for each of rows and writes
+// it, in the same transaction, so that no other write can come between
+// them. Rows are written as many to a transaction as fit, and each
+// AfterSave hook runs once its row's transaction is committed.
+func writeNewRows(db kvs.KVDB, rows []unsavedRow) error {
+	for len(rows) > 0 {
+		fit := len(rows)
+		write := func(txn *badger.Txn) error {
+			for i, r := range rows[:fit] {
+				if err := checkNewRow(txn, r.w.row, r.w.columns); err != nil {
+					return err
+				}
+				for _, e := range r.entries {
+					if err := txn.SetEntry(e); err != nil {
+						if errors.Is(err, badger.ErrTxnTooBig) && i > 0 {
+							fit = i
+							return errTxnFull
+						}
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		err := db.Update(write)
+		if errors.Is(err, errTxnFull) {
+			// the rows before the one which didn't fit did, by themselves
+			err = db.Update(write)
+		}
+		if err != nil {
 			return err
 		}
+
+		for _, r := range rows[:fit] {
+			if err := afterSave(r.w.value); err != nil {
+				return err
+			}
+		}
+		rows = rows[fit:]
 	}
+	return nil
+}
 
-	return kvs.LoadID(v, rowID)
+func (s Store) invalidateRows(owner kvs.UUID, values []Value, rowIDs []kvs.RowID) {
+	rows := make([]kvs.Entry, 0, len(values))
+	for i, v := range values {
+		if v != nil {
+			rows = append(rows, kvs.Entry{TableName: v.TableName(), OwnerUUID: owner}.WithRowID(rowIDs[i]))
+		}
+	}
+	s.cache.invalidate(rows...)
 }
 
-func (s Store) Delete(owner kvs.UUID, value Value, rowID uint32) error {
-	db := s.db
+// newRowIDs assigns each of values its row ID, taking those of tables
+// numbered by a sequence from the blocks starting at next. Natural keys are
+// checked against each other, and against the rows already stored only as
+// they're written.
+func (s Store) newRowIDs(owner kvs.UUID, values []Value, next map[string]uint64) ([]kvs.RowID, error) {
+	rowIDs := make([]kvs.RowID, len(values))
+	type tableRow struct {
+		table string
+		id    kvs.RowID
+	}
+	seen := map[tableRow]struct{}{}
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		tableName := v.TableName()
+		if first, ok := next[tableName]; ok {
+			rowIDs[i] = kvs.NumericID(first)
+			next[tableName]++
+			continue
+		}
 
-	blankEntries := kvs.ConvertToBlankEntries(value.TableName(), owner, rowID, value)
-	for _, ent := range blankEntries {
-		db.Update(func(txn *badger.Txn) error {
-			return txn.Delete(ent.Key())
-		})
+		ids := s.ids.forTable(tableName)
+		rowID, err := ids.NextID(s.db, owner, tableName, v)
+		if err != nil {
+			return nil, err
+		}
+		rowIDs[i] = rowID
+
+		if isNatural(ids) {
+			if _, ok := seen[tableRow{tableName, rowID}]; ok {
+				return nil, fmt.Errorf("%s %s: %w", tableName, rowID, ErrRowExists)
+			}
+			seen[tableRow{tableName, rowID}] = struct{}{}
+		}
 	}
+	return rowIDs, nil
+}
 
+// checkNewRow returns ErrRowExists if any of the given columns, in either
+// layout, are stored for row.
+func checkNewRow(txn *badger.Txn, row kvs.Entry, columns []string) error {
+	stored, err := loadRow(txn, row, columns, nil)
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		return fmt.Errorf("%s %s: %w", row.TableName, row.ResolveRowID(), ErrRowExists)
+	}
 	return nil
 }
 
-func Load[T Value](s Store, dest T, owner kvs.UUID, rowID uint32) error {
-	db := s.db
+// Update overwrites the given row with value. Columns declared readonly
+// keep the value they were first saved with.
+func (s Store) Update(owner kvs.UUID, value Value, rowID uint32) error {
+	return s.UpdateByID(owner, value, kvs.NumericID(uint64(rowID)))
+}
 
-	blankEntries := kvs.ConvertToBlankEntries(dest.TableName(), owner, rowID, dest)
-	for _, ent := range blankEntries {
-		db.View(func(txn *badger.Txn) error {
-			item, err := txn.Get(ent.Key())
+// UpdateByID is Update for rows with IDs of any kind, such as those handed
+// out by UUIDv7IDs or NaturalKeys.
+func (s Store) UpdateByID(owner kvs.UUID, value Value, rowID kvs.RowID) error {
+	return s.saveValue(value.TableName(), owner, value, saveOptions{update: true}, func() (kvs.RowID, error) {
+		return rowID, nil
+	})
+}
+
+// saveValue writes v, and its children if cascading, in one transaction
+// along with the value's hooks, taking its row ID from nextID once its
+// BeforeSave hook has run.
+func (s Store) saveValue(tableName string, ownerID kvs.UUID, v Value, opts saveOptions, nextID func() (kvs.RowID, error)) error {
+	if v == nil {
+		return nil
+	}
+
+	columns, err := kvs.Columns(reflect.TypeOf(v))
+	if err != nil {
+		return err
+	}
+	indexed := map[string]struct{}{}
+	indexedColumns(indexed, tableName, columns)
+
+	var writes []rowWrite
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		if err := beforeSave(v); err != nil {
+			return err
+		}
+		rowID, err := nextID()
+		if err != nil {
+			return err
+		}
+
+		entries, err := entriesOf(tableName, ownerID, rowID, v)
+		if err != nil {
+			return err
+		}
+		if opts.update {
+			entries = withoutReadOnly(entries, columns)
+		}
+
+		writes = []rowWrite{{
+			row:     kvs.Entry{TableName: tableName, OwnerUUID: ownerID}.WithRowID(rowID),
+			value:   v,
+			columns: columnNames(columns),
+			entries: entries,
+			layout:  layoutOf(v),
+			update:  opts.update,
+			unique:  opts.unique,
+		}}
+		if opts.cascade {
+			children, err := s.childRows(v, indexed)
 			if err != nil {
 				return err
 			}
+			writes = append(writes, children...)
+		}
+
+		if err := kvs.LoadRowID(v, rowID); err != nil {
+			return err
+		}
 
-			if err := item.Value(func(val []byte) error {
-				ent.Data = val
-				return nil
-			}); err != nil {
+		tables := map[string]struct{}{}
+		for _, w := range writes {
+			if _, ok := tables[w.row.TableName]; ok {
+				continue
+			}
+			tables[w.row.TableName] = struct{}{}
+			if err := keptIndexes(txn, w.row.TableName, indexed); err != nil {
+				return err
+			}
+		}
+		for _, w := range writes {
+			if w.unique {
+				if err := checkNewRow(txn, w.row, w.columns); err != nil {
+					return err
+				}
+			}
+			if err := writeRow(txn, w, indexed); err != nil {
 				return err
 			}
+		}
+		for _, w := range writes {
+			if err := afterSave(w.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
 
-			return nil
-		})
+	for _, w := range writes {
+		s.cache.invalidate(w.row)
+	}
+	return nil
+}
 
-		ent.RowID = rowID
+// entriesOf converts v into the entries of the row with the given ID.
+func entriesOf(tableName string, owner kvs.UUID, rowID kvs.RowID, v any) ([]kvs.Entry, error) {
+	entries, err := kvs.EntriesOf(tableName, owner, 0, v)
+	return withRowID(entries, rowID), err
+}
 
-		if err := kvs.LoadEntry(dest, ent); err != nil {
-			return err
+// blankEntriesOf is entriesOf for entries without data, as used for
+// loading and deleting.
+func blankEntriesOf(tableName string, owner kvs.UUID, rowID kvs.RowID, v any) []kvs.Entry {
+	return withRowID(kvs.ConvertToBlankEntries(tableName, owner, 0, v), rowID)
+}
+
+func withRowID(entries []kvs.Entry, rowID kvs.RowID) []kvs.Entry {
+	for i := range entries {
+		entries[i] = entries[i].WithRowID(rowID)
+	}
+	return entries
+}
+
+func columnNames(columns []kvs.Column) []string {
+	names := make([]string, 0, len(columns))
+	for _, c := range columns {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func withoutReadOnly(entries []kvs.Entry, columns []kvs.Column) []kvs.Entry {
+	readOnly := map[string]struct{}{}
+	for _, c := range columns {
+		if c.ReadOnly {
+			readOnly[c.Name] = struct{}{}
 		}
 	}
 
-	return kvs.LoadID(dest, rowID)
+	writable := make([]kvs.Entry, 0, len(entries))
+	for _, e := range entries {
+		if _, ok := readOnly[e.ColumnName]; !ok {
+			writable = append(writable, e)
+		}
+	}
+	return writable
 }
 
-func extractRowFromKey(k string) (int, error) {
-	rowPos := strings.LastIndex(k, ".")
-	return strconv.Atoi(k[rowPos+1:])
+// childRows assigns row IDs to every child row held by v's relationship
+// fields, returning them so they can be written alongside v. The indexed
+// columns of child tables are added to indexed.
+func (s Store) childRows(v Value, indexed map[string]struct{}) ([]rowWrite, error) {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	relations := kvs.Relations(val.Type())
+	if len(relations) == 0 {
+		return nil, nil
+	}
+
+	parent, err := parentUUID(val)
+	if err != nil {
+		return nil, err
+	}
+
+	writes := []rowWrite{}
+	for _, rel := range relations {
+		children := val.Field(rel.Index)
+		for i := 0; i < children.Len(); i++ {
+			child := children.Index(i)
+			if child.Kind() != reflect.Pointer {
+				child = child.Addr()
+			}
+			cv, ok := child.Interface().(Value)
+			if !ok {
+				return nil, fmt.Errorf("%s children must implement storage.Value", rel.Name)
+			}
+
+			columns, err := kvs.Columns(child.Type())
+			if err != nil {
+				return nil, err
+			}
+			indexedColumns(indexed, cv.TableName(), columns)
+
+			setReference(child.Elem(), rel.Column, parent)
+			if err := beforeSave(cv); err != nil {
+				return nil, err
+			}
+
+			ids := s.ids.forTable(cv.TableName())
+			rowID, err := ids.NextID(s.db, parent, cv.TableName(), cv)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := entriesOf(cv.TableName(), parent, rowID, cv)
+			if err != nil {
+				return nil, err
+			}
+			writes = append(writes, rowWrite{
+				row:     kvs.Entry{TableName: cv.TableName(), OwnerUUID: parent}.WithRowID(rowID),
+				value:   cv,
+				columns: columnNames(columns),
+				entries: entries,
+				layout:  layoutOf(cv),
+				unique:  isNatural(ids),
+			})
+			if err := kvs.LoadRowID(cv, rowID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return writes, nil
 }
 
-func LoadAll[T Value](s Store, owner kvs.UUID) ([]T, error) {
-	return loadAllWithPredicate[T](s, owner, func(e kvs.Entry) bool { return true })
+// Delete removes every column of the given row, in either layout.
+func (s Store) Delete(owner kvs.UUID, value Value, rowID uint32) error {
+	return s.DeleteByID(owner, value, kvs.NumericID(uint64(rowID)))
 }
 
-func LoadAllWithEvaluator[T Value](s Store, owner kvs.UUID, pred func(e kvs.Entry) bool) ([]T, error) {
-	return loadAllWithPredicate[T](s, owner, pred)
+// DeleteByID is Delete for rows with IDs of any kind.
+func (s Store) DeleteByID(owner kvs.UUID, value Value, rowID kvs.RowID) error {
+	columns, err := kvs.Columns(reflect.TypeOf(value))
+	if err != nil {
+		return err
+	}
+	indexed := map[string]struct{}{}
+	indexedColumns(indexed, value.TableName(), columns)
+
+	blankEntries := blankEntriesOf(value.TableName(), owner, rowID, value)
+	keys := make([][]byte, 0, len(blankEntries)+1)
+	for _, ent := range blankEntries {
+		keys = append(keys, ent.Key())
+	}
+	keys = append(keys, kvs.RowKey(kvs.Entry{TableName: value.TableName(), OwnerUUID: owner}.WithRowID(rowID)))
+
+	if err := s.db.View(func(txn *badger.Txn) error {
+		if err := keptIndexes(txn, value.TableName(), indexed); err != nil {
+			return err
+		}
+		ik, err := indexKeys(txn, blankEntries, indexed)
+		keys = append(keys, ik...)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	defer s.cache.invalidateKeys(keys)
+	return deleteKeys(s.db, keys, value)
 }
 
-func loadAllWithPredicate[T Value](s Store, owner kvs.UUID, pred func(e kvs.Entry) bool) ([]T, error) {
-	db := s.db
-	dest := []T{}
-	v := *new(T)
+// DeleteCascade removes the given row along with its child rows: those of
+// the tables of its declared relations, such as `mdb:"children=cake"`,
+// owned by its uuid column, and so on down through the relations of each
+// child table. UUIDs held in any other column are only references, so the
+// rows they own are left alone. Rows are removed in a single transaction
+// where they fit, and in batches otherwise.
+func (s Store) DeleteCascade(owner kvs.UUID, value Value, rowID uint32) error {
+	return s.DeleteCascadeByID(owner, value, kvs.NumericID(uint64(rowID)))
+}
 
-	exclusions := map[int]int{}
+// DeleteCascadeByID is DeleteCascade for rows with IDs of any kind.
+func (s Store) DeleteCascadeByID(owner kvs.UUID, value Value, rowID kvs.RowID) error {
+	if owner == nil {
+		owner = kvs.RootOwner{}
+	}
 
-	blankEntries := kvs.ConvertToBlankEntries(v.TableName(), owner, 0, v)
-	for _, ent := range blankEntries {
-		// iterate over all stored values for this entry
-		prefix := ent.PrefixKey()
-		if err := db.View(func(txn *badger.Txn) error {
-			it := txn.NewIterator(badger.DefaultIteratorOptions)
-			defer it.Close()
-
-			var destinationindex uint32 = 0
-			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-				if _, ok := exclusions[int(destinationindex)]; ok {
-					destinationindex++
-					continue
-				}
+	t := reflect.TypeOf(value)
+	columns, err := kvs.Columns(t)
+	if err != nil {
+		return err
+	}
+	indexed := map[string]struct{}{}
+	indexedColumns(indexed, value.TableName(), columns)
 
-				item := it.Item()
-				if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
-					return err
-				}
+	row := kvs.Entry{TableName: value.TableName(), OwnerUUID: owner}.WithRowID(rowID)
+	blankEntries := blankEntriesOf(value.TableName(), owner, rowID, value)
+	keys := make([][]byte, 0, len(blankEntries)+1)
+	if err := s.db.View(func(txn *badger.Txn) error {
+		if err := keptIndexes(txn, value.TableName(), indexed); err != nil {
+			return err
+		}
+		ik, err := indexKeys(txn, blankEntries, indexed)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, ik...)
 
-				if err := forEachEntryItem(destinationindex, ent, item.Key(), &dest, &exclusions, pred); err != nil {
-					return err
-				}
+		keys = append(keys, kvs.RowKey(row))
+		for _, ent := range blankEntries {
+			keys = append(keys, ent.Key())
+		}
 
-				destinationindex++
-			}
+		if len(kvs.Relations(t)) == 0 {
 			return nil
-		}); err != nil {
-			return nil, err
 		}
+		parent, ok, err := storedUUID(txn, row)
+		if err != nil || !ok {
+			return err
+		}
+		children, err := childKeys(txn, t, parent, map[string]struct{}{})
+		keys = append(keys, children...)
+		return err
+	}); err != nil {
+		return err
 	}
 
-	finalDest := []T{}
-	for i, v := range dest {
-		if _, ok := exclusions[i]; ok {
+	defer s.cache.invalidateKeys(keys)
+	return deleteKeys(s.db, keys, value)
+}
+
+// childKeys lists the keys of the rows parent owns through t's declared
+// relations, with their index keys, and so on down through the relations
+// of each child table. Only the keys of the rows each parent owns are
+// read, the rest of the child tables being skipped over.
+func childKeys(txn *badger.Txn, t reflect.Type, parent kvs.UUID, visited map[string]struct{}) ([][]byte, error) {
+	keys := [][]byte{}
+	for _, rel := range kvs.Relations(t) {
+		elem := rel.Elem
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		child, ok := reflect.New(elem).Interface().(Value)
+		if !ok {
+			return nil, fmt.Errorf("%s children must implement storage.Value", rel.Name)
+		}
+		tableName := child.TableName()
+		if _, ok := visited[tableName+"."+parent.String()]; ok {
 			continue
 		}
-		finalDest = append(finalDest, v)
-	}
+		visited[tableName+"."+parent.String()] = struct{}{}
+
+		columns, err := kvs.Columns(elem)
+		if err != nil {
+			return nil, err
+		}
+		indexed := map[string]struct{}{}
+		indexedColumns(indexed, tableName, columns)
+		if err := keptIndexes(txn, tableName, indexed); err != nil {
+			return nil, err
+		}
+
+		owned, rows, err := ownedKeys(txn, tableName, parent)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, owned...)
+
+		for _, row := range rows {
+			entries := make([]kvs.Entry, 0, len(indexed))
+			for c := range indexed {
+				if column, ok := strings.CutPrefix(c, tableName+"."); ok {
+					e := row
+					e.ColumnName = column
+					entries = append(entries, e)
+				}
+			}
+			ik, err := indexKeys(txn, entries, indexed)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, ik...)
 
-	return finalDest, nil
+			if len(kvs.Relations(elem)) == 0 {
+				continue
+			}
+			ref, ok, err := storedUUID(txn, row)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			grandchildren, err := childKeys(txn, elem, ref, visited)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, grandchildren...)
+		}
+	}
+	return keys, nil
 }
 
-func (s Store) Close() (err error) {
-	if s.pks == nil {
-		return
+// ownedKeys lists the keys of every row of a table owned by owner, in
+// either layout, along with each of the rows. The keys of other owners'
+// columns are skipped over rather than read.
+func ownedKeys(txn *badger.Txn, tableName string, owner kvs.UUID) ([][]byte, []kvs.Entry, error) {
+	ownerID := resolveOwnerID(owner)
+	keys := [][]byte{}
+	rows := []kvs.Entry{}
+	seen := map[kvs.RowID]struct{}{}
+	addRow := func(e kvs.Entry) {
+		if _, ok := seen[e.ResolveRowID()]; !ok {
+			seen[e.ResolveRowID()] = struct{}{}
+			e.ColumnName = ""
+			rows = append(rows, e)
+		}
 	}
-	for _, seq := range s.pks {
-		if seq == nil {
-			continue
+
+	groups := [][]byte{}
+	if err := scanKeys(txn, []byte(tableName+"."), func(item *badger.Item, e kvs.Entry, isRow bool) (bool, error) {
+		if e.OwnerUUID.String() != ownerID {
+			return false, nil
 		}
-		// TODO:(tauraamui) should collect all errors into group here rather than immediately escape
-		if err = seq.Release(); err != nil {
-			return
+		if isRow {
+			keys = append(keys, item.KeyCopy(nil))
+			addRow(e)
+			return false, nil
 		}
+		groups = append(groups, append(kvs.Entry{TableName: tableName, ColumnName: e.ColumnName, OwnerUUID: owner}.PrefixKey(), '.'))
+		return false, nil
+	}); err != nil {
+		return nil, nil, err
 	}
 
-	s.pks = nil
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for _, prefix := range groups {
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			e, err := kvs.ParseKey(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, key)
+			addRow(e)
+		}
+	}
+	return keys, rows, nil
+}
 
-	return
+// storedUUID reads the UUID stored in the uuid column of row, which owns
+// its children.
+func storedUUID(txn *badger.Txn, row kvs.Entry) (kvs.UUID, bool, error) {
+	row.ColumnName = "uuid"
+	stored, err := getEntry(txn, row)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	id, ok := kvs.UUIDFromData(stored.Data, stored.Meta)
+	return id, ok, nil
 }
 
-func forEachEntryItem[T Value](index uint32, ent kvs.Entry, key []byte, dest *[]T, exclusions *map[int]int, pred func(e kvs.Entry) bool) error {
-	if len(*dest) == 0 || index >= uint32(len(*dest)) {
-		rowID, err := extractRowFromKey(string(key))
-		if err != nil {
+// deleteKeys removes the given keys in one transaction, falling back to a
+// write batch when there are too many for a single transaction, once the
+// BeforeDelete hook of the value being deleted has allowed it.
+func deleteKeys(db kvs.KVDB, keys [][]byte, value Value) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		if err := beforeDelete(value); err != nil {
 			return err
 		}
+		for _, k := range keys {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, badger.ErrTxnTooBig) {
+		return err
+	}
 
-		*dest = append(*dest, *new(T))
-
-		// for reasons, we have to just keep assigning the current "field we're on" as the full entry's ID
-		if err := kvs.LoadID(&(*dest)[index], uint32(rowID)); err != nil {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range keys {
+		if err := wb.Delete(k); err != nil {
 			return err
 		}
 	}
+	return wb.Flush()
+}
 
-	ent.RowID = index
+// Load reads the given row into dest, taking it from the store's row cache
+// when every column loaded is held there.
+func Load[T Value](s Store, dest T, owner kvs.UUID, rowID uint32, opts ...LoadOption) error {
+	return LoadByID(s, dest, owner, kvs.NumericID(uint64(rowID)), opts...)
+}
 
-	excluded := false
-	if pred != nil && !pred(ent) {
-		(*exclusions)[int(index)] = int(index)
-		excluded = true
+// LoadByID is Load for rows with IDs of any kind.
+func LoadByID[T Value](s Store, dest T, owner kvs.UUID, rowID kvs.RowID, opts ...LoadOption) error {
+	if _, err := kvs.Columns(reflect.TypeOf(dest)); err != nil {
+		return err
+	}
+
+	lo := resolveLoadOptions(opts)
+	blankEntries, loaded, err := lo.project(blankEntriesOf(dest.TableName(), owner, rowID, dest))
+	if err != nil {
+		return err
+	}
+	columns := make([]string, 0, len(loaded))
+	for _, ent := range blankEntries {
+		if _, ok := loaded[ent.ColumnName]; ok {
+			columns = append(columns, ent.ColumnName)
+		}
 	}
 
-	if !excluded {
-		if err := kvs.LoadEntry(&(*dest)[index], ent); err != nil {
+	row := kvs.Entry{TableName: dest.TableName(), OwnerUUID: owner}.WithRowID(rowID)
+	// taken before reading, so that a write committed once the read has
+	// begun keeps what's read from being cached
+	generation := s.cache.snapshot()
+	return s.db.View(func(txn *badger.Txn) error {
+		stored, ok := s.cache.get(row, columns)
+		if !ok {
+			var err error
+			if stored, err = loadRow(txn, row, columns, lo.stats); err != nil {
+				return err
+			}
+			s.cache.put(row, generation, txn.ReadTs(), columns, stored)
+		}
+
+		for _, column := range columns {
+			ent, ok := stored[column]
+			if !ok {
+				if err := kvs.LoadDefault(dest, column); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := kvs.LoadEntry(dest, ent); err != nil {
+				return err
+			}
+		}
+
+		if err := kvs.LoadRowID(dest, rowID); err != nil {
 			return err
 		}
+
+		if err := s.loadChildren(txn, reflect.ValueOf(dest).Elem(), lo.eager); err != nil {
+			return err
+		}
+		return afterLoad(dest)
+	})
+}
+
+// LoadMany loads the rows of T with the given row IDs, reading them with
+// point lookups in a single transaction rather than by scanning. Values are
+// returned in the order their IDs were given, leaving out rows which have
+// nothing stored.
+func LoadMany[T Value](s Store, owner kvs.UUID, rowIDs []uint32, opts ...LoadOption) ([]T, error) {
+	ids := make([]kvs.RowID, len(rowIDs))
+	for i, id := range rowIDs {
+		ids[i] = kvs.NumericID(uint64(id))
 	}
-	return nil
+	return LoadManyByID[T](s, owner, ids, opts...)
 }
 
-func loadItemDataIntoEntry(ent *kvs.Entry, fn func(func(val []byte) error) error) error {
-	return fn(func(val []byte) error {
-		ent.Data = val
-		return nil
-	})
+// LoadManyByID is LoadMany for rows with IDs of any kind.
+func LoadManyByID[T Value](s Store, owner kvs.UUID, rowIDs []kvs.RowID, opts ...LoadOption) ([]T, error) {
+	lo := resolveLoadOptions(opts)
+	lo.rowIDs = rowIDs
+	if lo.rowIDs == nil {
+		lo.rowIDs = []kvs.RowID{}
+	}
+	return loadAllWithPredicate[T](s, owner, nil, lo)
 }
 
-func nextRowID(db kvs.KVDB, owner kvs.UUID, tableName string, pks map[string]*badger.Sequence) (uint32, error) {
-	seq, err := resolveSequence(db, fmt.Sprintf("%s.%s", owner, tableName), pks)
-	if err != nil {
-		return 0, err
+func LoadAll[T Value](s Store, owner kvs.UUID, opts ...LoadOption) ([]T, error) {
+	return loadAllWithPredicate[T](s, owner, nil, resolveLoadOptions(opts))
+}
+
+// LoadAllWithEvaluator loads every row of T which the given predicate accepts.
+// The predicate is handed each row once all of its scanned columns have been
+// assembled, so it may inspect any combination of them.
+func LoadAllWithEvaluator[T Value](s Store, owner kvs.UUID, pred func(r Row) bool, opts ...LoadOption) ([]T, error) {
+	return loadAllWithPredicate[T](s, owner, pred, resolveLoadOptions(opts))
+}
+
+func loadAllWithPredicate[T Value](s Store, owner kvs.UUID, pred func(r Row) bool, opts loadOptions) ([]T, error) {
+	t := reflect.TypeOf(*new(T))
+	if opts.index != nil {
+		if err := ensureIndex(s, t, opts.index.column); err != nil {
+			return nil, err
+		}
 	}
 
-	s, err := seq.Next()
-	if err != nil {
-		return 0, err
+	var values []reflect.Value
+	if err := s.db.View(func(txn *badger.Txn) (err error) {
+		values, err = s.loadValues(txn, t, owner, pred, opts)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	dest := make([]T, len(values))
+	for i, v := range values {
+		dest[i] = v.Interface().(T)
 	}
-	return uint32(s), nil
+
+	return dest, nil
 }
 
-func nextSequence(seq *badger.Sequence) (uint32, error) {
-	s, err := seq.Next()
+// loadValues loads every row of the table described by t which pred
+// accepts, returning each as an addressable value of type t. AfterLoad
+// hooks run within txn, as do the loads of any eager children.
+func (s Store) loadValues(txn *badger.Txn, t reflect.Type, owner kvs.UUID, pred func(r Row) bool, opts loadOptions) ([]reflect.Value, error) {
+	v, ok := reflect.New(t).Elem().Interface().(Value)
+	if !ok {
+		return nil, fmt.Errorf("%s does not implement storage.Value", t)
+	}
+
+	if _, err := kvs.Columns(t); err != nil {
+		return nil, err
+	}
+
+	blankEntries, loaded, err := opts.project(kvs.ConvertToBlankEntries(v.TableName(), owner, 0, v))
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	columns := make([]string, 0, len(blankEntries))
+	for _, ent := range blankEntries {
+		columns = append(columns, ent.ColumnName)
 	}
-	return uint32(s), nil
+
+	var rows []Row
+	if opts.rowIDs != nil {
+		rows, err = loadRowsByID(txn, v.TableName(), owner, opts.rowIDs, columns, opts.stats)
+	} else if opts.index != nil {
+		rows, err = lookupRows(txn, v.TableName(), owner, t, *opts.index, columns, opts.stats)
+	} else {
+		rows, err = loadRows(txn, v.TableName(), owner, columns, opts.stats)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dest := make([]reflect.Value, 0, len(rows))
+	for _, row := range rows {
+		if pred != nil && !pred(row) {
+			continue
+		}
+
+		value := reflect.New(t)
+		for column := range loaded {
+			ent, ok := row.Entries[column]
+			if !ok {
+				if err := kvs.LoadDefault(value.Interface(), column); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := kvs.LoadEntry(value.Interface(), ent); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := kvs.LoadRowID(value.Interface(), row.ResolveRowID()); err != nil {
+			return nil, err
+		}
+
+		if err := s.loadChildren(txn, value.Elem(), opts.eager); err != nil {
+			return nil, err
+		}
+		if err := afterLoad(value.Interface()); err != nil {
+			return nil, err
+		}
+
+		dest = append(dest, value.Elem())
+	}
+
+	return dest, nil
 }
 
-func resolveSequence(db kvs.KVDB, sequenceKey string, pks map[string]*badger.Sequence) (*badger.Sequence, error) {
-	seq, ok := pks[sequenceKey]
-	var err error
-	if !ok {
-		seq, err = db.GetSeq([]byte(sequenceKey), 1)
+// loadChildren fills each of the named relationship fields of parent with
+// the child rows owned by the parent's UUID.
+func (s Store) loadChildren(txn *badger.Txn, parent reflect.Value, eager []string) error {
+	if len(eager) == 0 {
+		return nil
+	}
+
+	relations := map[string]kvs.Relation{}
+	for _, rel := range kvs.Relations(parent.Type()) {
+		relations[rel.Name] = rel
+	}
+
+	for _, name := range eager {
+		rel, ok := relations[name]
+		if !ok {
+			return fmt.Errorf("%s does not have a relationship named %q", parent.Addr().Interface().(Value).TableName(), name)
+		}
+
+		owner, err := parentUUID(parent)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		elem := rel.Elem
+		if elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
 		}
-		pks[sequenceKey] = seq
+
+		children, err := s.loadValues(txn, elem, owner, nil, loadOptions{})
+		if err != nil {
+			return err
+		}
+
+		field := reflect.MakeSlice(parent.Field(rel.Index).Type(), 0, len(children))
+		for _, child := range children {
+			if !referencesParent(child, rel.Column, owner) {
+				continue
+			}
+			if rel.Elem.Kind() == reflect.Pointer {
+				child = child.Addr()
+			}
+			field = reflect.Append(field, child)
+		}
+		parent.Field(rel.Index).Set(field)
+	}
+
+	return nil
+}
+
+// parentUUID resolves the UUID column of a value with child rows, which
+// its children are owned by.
+func parentUUID(v reflect.Value) (kvs.UUID, error) {
+	f, ok := kvs.FieldByColumn(v, "uuid")
+	if !ok {
+		return nil, fmt.Errorf("%s does not have a uuid column to own its children", v.Type())
+	}
+	id, ok := f.Interface().(kvs.UUID)
+	if !ok || id == nil {
+		return nil, fmt.Errorf("%s uuid column does not hold a UUID", v.Type())
 	}
+	return id, nil
+}
+
+// referencesParent reports whether child's reference column holds the
+// parent's UUID. Children without the column are owned, so they match.
+func referencesParent(child reflect.Value, column string, parent kvs.UUID) bool {
+	f, ok := kvs.FieldByColumn(child, column)
+	if !ok {
+		return true
+	}
+	return fmt.Sprint(f.Interface()) == parent.String()
+}
+
+// setReference points child's reference column at its parent, when the
+// column can hold the parent's UUID.
+func setReference(child reflect.Value, column string, parent kvs.UUID) {
+	f, ok := kvs.FieldByColumn(child, column)
+	if !ok || !f.CanSet() {
+		return
+	}
+	pv := reflect.ValueOf(parent)
+	switch {
+	case pv.Type().AssignableTo(f.Type()):
+		f.Set(pv)
+	case f.Kind() == reflect.String:
+		f.SetString(parent.String())
+	}
+}
+
+// CacheStats reports how often Load has found the rows it reads in the
+// store's row cache. It is all zeros for a store created without
+// WithRowCache.
+func (s Store) CacheStats() CacheStats {
+	return s.cache.cacheStats()
+}
 
-	return seq, nil
+// Close closes the store's ID generators, releasing the leases of every
+// row ID sequence it has fetched, and stops its row cache watching for
+// writes, returning the errors of any which failed.
+func (s Store) Close() error {
+	return errors.Join(s.ids.close(), s.cache.close())
 }
@@ -32,10 +32,16 @@
 package storage_test
 
 import (
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
 	"github.com/matryer/is"
 	"github.com/tauraamui/bluepanda/pkg/kvs"
+	"github.com/tauraamui/bluepanda/pkg/kvs/codec"
 	"github.com/tauraamui/bluepanda/pkg/kvs/storage"
 )
 
@@ -55,6 +61,23 @@ type Cake struct {
 
 func (b Cake) TableName() string { return "cakes" }
 
+type Party struct {
+	ID     uint32 `mdb:"ignore"`
+	UUID   uuid.UUID
+	Theme  string
+	Guests []Guest `mdb:"children=party"`
+}
+
+func (p Party) TableName() string { return "parties" }
+
+type Guest struct {
+	ID    uint32 `mdb:"ignore"`
+	Party uuid.UUID
+	Name  string
+}
+
+func (g Guest) TableName() string { return "guests" }
+
 func TestStoreAndLoadMultipleBalloonsSuccess(t *testing.T) {
 	is := is.New(t)
 
@@ -228,3 +251,849 @@ func TestStoreMultipleBalloonsAndCakesInSuccessionRetainsCorrectRowIDs(t *testin
 	is.Equal(mediumWhiteBalloon.ID, uint32(2))
 	is.Equal(redVelvetCake.ID, uint32(2))
 }
+
+func TestLoadRowsAssemblesRequestedColumnsByRowID(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366}))
+
+	rows, err := storage.LoadRows(store, "balloons", kvs.RootOwner{}, "size")
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+
+	is.Equal(rows[0].ID, uint32(0))
+	is.Equal(len(rows[0].Entries), 1)
+	size, ok := rows[0].Entry("size")
+	is.True(ok)
+	is.True(kvs.CompareEntryToAny(size, 695))
+
+	columns, err := storage.TableColumns(store, "balloons", kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(columns, []string{"color", "size"})
+}
+
+func TestExpandColumnsFindsOnlyTheOwnersColumnsUnderThoseAskedFor(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	other := uuid.New()
+	for i := uint32(0); i < 3; i++ {
+		is.NoErr(kvs.Store(db, kvs.Entry{TableName: "parcels", ColumnName: "to.city", OwnerUUID: kvs.RootOwner{}, RowID: i, Data: []byte("Leadworth")}))
+		is.NoErr(kvs.Store(db, kvs.Entry{TableName: "parcels", ColumnName: "tags", OwnerUUID: kvs.RootOwner{}, RowID: i, Data: []byte("[]")}))
+		is.NoErr(kvs.Store(db, kvs.Entry{TableName: "parcels", ColumnName: "to.postcode", OwnerUUID: other, RowID: i, Data: []byte("LW1")}))
+		is.NoErr(kvs.Store(db, kvs.Entry{TableName: "parcels", ColumnName: "weight", OwnerUUID: other, RowID: i, Data: []byte("3")}))
+	}
+	row := kvs.Entry{TableName: "parcels", OwnerUUID: kvs.RootOwner{}, RowID: 3}
+	note := row
+	note.ColumnName, note.Data = "notes.text", []byte("fragile")
+	is.NoErr(db.Update(func(txn *badger.Txn) error {
+		return txn.Set(kvs.RowKey(row), kvs.EncodeRow([]kvs.Entry{note}))
+	}))
+
+	columns, err := storage.ExpandColumns(store, "parcels", kvs.RootOwner{}, []string{"to", "tags.0", "notes", "weight"})
+	is.NoErr(err)
+	is.Equal(columns, []string{"to.city", "tags", "notes.text", "weight"})
+
+	columns, err = storage.ExpandColumns(store, "parcels", kvs.AnyOwner{}, []string{"to"})
+	is.NoErr(err)
+	is.Equal(columns, []string{"to.city", "to.postcode"})
+
+	columns, err = storage.TableColumns(store, "parcels", kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(columns, []string{"notes.text", "tags", "to.city"})
+}
+
+func TestLoadAllWithColumnsLeavesOtherFieldsZero(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366}))
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{}, storage.WithColumns("size"))
+	is.NoErr(err)
+
+	is.Equal(len(bs), 2)
+	is.Equal(bs[0], Balloon{ID: 0, Size: 695})
+	is.Equal(bs[1], Balloon{ID: 1, Size: 366})
+
+	b := Balloon{}
+	is.NoErr(storage.Load(store, &b, kvs.RootOwner{}, 1, storage.WithColumns("color")))
+	is.Equal(b, Balloon{ID: 1, Color: "WHITE"})
+}
+
+func TestLoadAllWithUnknownColumnReturnsError(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695}))
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{}, storage.WithColumns("color", "weight"))
+	is.Equal(err.Error(), `balloons does not have a column named "weight"`)
+	is.Equal(bs, nil)
+}
+
+func TestLoadAllWithSparseColumnsKeepsValuesOnTheirOwnRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "YELLOW", Size: 112}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "WHITE", Size: 366}))
+
+	// drop just the color column of the middle row
+	is.NoErr(db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("balloons.color.root.1"))
+	}))
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{
+		{ID: 0, Color: "RED", Size: 695},
+		{ID: 1, Size: 112},
+		{ID: 2, Color: "WHITE", Size: 366},
+	})
+
+	bs, err = storage.LoadAllWithEvaluator[Balloon](store, kvs.RootOwner{}, func(r storage.Row) bool {
+		_, hasColor := r.Entry("color")
+		return hasColor
+	})
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{
+		{ID: 0, Color: "RED", Size: 695},
+		{ID: 2, Color: "WHITE", Size: 366},
+	})
+}
+
+func TestLoadAllAfterDeletingRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	balloons := []Balloon{
+		{Color: "RED", Size: 1}, {Color: "YELLOW", Size: 2}, {Color: "WHITE", Size: 3},
+		{Color: "BLUE", Size: 4}, {Color: "GREEN", Size: 5},
+	}
+	for i := range balloons {
+		is.NoErr(store.Save(kvs.RootOwner{}, &balloons[i]))
+	}
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &balloons[1], balloons[1].ID))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &balloons[3], balloons[3].ID))
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{
+		{ID: 0, Color: "RED", Size: 1},
+		{ID: 2, Color: "WHITE", Size: 3},
+		{ID: 4, Color: "GREEN", Size: 5},
+	})
+}
+
+func TestLoadAllWithMoreThanTenRowsOrdersByRowID(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for i := 0; i < 25; i++ {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: i}))
+	}
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bs), 25)
+	for i, b := range bs {
+		is.Equal(b.ID, uint32(i))
+		is.Equal(b.Size, i)
+	}
+
+	bs, err = storage.LoadAllWithEvaluator[Balloon](store, kvs.RootOwner{}, func(r storage.Row) bool {
+		e, _ := r.Entry("size")
+		return kvs.CompareEntryToAny(e, 12) || kvs.CompareEntryToAny(e, 21)
+	})
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 12, Color: "RED", Size: 12}, {ID: 21, Color: "RED", Size: 21}})
+}
+
+func TestSaveWithCascadeAndLoadWithEagerChildren(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	party := Party{UUID: uuid.New(), Theme: "PIRATES", Guests: []Guest{{Name: "Amy"}, {Name: "Rory"}}}
+	is.NoErr(store.Save(kvs.RootOwner{}, &party, storage.WithCascade()))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Party{UUID: uuid.New(), Theme: "SPACE", Guests: []Guest{{Name: "Clara"}}}))
+
+	// cascading points each child at its parent and assigns its row ID
+	is.Equal(party.Guests[1].Party, party.UUID)
+	is.Equal(party.Guests[1].ID, uint32(1))
+
+	guests, err := storage.LoadAll[Guest](store, party.UUID)
+	is.NoErr(err)
+	is.Equal(len(guests), 2)
+
+	parties, err := storage.LoadAll[Party](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(parties), 2)
+	is.Equal(len(parties[0].Guests), 0)
+
+	parties, err = storage.LoadAll[Party](store, kvs.RootOwner{}, storage.WithEager("guests"))
+	is.NoErr(err)
+	is.Equal(len(parties[0].Guests), 2)
+	is.Equal(parties[0].Guests[0].Name, "Amy")
+	is.Equal(parties[0].Guests[1].Name, "Rory")
+	// the second party was saved without cascading, so has no guests
+	is.Equal(len(parties[1].Guests), 0)
+
+	loaded := Party{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0, storage.WithEager("guests")))
+	is.Equal(loaded.Theme, "PIRATES")
+	is.Equal(len(loaded.Guests), 2)
+
+	_, err = storage.LoadAll[Party](store, kvs.RootOwner{}, storage.WithEager("hosts"))
+	is.Equal(err.Error(), `parties does not have a relationship named "hosts"`)
+}
+
+func TestDeleteReturnsErrorsAndRemovesRow(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	store := storage.New(db)
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 695}))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Balloon{}, 0))
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bs), 0)
+
+	is.NoErr(store.Close())
+	is.NoErr(db.Close())
+	is.True(store.Delete(kvs.RootOwner{}, &Balloon{}, 0) != nil)
+}
+
+func TestDeleteCascadeRemovesOwnedRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	pirates := Party{UUID: uuid.New(), Theme: "PIRATES", Guests: []Guest{{Name: "Amy"}, {Name: "Rory"}}}
+	space := Party{UUID: uuid.New(), Theme: "SPACE", Guests: []Guest{{Name: "Clara"}}}
+	is.NoErr(store.Save(kvs.RootOwner{}, &pirates, storage.WithCascade()))
+	is.NoErr(store.Save(kvs.RootOwner{}, &space, storage.WithCascade()))
+	// rows owned by the party's UUID but not declared its children stay
+	is.NoErr(store.Save(pirates.UUID, &Balloon{Color: "BLACK", Size: 10}))
+
+	// a guest references its party, which must not take its siblings with it
+	is.NoErr(store.DeleteCascade(pirates.UUID, &Guest{}, pirates.Guests[0].ID))
+	guests, err := storage.LoadAll[Guest](store, pirates.UUID)
+	is.NoErr(err)
+	is.Equal(len(guests), 1)
+	is.Equal(guests[0].Name, "Rory")
+
+	is.NoErr(store.DeleteCascade(kvs.RootOwner{}, &Party{}, pirates.ID))
+
+	parties, err := storage.LoadAll[Party](store, kvs.RootOwner{}, storage.WithEager("guests"))
+	is.NoErr(err)
+	is.Equal(len(parties), 1)
+	is.Equal(parties[0].Theme, "SPACE")
+	is.Equal(len(parties[0].Guests), 1)
+
+	guests, err = storage.LoadAll[Guest](store, kvs.AnyOwner{})
+	is.NoErr(err)
+	is.Equal(len(guests), 1)
+
+	balloons, err := storage.LoadAll[Balloon](store, pirates.UUID)
+	is.NoErr(err)
+	is.Equal(len(balloons), 1)
+}
+
+type Project struct {
+	ID        uint32 `mdb:"ignore"`
+	UUID      uuid.UUID
+	CreatedBy uuid.UUID
+	Name      string
+	Tasks     []Task `mdb:"children=project"`
+}
+
+func (p Project) TableName() string { return "projects" }
+
+type Task struct {
+	ID      uint32 `mdb:"ignore"`
+	UUID    uuid.UUID
+	Project uuid.UUID
+	Title   string `mdb:"index"`
+	Notes   []Note `mdb:"children=task"`
+}
+
+func (t Task) TableName() string { return "tasks" }
+
+type Note struct {
+	ID   uint32 `mdb:"ignore"`
+	Task uuid.UUID
+	Text string
+}
+
+func (n Note) TableName() string { return "notes" }
+
+func TestDeleteCascadeFollowsOnlyDeclaredChildren(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	// the creator's own rows are owned by the UUID the project references
+	creator := uuid.New()
+	is.NoErr(store.Save(creator, &Balloon{Color: "GREEN", Size: 4}))
+	is.NoErr(store.Save(creator, &Task{UUID: uuid.New(), Title: "Unrelated"}))
+
+	build := Project{UUID: uuid.New(), CreatedBy: creator, Name: "Build", Tasks: []Task{{UUID: uuid.New(), Title: "Plan"}, {UUID: uuid.New(), Title: "Dig"}}}
+	keep := Project{UUID: uuid.New(), CreatedBy: creator, Name: "Keep", Tasks: []Task{{UUID: uuid.New(), Title: "Plan"}}}
+	is.NoErr(store.Save(kvs.RootOwner{}, &build, storage.WithCascade()))
+	is.NoErr(store.Save(kvs.RootOwner{}, &keep, storage.WithCascade()))
+	is.NoErr(store.Save(build.Tasks[1].UUID, &Note{Task: build.Tasks[1].UUID, Text: "bring spades"}))
+	is.NoErr(store.Save(keep.Tasks[0].UUID, &Note{Task: keep.Tasks[0].UUID, Text: "keep this"}))
+
+	is.NoErr(store.DeleteCascade(kvs.RootOwner{}, &Project{}, build.ID))
+
+	projects, err := storage.LoadAll[Project](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(projects), 1)
+	is.Equal(projects[0].Name, "Keep")
+
+	tasks, err := storage.LoadAll[Task](store, kvs.AnyOwner{})
+	is.NoErr(err)
+	is.Equal(len(tasks), 2)
+	titles := []string{tasks[0].Title, tasks[1].Title}
+	sort.Strings(titles) // ordered by owner, whose UUIDs are random
+	is.Equal(titles, []string{"Plan", "Unrelated"})
+
+	notes, err := storage.LoadAll[Note](store, kvs.AnyOwner{})
+	is.NoErr(err)
+	is.Equal(len(notes), 1)
+	is.Equal(notes[0].Text, "keep this")
+
+	balloons, err := storage.LoadAll[Balloon](store, creator)
+	is.NoErr(err)
+	is.Equal(len(balloons), 1)
+
+	// the deleted tasks' index keys went with them
+	planned, err := storage.LoadAll[Task](store, kvs.AnyOwner{}, storage.WithIndex("title", "Plan", "Dig"))
+	is.NoErr(err)
+	is.Equal(len(planned), 1)
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 0)
+}
+
+func TestDeleteCascadeFallsBackToBatchesForLargeTrees(t *testing.T) {
+	is := is.New(t)
+
+	bdb, err := badger.Open(badger.DefaultOptions("").WithLogger(nil).WithInMemory(true).WithMemTableSize(1 << 20).WithValueThreshold(1 << 10))
+	is.NoErr(err)
+	db, err := kvs.NewKVDB(bdb)
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	party := Party{UUID: uuid.New(), Theme: "CROWDED"}
+	is.NoErr(store.Save(kvs.RootOwner{}, &party))
+
+	wb := db.NewWriteBatch()
+	for i := 0; i < 20000; i++ {
+		for _, e := range kvs.ConvertToEntries("guests", party.UUID, uint32(i), Guest{Party: party.UUID, Name: "Extra"}) {
+			is.NoErr(wb.Set(e.Key(), e.Data))
+		}
+	}
+	is.NoErr(wb.Flush())
+
+	is.NoErr(store.DeleteCascade(kvs.RootOwner{}, &Party{}, party.ID))
+
+	guests, err := storage.LoadAll[Guest](store, party.UUID)
+	is.NoErr(err)
+	is.Equal(len(guests), 0)
+}
+
+type Ticket struct {
+	ID       uint32 `mdb:"ignore"`
+	Title    string `mdb:"name=summary"`
+	Status   string `mdb:"index"`
+	Priority int    `mdb:"omitempty,default=3"`
+	Reporter string `mdb:"readonly"`
+}
+
+func (t Ticket) TableName() string { return "tickets" }
+
+func TestSaveHonoursMdbTagOptions(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "Broken", Status: "open", Reporter: "amy"}))
+	is.NoErr(store.Update(kvs.RootOwner{}, &Ticket{Title: "Fixed", Status: "closed", Priority: 1, Reporter: "rory"}, 0))
+
+	columns, err := storage.TableColumns(store, "tickets", kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(columns, []string{"priority", "reporter", "status", "summary"})
+
+	loaded := Ticket{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded, Ticket{Title: "Fixed", Status: "closed", Priority: 1, Reporter: "amy"}) // readonly columns keep their first value
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "Slow", Status: "open"}))
+	ts, err := storage.LoadAll[Ticket](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(ts), 2)
+	is.Equal(ts[1].Priority, 3) // an omitted column loads its default
+
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 1))
+	is.Equal(loaded.Priority, 3)
+}
+
+func TestMdbTagErrorsAreReturned(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.Equal(store.Save(kvs.RootOwner{}, &Unknown{}).Error(), `field Reason: unknown mdb tag option "ignored_reason"`)
+	_, err = storage.LoadAll[Unknown](store, kvs.RootOwner{})
+	is.Equal(err.Error(), `field Reason: unknown mdb tag option "ignored_reason"`)
+}
+
+type Unknown struct {
+	Reason string `mdb:"ignored_reason"`
+}
+
+func (u Unknown) TableName() string { return "unknowns" }
+
+func TestIndexFollowsUpdatesAndDeletes(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for _, status := range []string{"open", "closed", "open", "open"} {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "T", Status: status}))
+	}
+
+	stats := storage.ScanStats{}
+	ts, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"), storage.WithScanStats(&stats))
+	is.NoErr(err)
+	is.Equal(len(ts), 3)
+	is.Equal([]uint32{ts[0].ID, ts[1].ID, ts[2].ID}, []uint32{0, 2, 3})
+	is.Equal(stats.KeysScanned, 3+3*3) // three index keys, then the three stored columns of each row
+
+	is.NoErr(store.Update(kvs.RootOwner{}, &Ticket{Title: "T", Status: "closed"}, 2))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Ticket{}, 3))
+
+	ts, err = storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"))
+	is.NoErr(err)
+	is.Equal(len(ts), 1)
+	is.Equal(ts[0].ID, uint32(0))
+
+	ts, err = storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "closed", "missing"))
+	is.NoErr(err)
+	is.Equal(len(ts), 2)
+
+	indexKeys := 0
+	is.NoErr(db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if _, err := kvs.ParseIndexKey(it.Item().Key()); err == nil {
+				indexKeys++
+			}
+		}
+		return nil
+	}))
+	is.Equal(indexKeys, 3) // one per remaining row
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 0)
+
+	_, err = storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("summary", "T"))
+	is.Equal(err.Error(), `tickets column "summary" is not indexed`)
+}
+
+// UnindexedTicket is Ticket as saved before its status was indexed.
+type UnindexedTicket struct {
+	ID       uint32 `mdb:"ignore"`
+	Title    string `mdb:"name=summary"`
+	Status   string
+	Priority int    `mdb:"omitempty,default=3"`
+	Reporter string `mdb:"readonly"`
+}
+
+func (t UnindexedTicket) TableName() string { return "tickets" }
+
+func TestIndexAddedAfterRowsExistFindsThem(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for _, status := range []string{"open", "closed", "open"} {
+		is.NoErr(store.Save(kvs.RootOwner{}, &UnindexedTicket{Title: "T", Status: status}))
+	}
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, []storage.Value{&UnindexedTicket{Title: "U", Status: "open"}}))
+
+	ts, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"))
+	is.NoErr(err)
+	is.Equal(len(ts), 3)
+	is.Equal([]uint32{ts[0].ID, ts[1].ID, ts[2].ID}, []uint32{0, 2, 3})
+
+	// once built, the index is kept by writes of types which don't declare it
+	is.NoErr(store.Save(kvs.RootOwner{}, &UnindexedTicket{Title: "V", Status: "open"}))
+	is.NoErr(store.Update(kvs.RootOwner{}, &UnindexedTicket{Title: "T", Status: "closed"}, 0))
+	is.NoErr(store.PatchMap("tickets", kvs.RootOwner{}, 1, map[string]any{"status": "open"}))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &UnindexedTicket{}, 2))
+
+	stats := storage.ScanStats{}
+	ts, err = storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"), storage.WithScanStats(&stats))
+	is.NoErr(err)
+	is.Equal(len(ts), 3)
+	is.Equal([]uint32{ts[0].ID, ts[1].ID, ts[2].ID}, []uint32{1, 3, 4})
+	is.Equal(stats.KeysScanned, 3+3*3) // found through the index, not by scanning
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 0)
+}
+
+func TestIndexLookupsScanUntilTheIndexIsBuilt(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &UnindexedTicket{Title: "T", Status: "open"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "U", Status: "open"}))
+
+	// as if another lookup were still building it
+	is.NoErr(db.Update(func(txn *badger.Txn) error {
+		return txn.Set(kvs.IndexStateKey("tickets", "status"), []byte("building"))
+	}))
+
+	ts, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"), storage.WithColumns("summary"))
+	is.NoErr(err)
+	is.Equal(ts, []Ticket{{ID: 0, Title: "T"}, {ID: 1, Title: "U"}})
+}
+
+type Survey struct {
+	ID     uint32 `mdb:"ignore"`
+	Name   string
+	Rating *int
+	Note   *string
+}
+
+func (s Survey) TableName() string { return "surveys" }
+
+func TestPointerFieldsTellNullFromZeroAndAbsent(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	zero, note := 0, "late"
+	is.NoErr(store.Save(kvs.RootOwner{}, &Survey{Name: "zero", Rating: &zero, Note: &note}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Survey{Name: "null"}))
+	is.NoErr(kvs.Store(db, kvs.Entry{TableName: "surveys", ColumnName: "name", OwnerUUID: kvs.RootOwner{}, RowID: 2, Data: []byte("absent"), Meta: codec.Meta(codec.TagString)}))
+
+	rows, err := storage.LoadRows(store, "surveys", kvs.RootOwner{}, "rating")
+	is.NoErr(err)
+	is.Equal(len(rows), 2)
+	is.Equal(rows[1].Entries["rating"].Meta, codec.Null) // nil pointers are stored as null
+
+	ss, err := storage.LoadAll[Survey](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(ss), 3)
+	is.Equal(*ss[0].Rating, 0)
+	is.Equal(*ss[0].Note, "late")
+	is.Equal(ss[1].Rating, nil)
+	is.Equal(ss[1].Note, nil)
+	is.Equal(ss[2].Name, "absent")
+	is.Equal(ss[2].Rating, nil)
+
+	loaded := Survey{Rating: &zero}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 1))
+	is.Equal(loaded.Rating, nil)
+}
+
+type Destination struct {
+	City     string
+	Postcode string `mdb:"index"`
+}
+
+// Shipment has Entries and LoadEntry methods generated by bluepanda-gen.
+type Shipment struct {
+	ID       uint32 `mdb:"ignore"`
+	Sender   kvs.UUID
+	Contents string `mdb:"name=label"`
+	Weight   float64
+	Fragile  bool `mdb:"omitempty"`
+	Sent     time.Time
+	To       Destination
+	Tags     []string
+}
+
+func (s Shipment) TableName() string { return "shipments" }
+
+func TestGeneratedMethodsStoreWhatReflectionWould(t *testing.T) {
+	is := is.New(t)
+
+	sender := uuid.New()
+	shipment := Shipment{
+		Sender:   sender,
+		Contents: "teacups",
+		Weight:   1.5,
+		Sent:     time.Date(2023, 9, 1, 10, 30, 0, 0, time.UTC),
+		To:       Destination{City: "Leadworth", Postcode: "LW1"},
+		Tags:     []string{"kitchen"},
+	}
+
+	generated, err := shipment.Entries("shipments", kvs.RootOwner{}, 4)
+	is.NoErr(err)
+	is.Equal(generated, kvs.ConvertToEntries("shipments", kvs.RootOwner{}, 4, &shipment))
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &shipment))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Shipment{Contents: "saucers", To: Destination{Postcode: "LW2"}}))
+
+	loaded := Shipment{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, shipment.ID))
+	is.Equal(loaded, shipment)
+
+	shipments, err := storage.LoadAll[Shipment](store, kvs.RootOwner{}, storage.WithIndex("to.postcode", "LW2"))
+	is.NoErr(err)
+	is.Equal(len(shipments), 1)
+	is.Equal(shipments[0].Contents, "saucers")
+
+	is.Equal(kvs.LoadEntry(&loaded, kvs.Entry{ColumnName: "contents"}).Error(), `struct does not have a field with name "contents"`)
+}
+
+func TestSaveManyReservesRowIDsAlongsideSave(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	first := Balloon{Color: "RED", Size: 695}
+	is.NoErr(store.Save(kvs.RootOwner{}, &first))
+
+	yellow, cake, white := Balloon{Color: "YELLOW", Size: 112}, Cake{Type: "CARROT", Calories: 280}, Balloon{Color: "WHITE", Size: 366}
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, []storage.Value{&yellow, &cake, &white}))
+	is.Equal(yellow.ID, uint32(1))
+	is.Equal(cake.ID, uint32(0))
+	is.Equal(white.ID, uint32(2))
+
+	last := Balloon{Color: "BLUE", Size: 40}
+	is.NoErr(store.Save(kvs.RootOwner{}, &last))
+	is.Equal(last.ID, uint32(3))
+
+	bs, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{first, yellow, white, last})
+
+	cs, err := storage.LoadAll[Cake](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(cs, []Cake{cake})
+}
+
+func TestIndexKeysStayTheSameSizeHoweverBigTheValue(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	// hex encoded whole, this would be over badger's largest key
+	long := strings.Repeat("closed because ", 3000)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "A", Status: long}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Ticket{Title: "B", Status: "open"}))
+
+	ts, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", long))
+	is.NoErr(err)
+	is.Equal(len(ts), 1)
+	is.Equal(ts[0].Title, "A")
+
+	sizes := map[int]struct{}{}
+	is.NoErr(db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if _, err := kvs.ParseIndexKey(it.Item().Key()); err == nil {
+				sizes[len(it.Item().Key())] = struct{}{}
+			}
+		}
+		return nil
+	}))
+	is.Equal(len(sizes), 1)
+}
+
+func TestSaveManyWritesIndexesAndRowMajorRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	tickets := []storage.Value{}
+	for _, status := range []string{"open", "closed", "open"} {
+		tickets = append(tickets, &Ticket{Title: "T", Status: status})
+	}
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, tickets))
+
+	ts, err := storage.LoadAll[Ticket](store, kvs.RootOwner{}, storage.WithIndex("status", "open"))
+	is.NoErr(err)
+	is.Equal(len(ts), 2)
+	is.Equal([]uint32{ts[0].ID, ts[1].ID}, []uint32{0, 2})
+	is.Equal(ts[0].Priority, 3) // defaults apply as they would through Save
+
+	report, err := kvs.Check(db)
+	is.NoErr(err)
+	is.Equal(len(report.Problems), 0)
+
+	readings := []storage.Value{
+		&PackedReading{Station: "north", Value: 21.5, Unit: "C"},
+		&PackedReading{Station: "south", Value: 19, Unit: "C", Note: "shaded"},
+	}
+	is.NoErr(store.SaveMany(kvs.RootOwner{}, readings))
+
+	rs, err := storage.LoadAll[PackedReading](store, kvs.RootOwner{}, storage.WithIndex("station", "south"))
+	is.NoErr(err)
+	is.Equal(rs, []PackedReading{{ID: 1, Station: "south", Value: 19, Unit: "C", Note: "shaded"}})
+}
+
+func TestLoadManyReturnsRowsInTheOrderAsked(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for _, color := range []string{"RED", "YELLOW", "WHITE", "BLUE"} {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: color, Size: len(color)}))
+	}
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Balloon{}, 1))
+
+	bs, err := storage.LoadMany[Balloon](store, kvs.RootOwner{}, []uint32{3, 1, 0, 9})
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 3, Color: "BLUE", Size: 4}, {ID: 0, Color: "RED", Size: 3}})
+
+	bs, err = storage.LoadMany[Balloon](store, kvs.RootOwner{}, []uint32{2}, storage.WithColumns("color"))
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 2, Color: "WHITE"}})
+
+	bs, err = storage.LoadMany[Balloon](store, kvs.RootOwner{}, nil)
+	is.NoErr(err)
+	is.Equal(len(bs), 0)
+
+	_, err = storage.LoadMany[Balloon](store, kvs.AnyOwner{}, []uint32{0})
+	is.Equal(err.Error(), "rows of balloons can only be read by ID for a single owner")
+}